@@ -1,169 +1,281 @@
 package smugmug
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"iter"
+	"sort"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/client"
 )
 
-type requestsHandler interface {
-	get(string, interface{}) error
+// api returns the typed API calling the endpoints with the requests handler
+func (w *Worker) api() *client.API {
+	return client.NewAPI(w.req)
 }
 
-// userAlbums returns the list of albums belonging to the suer
-func (w *Worker) userAlbums() ([]album, error) {
-	uri := w.userAlbumsURI()
-	return w.albums(uri)
+// userAlbums iterates over the albums belonging to the user, requesting them one page at a time
+func (w *Worker) userAlbums(ctx context.Context) iter.Seq2[client.Album, error] {
+	return func(yield func(client.Album, error) bool) {
+		uri, err := w.userAlbumsURI(ctx)
+		if err != nil {
+			yield(client.Album{}, err)
+			return
+		}
+		for a, err := range w.albums(ctx, uri) {
+			if !yield(a, err) {
+				return
+			}
+		}
+	}
 }
 
 // currentUser returns the nickname of the authenticated user
-func (w *Worker) currentUser() (string, error) {
-	var u currentUser
-	if err := w.req.get("/api/v2!authuser", &u); err != nil {
+func (w *Worker) currentUser(ctx context.Context) (string, error) {
+	u, err := w.api().AuthUser(ctx)
+	if err != nil {
 		return "", err
 	}
-	return u.Response.User.NickName, nil
+	return u.NickName, nil
 }
 
 // userAlbumsURI returns the URI of the first page of the user albums. It's intended to be used
 // as argument for a call to albums()
-func (w *Worker) userAlbumsURI() string {
-	var u user
-	path := fmt.Sprintf("/api/v2/user/%s", w.cfg.username)
-	w.req.get(path, &u)
-	return u.Response.User.Uris.UserAlbums.URI
+func (w *Worker) userAlbumsURI(ctx context.Context) (string, error) {
+	u, err := w.api().User(ctx, w.cfg.username)
+	if err != nil {
+		return "", err
+	}
+	return u.Uris.UserAlbums.URI, nil
 }
 
-// albums make multiple calls to obtain the full list of user albums. It calls the albums endpoint
-// unless the "NextPage" value in the response is empty
-func (w *Worker) albums(firstURI string) ([]album, error) {
-	uri := firstURI
-	var albums []album
-	for uri != "" {
-		var a albumsResponse
-		if err := w.req.get(uri, &a); err != nil {
-			return albums, fmt.Errorf("error getting albums from %s. Error: %v", uri, err)
+// albums iterates over a list of albums, requesting the next page once the albums of the
+// current one have been consumed. The iteration ends after yielding an error. The total number
+// of albums reported by SmugMug is stored in the metrics as soon as the first page is received
+func (w *Worker) albums(ctx context.Context, firstURI string) iter.Seq2[client.Album, error] {
+	return func(yield func(client.Album, error) bool) {
+		var found int64
+		for page, err := range w.api().AlbumPages(ctx, firstURI, w.pageOptions()...) {
+			if err != nil {
+				yield(client.Album{}, fmt.Errorf("error getting albums from %s. Error: %w", firstURI, err))
+				return
+			}
+			found += int64(len(page.Items))
+			w.metrics.albumsTotal.Store(max(int64(page.Pages.Total), found))
+
+			for _, album := range page.Items {
+				if !yield(album, nil) {
+					return
+				}
+			}
 		}
-		albums = append(albums, a.Response.Album...)
-		uri = a.Response.Pages.NextPage
 	}
-	return albums, nil
 }
 
-// albumImages make multiple calls to obtain all images of an album. It calls the album images
-// endpoint unless the "NextPage" value in the response is empty
-func (w *Worker) albumImages(firstURI string, albumPath string) ([]albumImage, error) {
-	uri := firstURI
-	var images []albumImage
-	for uri != "" {
-		if w.quitting {
-			return nil, nil
-		}
-		var a albumImagesResponse
-		if err := w.req.get(uri, &a); err != nil {
-			return images, fmt.Errorf("error getting album images from %s. Error: %v", uri, err)
+// albumImages iterates over the images of an album, requesting the next page once the images
+// of the current one have been consumed. The iteration ends after yielding an error
+func (w *Worker) albumImages(ctx context.Context, firstURI string, albumPath string) iter.Seq2[albumImage, error] {
+	return func(yield func(albumImage, error) bool) {
+		opts, err := w.albumImagesOptions()
+		if err != nil {
+			yield(albumImage{}, err)
+			return
 		}
+		for page, err := range w.api().AlbumImagePages(ctx, firstURI, opts...) {
+			if err != nil {
+				yield(albumImage{}, fmt.Errorf("error getting album images from %s. Error: %w", firstURI, err))
+				return
+			}
 
-		// If the album is empty, a.Response.AlbumImage is missing instead of an empty array (weird...)
-		if a.Response.AlbumImage == nil {
-			log.Infof("album is empty: %s", albumPath)
-
-			break
-		}
+			// If the album is empty, the images are missing instead of an empty array (weird...)
+			if page.Items == nil {
+				log.Infof("album is empty: %s", albumPath)
+				return
+			}
 
-		// Loop over response in inject the albumPath and then append to the images
-		for _, i := range a.Response.AlbumImage {
-			i.AlbumPath = albumPath
-			if err := i.buildFilename(w.filenameTmpl); err != nil {
-				return nil, fmt.Errorf("cannot build image filename: %v", err)
+			// Loop over response in inject the albumPath and then yield the images
+			for _, item := range page.Items {
+				i := albumImage{AlbumImage: item, AlbumPath: albumPath}
+				expand(page, &i)
+				if err := i.buildFilename(w.filenameTmpl); err != nil {
+					yield(albumImage{}, fmt.Errorf("cannot build image filename: %w", err))
+					return
+				}
+				if !yield(i, nil) {
+					return
+				}
 			}
-			images = append(images, i)
 		}
-		uri = a.Response.Pages.NextPage
 	}
+}
 
-	return images, nil
+// expand sets the LargestVideo and the ImageMetadata of the image if they have been inlined in
+// the page, so that they don't need other calls
+func expand(page *client.Page[client.AlbumImage], img *albumImage) {
+	if uri := img.Uris.LargestVideo.URI; uri != "" {
+		var v client.VideoResponse
+		if page.Expansion(uri, &v) {
+			img.largestVideo = &v.LargestVideo
+		}
+	}
+	if uri := img.Uris.ImageMetadata.URI; uri != "" {
+		var m client.ImageMetadata
+		if page.Expansion(uri, &m) {
+			img.created = m.DateTimeCreated
+		}
+	}
 }
 
-func (w *Worker) imageTimestamp(img albumImage) time.Time {
-	var i imageMetadataResponse
-	if err := w.req.get(img.Uris.ImageMetadata.Uri, &i); err != nil {
+// imageTimestamp returns the creation time from the image metadata, calling the metadata
+// endpoint unless it has been inlined in the album images response
+func (w *Worker) imageTimestamp(ctx context.Context, img albumImage) time.Time {
+	if !img.created.IsZero() {
+		return img.created
+	}
+	m, err := w.api().ImageMetadata(ctx, img.Uris.ImageMetadata.URI)
+	if err != nil {
 		return time.Time{}
 	}
-	return i.Response.DateTimeCreated
+	return m.DateTimeCreated
 }
 
-// saveImages calls saveImage or saveVideo to save a list of album images to the given folder
-func (w *Worker) saveImages(images []albumImage, folder string) {
-	for _, image := range images {
-		if w.quitting {
-			return
-		}
-		w.downloadsCh <- &downloadInfo{
-			image:  image,
-			folder: folder,
-		}
+// pageOptions returns the options setting the page size of the lists, if configured
+func (w *Worker) pageOptions() []client.RequestOption {
+	if w.cfg.HTTPPageSize <= 0 {
+		return nil
+	}
+	return []client.RequestOption{client.Count(w.cfg.HTTPPageSize)}
+}
+
+// albumImagesOptions returns the options of the album images calls. When the expansions are
+// enabled, the responses include only the fields used by the backup and inline the largest
+// video and, if the metadata times are used, the metadata of every image, saving those calls
+func (w *Worker) albumImagesOptions() ([]client.RequestOption, error) {
+	opts := w.pageOptions()
+	if !w.cfg.HTTPExpansions {
+		return opts, nil
+	}
+
+	expand := map[string]any{
+		"LargestVideo": map[string][]string{"filter": {"MD5", "Size", "Url"}},
 	}
+	if w.cfg.UseMetadataTimes {
+		expand["ImageMetadata"] = map[string][]string{"filter": {"DateTimeCreated"}}
+	}
+	config, err := json.Marshal(map[string]any{"expand": expand})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(expand))
+	for name := range expand {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return append(opts,
+		client.Filter(albumImageFields...),
+		client.FilterURI("ImageMetadata", "LargestVideo"),
+		client.Expand(names...),
+		client.Config(string(config)),
+	), nil
 }
 
-// saveImage saves an image to the given folder unless its name is empty
-func (w *Worker) saveImage(image albumImage, folder string) error {
+// queueImage sends an album image to the downloaders, to be saved to the folder of the album.
+// It returns false if interrupted by the cancellation of ctx
+func (w *Worker) queueImage(ctx context.Context, image albumImage, album *albumProgress) bool {
+	w.metrics.downloadsQueue.Add(1)
+	album.pending.Add(1)
+	select {
+	case w.downloadsCh <- &downloadInfo{image: image, folder: album.folder, album: album}:
+		w.metrics.bytesQueued.Add(image.downloadSize())
+		return true
+	case <-ctx.Done():
+		w.metrics.downloadsQueue.Add(-1)
+		album.pending.Add(-1)
+		return false
+	}
+}
+
+// saveImage saves an image to the given folder unless its name is empty. It returns true if
+// the image has been downloaded, false if it has been skipped
+func (w *Worker) saveImage(ctx context.Context, image albumImage, folder string) (bool, error) {
 	if image.Name() == "" {
-		return errors.New("unable to find valid image filename, skipping")
+		return false, errors.New("unable to find valid image filename, skipping")
 	}
 	dest := fmt.Sprintf("%s/%s", folder, image.Name())
 	log.Debug(image.ArchivedUri)
 
-	ok, err := w.downloadFn(dest, image.ArchivedUri, image.ArchivedSize)
+	ok, err := w.fetch(ctx, dest, image.ArchivedUri, image.ArchivedSize, image.ArchivedMD5)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if w.cfg.UseMetadataTimes && (ok || w.cfg.ForceMetadataTimes) {
-		return w.setChTime(image, dest)
+		return ok, w.setChTime(ctx, image, dest)
 	}
 
-	return nil
+	return ok, nil
 }
 
-// saveVideo saves a video to the given folder unless its name is empty or is still under processing
-func (w *Worker) saveVideo(image albumImage, folder string) error {
+// saveVideo saves a video to the given folder unless its name is empty or is still under processing.
+// It returns true if the video has been downloaded, false if it has been skipped
+func (w *Worker) saveVideo(ctx context.Context, image albumImage, folder string) (bool, error) {
 	if image.Name() == "" {
-		return errors.New("unable to find valid video filename, skipping")
+		return false, errors.New("unable to find valid video filename, skipping")
 	}
 	dest := fmt.Sprintf("%s/%s", folder, image.Name())
 
 	if image.Processing {
 		if image.Status == "Preprocess" && image.SubStatus == "CanNotProcess" {
-			return fmt.Errorf("skipping video %s because cannot be processed, %#v", image.Name(), image)
+			return false, fmt.Errorf("skipping video %s because cannot be processed, %#v", image.Name(), image)
 		}
 		if !w.cfg.ForceVideoDownload { // Skip videos if under processing
-			return fmt.Errorf("skipping video %s because under processing, %#v", image.Name(), image)
+			return false, fmt.Errorf("skipping video %s because under processing, %#v", image.Name(), image)
 		}
 	}
 
-	var v albumVideo
-	log.Debug("(saveVideo) getting ", image.Uris.LargestVideo.Uri)
-	if err := w.req.get(image.Uris.LargestVideo.Uri, &v); err != nil {
-		return fmt.Errorf("cannot get URI for video %+v. Error: %v", image, err)
+	video, err := w.largestVideo(ctx, image)
+	if err != nil {
+		return false, err
+	}
+	if image.largestVideo == nil {
+		// The size wasn't known when the video was queued
+		w.metrics.bytesQueued.Add(video.Size)
+		defer w.metrics.bytesHandled.Add(video.Size)
 	}
 
-	ok, err := w.downloadFn(dest, v.Response.LargestVideo.Url, v.Response.LargestVideo.Size)
+	ok, err := w.fetch(ctx, dest, video.Url, video.Size, video.MD5)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if w.cfg.UseMetadataTimes && (ok || w.cfg.ForceMetadataTimes) {
-		return w.setChTime(image, dest)
+		return ok, w.setChTime(ctx, image, dest)
 	}
 
-	return nil
+	return ok, nil
+}
+
+// largestVideo returns the largest version of the video, inlined in the album images response
+// or requested to the API
+func (w *Worker) largestVideo(ctx context.Context, image albumImage) (*client.LargestVideo, error) {
+	if image.largestVideo != nil {
+		return image.largestVideo, nil
+	}
+	log.Debug("(largestVideo) getting ", image.Uris.LargestVideo.URI)
+	v, err := w.api().LargestVideo(ctx, image.Uris.LargestVideo.URI)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get URI for video %s. Error: %w", image.Name(), err)
+	}
+	return v, nil
 }
 
-func (w *Worker) setChTime(image albumImage, dest string) error {
+func (w *Worker) setChTime(ctx context.Context, image albumImage, dest string) error {
 	// Try first with the date in the image, to avoid making an additional call
 	dt := image.DateTimeOriginal
 	if dt == "" {
@@ -171,11 +283,11 @@ func (w *Worker) setChTime(image albumImage, dest string) error {
 	}
 	created, err := time.Parse(time.RFC3339, dt)
 	if err != nil || created.IsZero() {
-		created = w.imageTimestamp(image)
+		created = w.imageTimestamp(ctx, image)
 	}
 	if !created.IsZero() {
 		log.Debugf("setting chtime %v for %s", created, dest)
-		return os.Chtimes(dest, time.Now(), created)
+		return w.store.Chtimes(dest, time.Now(), created)
 	}
 
 	return nil
@@ -1,35 +1,49 @@
 package smugmug
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tommyblue/smugmug-backup/client"
+	"github.com/tommyblue/smugmug-backup/storage"
 )
 
 type albumMockHandler struct {
 	called int
+	failOn int // Page number (starting from 1) failing, if > 0
 }
 
-func (c *albumMockHandler) get(url string, obj interface{}) error {
+func (c *albumMockHandler) Get(_ context.Context, _ string, obj any, _ ...client.RequestOption) error {
 	defer func() { c.called++ }()
-	a := obj.(*albumsResponse)
-	a.Response.Album = []album{
-		{},
-		{},
+	if c.failOn == c.called+1 {
+		return errors.New("boom")
 	}
+	pages := client.Pages{Total: 4}
 	if c.called == 0 {
-		a.Response.Pages.NextPage = "something"
-		return nil
+		pages.NextPage = "something"
 	}
-	a.Response.Pages.NextPage = ""
-	return nil
+	return respond(obj, map[string]any{"Album": []client.Album{{}, {}}, "Pages": pages})
 }
 
 func TestGetAlbums(t *testing.T) {
 	w := &Worker{
-		req: &albumMockHandler{},
+		cfg:     &Conf{},
+		req:     &albumMockHandler{},
+		metrics: newMetrics(),
 	}
-	albums, err := w.albums("someurl")
-	if err != nil {
-		t.Errorf("Unexpected error %v", err)
+	var albums []client.Album
+	for a, err := range w.albums(context.Background(), "someurl") {
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		albums = append(albums, a)
 	}
 	if w.req.(*albumMockHandler).called != 2 {
 		t.Errorf("Called, want 2, got %d", w.req.(*albumMockHandler).called)
@@ -37,41 +51,179 @@ func TestGetAlbums(t *testing.T) {
 	if len(albums) != 4 {
 		t.Errorf("Want 4, got %d", len(albums))
 	}
+	if total := w.metrics.albumsTotal.Load(); total != 4 {
+		t.Errorf("Total, want 4, got %d", total)
+	}
+}
+
+func TestGetAlbumsStreaming(t *testing.T) {
+	// Stopping the iteration doesn't request the next pages
+	w := &Worker{
+		cfg:     &Conf{},
+		req:     &albumMockHandler{},
+		metrics: newMetrics(),
+	}
+	for range w.albums(context.Background(), "someurl") {
+		break
+	}
+	if w.req.(*albumMockHandler).called != 1 {
+		t.Errorf("Called, want 1, got %d", w.req.(*albumMockHandler).called)
+	}
+
+	// A failing page doesn't discard the albums of the previous ones
+	w.req = &albumMockHandler{failOn: 2}
+	var albums []client.Album
+	var gotErr error
+	for a, err := range w.albums(context.Background(), "someurl") {
+		if err != nil {
+			gotErr = err
+			continue
+		}
+		albums = append(albums, a)
+	}
+	if gotErr == nil {
+		t.Errorf("Want error")
+	}
+	if len(albums) != 2 {
+		t.Errorf("Want 2, got %d", len(albums))
+	}
 }
 
 type albumImages struct {
 	called int
 }
 
-func (c *albumImages) get(url string, obj interface{}) error {
+func (c *albumImages) Get(_ context.Context, _ string, obj any, _ ...client.RequestOption) error {
 	defer func() { c.called++ }()
-	a := obj.(*albumImagesResponse)
-	a.Response.AlbumImage = []albumImage{
-		{FileName: "value"},
-		{FileName: "value"},
-	}
+	var pages client.Pages
 	if c.called == 0 {
-		a.Response.Pages.NextPage = "something"
-		return nil
+		pages.NextPage = "something"
 	}
-	a.Response.Pages.NextPage = ""
-	return nil
+	return respond(obj, map[string]any{
+		"AlbumImage": []client.AlbumImage{{FileName: "value"}, {FileName: "value"}},
+		"Pages":      pages,
+	})
 }
 
 func TestGetAlbumImages(t *testing.T) {
 	tmpl, _ := buildFilenameTemplate("")
 	w := &Worker{
+		cfg:          &Conf{},
 		req:          &albumImages{},
 		filenameTmpl: tmpl,
 	}
-	albums, err := w.albumImages("someurl", "myAlbumPath")
-	if err != nil {
-		t.Errorf("Unexpected error %v", err)
+	var images []albumImage
+	for i, err := range w.albumImages(context.Background(), "someurl", "myAlbumPath") {
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		images = append(images, i)
 	}
 	if w.req.(*albumImages).called != 2 {
 		t.Errorf("Called, want 2, got %d", w.req.(*albumImages).called)
 	}
-	if len(albums) != 4 {
-		t.Errorf("Want 4, got %d", len(albums))
+	if len(images) != 4 {
+		t.Errorf("Want 4, got %d", len(images))
+	}
+}
+
+// expansionsHandler returns a page of album images with the largest video and the metadata
+// inlined, failing any other call
+type expansionsHandler struct {
+	urls []string
+}
+
+func (h *expansionsHandler) Get(_ context.Context, uri string, obj any, opts ...client.RequestOption) error {
+	if !strings.HasPrefix(uri, "/api/v2/album/1!images") {
+		return fmt.Errorf("unexpected call to %s", uri)
+	}
+	uri, err := client.ApplyOptions(uri, opts...)
+	if err != nil {
+		return err
+	}
+	h.urls = append(h.urls, uri)
+	return json.Unmarshal([]byte(`{
+		"Response": {
+			"AlbumImage": [{
+				"FileName": "video.mp4",
+				"ImageKey": "abc123",
+				"IsVideo": true,
+				"Uris": {
+					"ImageMetadata": {"Uri": "/api/v2/image/abc123!metadata"},
+					"LargestVideo": {"Uri": "/api/v2/image/abc123!largestvideo"}
+				}
+			}]
+		},
+		"Expansions": {
+			"/api/v2/image/abc123!metadata": {"DateTimeCreated": "2020-01-02T03:04:05Z"},
+			"/api/v2/image/abc123!largestvideo": {"LargestVideo": {"MD5": "d41d8cd98f00b204e9800998ecf8427e", "Size": 42, "Url": "https://video/url"}}
+		}
+	}`), obj)
+}
+
+func TestAlbumImagesExpansions(t *testing.T) {
+	h := &expansionsHandler{}
+	tmpl, _ := buildFilenameTemplate("")
+	var downloaded string
+	fs := afero.NewMemMapFs()
+	w := &Worker{
+		cfg:          &Conf{HTTPPageSize: 50, HTTPExpansions: true, UseMetadataTimes: true},
+		req:          h,
+		filenameTmpl: tmpl,
+		downloadFn: func(_ context.Context, dest, url string, size int64, md5 string) (bool, error) {
+			downloaded = fmt.Sprintf("%s %d %s", url, size, md5)
+			return true, afero.WriteFile(fs, dest, nil, 0o644)
+		},
+		store: storage.NewFs(fs),
+	}
+
+	var images []albumImage
+	for i, err := range w.albumImages(context.Background(), "/api/v2/album/1!images", "album") {
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		images = append(images, i)
+	}
+	if len(images) != 1 {
+		t.Fatalf("want 1 image, got %d", len(images))
+	}
+
+	u, err := url.Parse(h.urls[0])
+	if err != nil {
+		t.Fatalf("invalid url %s: %v", h.urls[0], err)
+	}
+	q := u.Query()
+	if q.Get("count") != "50" || q.Get("_expand") != "ImageMetadata,LargestVideo" || q.Get("_filter") == "" {
+		t.Fatalf("unexpected query %s", u.RawQuery)
+	}
+	if !strings.Contains(q.Get("_config"), `"filter":["MD5","Size","Url"]`) {
+		t.Fatalf("unexpected _config %s", q.Get("_config"))
+	}
+
+	// The video and its timestamp are taken from the expansions, without other calls
+	if _, err := w.saveVideo(context.Background(), images[0], "album"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if downloaded != "https://video/url 42 d41d8cd98f00b204e9800998ecf8427e" {
+		t.Fatalf("want the expanded video, got %q", downloaded)
+	}
+	if len(h.urls) != 1 {
+		t.Fatalf("want 1 call, got %v", h.urls)
+	}
+	info, err := fs.Stat("album/video.mp4")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !info.ModTime().Equal(want) {
+		t.Fatalf("modtime, want %s, got %s", want, info.ModTime())
+	}
+
+	// Without expansions only the page size is set
+	w.cfg.HTTPExpansions = false
+	h.urls = nil
+	for range w.albumImages(context.Background(), "/api/v2/album/1!images", "album") {
+	}
+	if h.urls[0] != "/api/v2/album/1!images?count=50" {
+		t.Fatalf("unexpected url %s", h.urls[0])
 	}
 }
@@ -0,0 +1,101 @@
+package smugmug
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
+)
+
+// sidecarSuffix is appended to the names of the images and videos to name their metadata
+// sidecars, saved in the archives
+const sidecarSuffix = ".json"
+
+// sidecar is the metadata of an image or video saved next to it in the archives
+type sidecar struct {
+	FileName         string `json:"FileName"`
+	ImageKey         string `json:"ImageKey"`
+	ArchivedMD5      string `json:"ArchivedMD5"`
+	ArchivedSize     int64  `json:"ArchivedSize"`
+	ArchivedUri      string `json:"ArchivedUri"`
+	IsVideo          bool   `json:"IsVideo"`
+	DateTimeOriginal string `json:"DateTimeOriginal,omitempty"`
+	DateTimeUploaded string `json:"DateTimeUploaded,omitempty"`
+	Caption          string `json:"Caption,omitempty"`
+	Keywords         string `json:"Keywords,omitempty"`
+	Latitude         string `json:"Latitude,omitempty"`
+	Longitude        string `json:"Longitude,omitempty"`
+}
+
+// albumProgress counts the items of an album not processed yet, so that the album can be
+// completed (its archive written) as soon as they are done
+type albumProgress struct {
+	folder  string
+	pending atomic.Int64
+}
+
+// newAlbumProgress returns the progress of an album whose items are being listed. The listing
+// counts as an item, done when all the items have been queued
+func newAlbumProgress(folder string) *albumProgress {
+	p := &albumProgress{folder: folder}
+	p.pending.Add(1)
+	return p
+}
+
+// itemDone marks an item of the album as processed. When all the items are done, the files of
+// the album are added to its archive
+func (w *Worker) itemDone(p *albumProgress) {
+	if p == nil || p.pending.Add(-1) > 0 {
+		return
+	}
+	a, ok := w.store.(*storage.Archive)
+	if !ok {
+		return
+	}
+	if err := a.FlushFolder(p.folder); err != nil {
+		log.WithError(err).Errorf("cannot archive the album %s", p.folder)
+		w.errors.Add(1)
+	}
+}
+
+// saveSidecar saves the metadata of the image or video in the given folder, unless a sidecar
+// with the same size exists
+func (w *Worker) saveSidecar(image albumImage, folder string) error {
+	data, err := json.MarshalIndent(sidecar{
+		FileName:         image.FileName,
+		ImageKey:         image.ImageKey,
+		ArchivedMD5:      image.ArchivedMD5,
+		ArchivedSize:     image.ArchivedSize,
+		ArchivedUri:      image.ArchivedUri,
+		IsVideo:          image.IsVideo,
+		DateTimeOriginal: image.DateTimeOriginal,
+		DateTimeUploaded: image.DateTimeUploaded,
+		Caption:          image.Caption,
+		Keywords:         image.Keywords,
+		Latitude:         image.Latitude,
+		Longitude:        image.Longitude,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dest := fmt.Sprintf("%s/%s%s", folder, image.Name(), sidecarSuffix)
+	sum := md5.Sum(data)
+	same, err := sameFile(w.store, dest, int64(len(data)), hex.EncodeToString(sum[:]))
+	if err != nil || same {
+		return err
+	}
+	file, err := storage.CreateAtomic(w.store, dest)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Abort()
+		return fmt.Errorf("%s: %w", dest, err)
+	}
+	return file.Close()
+}
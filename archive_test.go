@@ -0,0 +1,85 @@
+package smugmug
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tommyblue/smugmug-backup/storage"
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestRunArchive(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	fs := afero.NewMemMapFs()
+	archive := storage.NewArchive(storage.NewFs(fs), storage.Tar, t.TempDir())
+	w := newTestWorker(t, func(_ context.Context, dest, _ string, _ int64, _ string) (bool, error) {
+		f, err := storage.CreateAtomic(archive, dest)
+		if err != nil {
+			return false, err
+		}
+		io.WriteString(f, dest)
+		return true, f.Close()
+	})
+	w.req = &bigAccountHandler{albums: 3, images: 5}
+	w.cfg.Archive = string(storage.Tar)
+	w.store = archive
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := range 3 {
+		folder := fmt.Sprintf("album_%d", i)
+		if exists, _ := afero.Exists(fs, folder); exists {
+			t.Fatalf("want no %s folder", folder)
+		}
+		data, err := afero.ReadFile(fs, folder+".tar")
+		if err != nil {
+			t.Fatalf("missing archive: %v", err)
+		}
+		entries := map[string][]byte{}
+		tr := tar.NewReader(bytes.NewReader(data))
+		for h, err := tr.Next(); err != io.EOF; h, err = tr.Next() {
+			if err != nil {
+				t.Fatalf("invalid archive %s: %v", folder, err)
+			}
+			entries[h.Name], _ = io.ReadAll(tr)
+		}
+		if len(entries) != 10 || string(entries["0.jpg"]) != folder+"/0.jpg" {
+			t.Fatalf("unexpected entries of %s: %d", folder, len(entries))
+		}
+		var meta sidecar
+		if err := json.Unmarshal(entries["0.jpg"+sidecarSuffix], &meta); err != nil || meta.FileName != "0.jpg" {
+			t.Fatalf("unexpected sidecar %+v, %v", meta, err)
+		}
+	}
+}
+
+func TestItemDoneArchivesAlbum(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	archive := storage.NewArchive(storage.NewFs(fs), storage.Zip, t.TempDir())
+	w := newTestWorker(t, nil)
+	w.store = archive
+
+	f, _ := storage.CreateAtomic(archive, "album/img.jpg")
+	io.WriteString(f, "image")
+	f.Close()
+
+	// The listing and an image are pending
+	p := newAlbumProgress("album")
+	p.pending.Add(1)
+	w.itemDone(p)
+	if exists, _ := afero.Exists(fs, "album.zip"); exists {
+		t.Fatalf("want album archived only when complete")
+	}
+	w.itemDone(p)
+	if exists, _ := afero.Exists(fs, "album.zip"); !exists {
+		t.Fatalf("want album archived")
+	}
+}
@@ -0,0 +1,183 @@
+package smugmug
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// BandwidthWindow sets the download bandwidth limit for a time of day window
+type BandwidthWindow struct {
+	From  time.Duration // Start of the window, as offset from midnight
+	To    time.Duration // End of the window, as offset from midnight. If before From, the window spans midnight
+	Limit int64         // Limit in bytes per second, 0 means unlimited
+}
+
+// contains returns true if the given offset from midnight falls in the window
+func (bw BandwidthWindow) contains(offset time.Duration) bool {
+	if bw.From <= bw.To {
+		return offset >= bw.From && offset < bw.To
+	}
+	return offset >= bw.From || offset < bw.To
+}
+
+// bandwidthLimiter limits the aggregate bandwidth of all downloads. The limit is evaluated
+// on every read, so that the schedule windows are applied while the backup is running
+type bandwidthLimiter struct {
+	defaultLimit int64
+	schedule     []BandwidthWindow
+	now          func() time.Time
+
+	lock    sync.Mutex
+	current int64
+	limiter *rate.Limiter
+}
+
+// newBandwidthLimiter returns a limiter applying the given default limit (bytes per second) when
+// no window of the schedule applies. It returns nil if no limit is set at all
+func newBandwidthLimiter(defaultLimit int64, schedule []BandwidthWindow) *bandwidthLimiter {
+	if defaultLimit <= 0 && len(schedule) == 0 {
+		return nil
+	}
+	return &bandwidthLimiter{
+		defaultLimit: defaultLimit,
+		schedule:     schedule,
+		now:          time.Now,
+		limiter:      rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+// limitAt returns the limit to apply at the given time. The first matching window wins. The
+// windows are matched with the wall clock time, also on the days of the DST changes
+func (b *bandwidthLimiter) limitAt(t time.Time) int64 {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, bw := range b.schedule {
+		if bw.contains(offset) {
+			return bw.Limit
+		}
+	}
+	return b.defaultLimit
+}
+
+// update applies the current limit to the shared limiter, returning it
+func (b *bandwidthLimiter) update() int64 {
+	limit := b.limitAt(b.now())
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if limit == b.current {
+		return limit
+	}
+	b.current = limit
+	if limit <= 0 {
+		b.limiter.SetLimit(rate.Inf)
+		return limit
+	}
+	// Allow bursts of up to one second of traffic
+	b.limiter.SetBurst(int(limit))
+	b.limiter.SetLimit(rate.Limit(limit))
+	return limit
+}
+
+// reader wraps r so that reads are throttled by the limiter. A nil limiter returns r as is
+func (b *bandwidthLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, b: b}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	b   *bandwidthLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	limit := lr.b.update()
+	if limit <= 0 {
+		return lr.r.Read(p)
+	}
+
+	// Never read more than the burst, otherwise WaitN fails
+	if int64(len(p)) > limit {
+		p = p[:limit]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.b.wait(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// wait blocks until n bytes can be read. A window starting in the meantime can lower the burst
+// below n, so the bytes are waited for in chunks of the current burst
+func (b *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	for n > 0 {
+		if b.limiter.Limit() == rate.Inf {
+			return nil
+		}
+		chunk := min(n, b.limiter.Burst())
+		err := b.limiter.WaitN(ctx, chunk)
+		if err != nil && ctx.Err() == nil {
+			// The burst has been lowered since it was read
+			b.update()
+			chunk = min(n, b.limiter.Burst())
+			err = b.limiter.WaitN(ctx, chunk)
+		}
+		if err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// parseByteSize parses sizes like "500KB", "2MB" or "1GB" (multiples of 1024). A plain number is
+// a number of bytes. An empty string is 0
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, u := range []struct {
+		suffix string
+		value  int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			multiplier = u.value
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * float64(multiplier)), nil
+}
+
+// parseTimeOfDay parses a "15:04" time to an offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
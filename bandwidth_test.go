@@ -0,0 +1,172 @@
+package smugmug
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiterLimitAt(t *testing.T) {
+	b := newBandwidthLimiter(0, []BandwidthWindow{
+		{From: 8 * time.Hour, To: 19 * time.Hour, Limit: 2 << 20},
+		{From: 23 * time.Hour, To: 1 * time.Hour, Limit: 1 << 20},
+	})
+
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		at   time.Duration
+		want int64
+	}{
+		{at: 7*time.Hour + 59*time.Minute, want: 0},
+		{at: 8 * time.Hour, want: 2 << 20},
+		{at: 18*time.Hour + 59*time.Minute, want: 2 << 20},
+		{at: 19 * time.Hour, want: 0},
+		{at: 23*time.Hour + 30*time.Minute, want: 1 << 20},
+		{at: 30 * time.Minute, want: 1 << 20},
+		{at: 1 * time.Hour, want: 0},
+	}
+	for _, tt := range tests {
+		if got := b.limitAt(day.Add(tt.at)); got != tt.want {
+			t.Errorf("limit at %s: want %d, got %d", tt.at, tt.want, got)
+		}
+	}
+}
+
+func TestBandwidthLimiterDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Skipf("time zone not available: %v", err)
+	}
+	b := newBandwidthLimiter(0, []BandwidthWindow{{From: 8 * time.Hour, To: 19 * time.Hour, Limit: 2 << 20}})
+
+	// The clocks go forward at 2:00 on 2026-03-29 and back at 3:00 on 2026-10-25
+	for _, day := range []time.Time{
+		time.Date(2026, time.March, 29, 0, 0, 0, 0, loc),
+		time.Date(2026, time.October, 25, 0, 0, 0, 0, loc),
+	} {
+		y, m, d := day.Date()
+		if got := b.limitAt(time.Date(y, m, d, 8, 0, 0, 0, loc)); got != 2<<20 {
+			t.Errorf("%s 08:00: want %d, got %d", day.Format(time.DateOnly), 2<<20, got)
+		}
+		if got := b.limitAt(time.Date(y, m, d, 7, 30, 0, 0, loc)); got != 0 {
+			t.Errorf("%s 07:30: want 0, got %d", day.Format(time.DateOnly), got)
+		}
+	}
+}
+
+func TestBandwidthLimiterNil(t *testing.T) {
+	if b := newBandwidthLimiter(0, nil); b != nil {
+		t.Fatalf("want nil limiter without limits")
+	}
+	var b *bandwidthLimiter
+	r := bytes.NewReader(nil)
+	if b.reader(context.Background(), r) != r {
+		t.Fatalf("nil limiter must not wrap the reader")
+	}
+}
+
+func TestBandwidthLimiterReader(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	b := newBandwidthLimiter(0, []BandwidthWindow{
+		{From: 8 * time.Hour, To: 19 * time.Hour, Limit: 10000},
+	})
+	b.now = func() time.Time { return now }
+
+	// The first second of traffic is allowed as burst, the remaining must wait
+	start := time.Now()
+	data := make([]byte, 15000)
+	n, err := io.Copy(io.Discard, b.reader(context.Background(), bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("want %d bytes, got %d", len(data), n)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("read not throttled, took %s", elapsed)
+	}
+
+	// Outside the window the limit is removed while reading
+	now = now.Add(8 * time.Hour)
+	start = time.Now()
+	data = make([]byte, 100000)
+	if _, err := io.Copy(io.Discard, b.reader(context.Background(), bytes.NewReader(data))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("read throttled without limits, took %s", elapsed)
+	}
+}
+
+// windowChangeReader moves the clock of the limiter into a window with a lower limit while
+// reading, like another download starting a read at the window boundary
+type windowChangeReader struct {
+	r      io.Reader
+	change func()
+}
+
+func (r *windowChangeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.change != nil {
+		r.change()
+		r.change = nil
+	}
+	return n, err
+}
+
+func TestBandwidthLimiterWindowChange(t *testing.T) {
+	now := time.Date(2026, 10, 18, 7, 59, 59, 0, time.Local)
+	b := newBandwidthLimiter(200000, []BandwidthWindow{
+		{From: 8 * time.Hour, To: 19 * time.Hour, Limit: 100000},
+	})
+	b.now = func() time.Time { return now }
+
+	// The bytes read before the burst is lowered are waited for in chunks of the new burst
+	data := make([]byte, 200000)
+	r := &windowChangeReader{r: bytes.NewReader(data), change: func() {
+		now = now.Add(time.Second)
+		b.update()
+	}}
+	n, err := b.reader(context.Background(), r).Read(make([]byte, len(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != len(data) {
+		t.Fatalf("want %d bytes, got %d", len(data), n)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "1500", want: 1500},
+		{in: "512KB", want: 512 << 10},
+		{in: "2MB", want: 2 << 20},
+		{in: "1.5 mb", want: 3 << 19},
+		{in: "1GB", want: 1 << 30},
+		{in: "fast", wantErr: true},
+		{in: "-1MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: want error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: want %d, got %d", tt.in, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package smugmug
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/tommyblue/smugmug-backup/client"
+)
+
+// cachedResponse is an API response stored in the cache with its validators
+type cachedResponse struct {
+	URL          string          `json:"url"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	Body         json.RawMessage `json:"body"`
+}
+
+func (r *cachedResponse) validators() client.Validators {
+	return client.Validators{ETag: r.ETag, LastModified: r.LastModified}
+}
+
+// responseCache stores the API responses on disk, a file for each URL. The next runs send the
+// validators of the stored responses and reuse them if they haven't changed
+type responseCache struct {
+	dir string
+	// Prefixed to the URLs when computing the file names, so that the responses of different
+	// accounts sharing the cache folder never mix
+	namespace string
+}
+
+func newResponseCache(dir, namespace string) (*responseCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cannot create cache folder: %w", err)
+	}
+	return &responseCache{dir: dir, namespace: namespace}, nil
+}
+
+func (c *responseCache) path(url string) string {
+	sum := sha256.Sum256([]byte(c.namespace + "\n" + url))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// load returns the cached response of url, nil if it isn't cached
+func (c *responseCache) load(url string) (*cachedResponse, error) {
+	data, err := os.ReadFile(c.path(url))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cached response: %w", err)
+	}
+	var r cachedResponse
+	if err := json.Unmarshal(data, &r); err != nil || r.URL != url {
+		// Corrupted, it's replaced by the next response
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// store saves the response of url, replacing the previous one. The file is written to a
+// temporary file and renamed, so that concurrent readers never see a partial response
+func (c *responseCache) store(r *cachedResponse) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot write cached response: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write cached response: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot write cached response: %w", err)
+	}
+	if err := os.Rename(f.Name(), c.path(r.URL)); err != nil {
+		return fmt.Errorf("cannot write cached response: %w", err)
+	}
+	return nil
+}
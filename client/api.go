@@ -0,0 +1,282 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"net/url"
+	"time"
+)
+
+// Link is a reference to another API endpoint
+type Link struct {
+	URI string `json:"Uri"`
+}
+
+// Pages describes the pagination of a list response
+type Pages struct {
+	Total          int    `json:"Total"`
+	Start          int    `json:"Start"`
+	Count          int    `json:"Count"`
+	RequestedCount int    `json:"RequestedCount"`
+	NextPage       string `json:"NextPage"`
+}
+
+// User is a SmugMug user
+type User struct {
+	NickName string `json:"NickName"`
+	Name     string `json:"Name"`
+	Uris     struct {
+		Node       Link `json:"Node"`
+		UserAlbums Link `json:"UserAlbums"`
+	} `json:"Uris"`
+}
+
+// Album is a SmugMug album
+type Album struct {
+	AlbumKey   string `json:"AlbumKey"`
+	Name       string `json:"Name"`
+	URLPath    string `json:"UrlPath"`
+	ImageCount int    `json:"ImageCount"`
+	Uris       struct {
+		AlbumImages Link `json:"AlbumImages"`
+		Node        Link `json:"Node"`
+	} `json:"Uris"`
+}
+
+// AlbumImage is an image or a video of an album
+type AlbumImage struct {
+	FileName         string `json:"FileName"`
+	ImageKey         string `json:"ImageKey"`
+	ArchivedMD5      string `json:"ArchivedMD5"`
+	ArchivedSize     int64  `json:"ArchivedSize"`
+	ArchivedUri      string `json:"ArchivedUri"`
+	IsVideo          bool   `json:"IsVideo"`
+	Processing       bool   `json:"Processing"`
+	UploadKey        string `json:"UploadKey"`
+	DateTimeOriginal string `json:"DateTimeOriginal"`
+	Caption          string `json:"Caption"`
+	DateTimeUploaded string `json:"DateTimeUploaded"`
+	Keywords         string `json:"Keywords"`
+	Latitude         string `json:"Latitude"`
+	Longitude        string `json:"Longitude"`
+	Status           string `json:"Status"`
+	SubStatus        string `json:"SubStatus"`
+	Uris             struct {
+		ImageMetadata Link `json:"ImageMetadata"`
+		LargestVideo  Link `json:"LargestVideo"`
+	} `json:"Uris"`
+}
+
+// ImageMetadata contains the metadata of an image
+type ImageMetadata struct {
+	DateTimeCreated  time.Time `json:"DateTimeCreated"`
+	DateTimeModified time.Time `json:"DateTimeModified"`
+}
+
+// LargestVideo is the largest available version of a video
+type LargestVideo struct {
+	MD5  string `json:"MD5"`
+	Size int64  `json:"Size"`
+	Url  string `json:"Url"`
+}
+
+// VideoResponse is the response of the largest video endpoint, also found in the expansions of
+// the album images
+type VideoResponse struct {
+	LargestVideo LargestVideo `json:"LargestVideo"`
+}
+
+// Node is an element of the user's hierarchy: a folder, an album or a page
+type Node struct {
+	NodeID      string `json:"NodeID"`
+	Name        string `json:"Name"`
+	Type        string `json:"Type"`
+	URLPath     string `json:"UrlPath"`
+	HasChildren bool   `json:"HasChildren"`
+	Uris        struct {
+		Album      Link `json:"Album"`
+		ChildNodes Link `json:"ChildNodes"`
+	} `json:"Uris"`
+}
+
+// Getter makes the GET calls of the API, decoding the JSON responses on obj. It's implemented by
+// Client and can be wrapped, e.g. to cache the responses
+type Getter interface {
+	Get(ctx context.Context, uri string, obj any, opts ...RequestOption) error
+}
+
+// API has the typed methods of the SmugMug endpoints, called with a Getter. A Client embeds the
+// API calling the endpoints with the client itself
+type API struct {
+	g Getter
+}
+
+// NewAPI returns the API calling the endpoints with g
+func NewAPI(g Getter) *API {
+	return &API{g: g}
+}
+
+// Page is a page of a list response
+type Page[T any] struct {
+	Items []T
+	Pages Pages
+	// Objects inlined with Expand, by URI. Each has the content of the Response of its endpoint
+	Expansions map[string]json.RawMessage
+}
+
+// Expansion decodes on obj the object inlined in the page for the given URI. It returns false if
+// the object is missing or can't be decoded
+func (p *Page[T]) Expansion(uri string, obj any) bool {
+	raw, ok := p.Expansions[uri]
+	return ok && json.Unmarshal(raw, obj) == nil
+}
+
+// AuthUser returns the user authenticated by the client credentials
+func (a *API) AuthUser(ctx context.Context, opts ...RequestOption) (*User, error) {
+	var r struct {
+		Response struct {
+			User User `json:"User"`
+		} `json:"Response"`
+	}
+	if err := a.g.Get(ctx, "/api/v2!authuser", &r, opts...); err != nil {
+		return nil, err
+	}
+	return &r.Response.User, nil
+}
+
+// User returns the user with the given nickname
+func (a *API) User(ctx context.Context, nickname string, opts ...RequestOption) (*User, error) {
+	var r struct {
+		Response struct {
+			User User `json:"User"`
+		} `json:"Response"`
+	}
+	if err := a.g.Get(ctx, "/api/v2/user/"+url.PathEscape(nickname), &r, opts...); err != nil {
+		return nil, err
+	}
+	return &r.Response.User, nil
+}
+
+// UserAlbums iterates over the albums of the user, following the URI of the user's albums
+// (User.Uris.UserAlbums). The pages are requested as the albums are consumed
+func (a *API) UserAlbums(ctx context.Context, user *User, opts ...RequestOption) iter.Seq2[Album, error] {
+	uri := user.Uris.UserAlbums.URI
+	if uri == "" {
+		return func(yield func(Album, error) bool) {
+			yield(Album{}, fmt.Errorf("no albums URI for user %s", user.NickName))
+		}
+	}
+	return items(a.AlbumPages(ctx, uri, opts...))
+}
+
+// AlbumPages iterates over the pages of a list of albums, starting from the given URI
+func (a *API) AlbumPages(ctx context.Context, uri string, opts ...RequestOption) iter.Seq2[*Page[Album], error] {
+	return pages[Album](ctx, a.g, uri, "Album", opts)
+}
+
+// AlbumImages iterates over the images of an album, given the URI of its images
+// (Album.Uris.AlbumImages). The pages are requested as the images are consumed
+func (a *API) AlbumImages(ctx context.Context, uri string, opts ...RequestOption) iter.Seq2[AlbumImage, error] {
+	return items(a.AlbumImagePages(ctx, uri, opts...))
+}
+
+// AlbumImagePages iterates over the pages of the images of an album, e.g. to read the objects
+// inlined with Expand
+func (a *API) AlbumImagePages(ctx context.Context, uri string, opts ...RequestOption) iter.Seq2[*Page[AlbumImage], error] {
+	return pages[AlbumImage](ctx, a.g, uri, "AlbumImage", opts)
+}
+
+// ImageMetadata returns the metadata of an image, given its URI (AlbumImage.Uris.ImageMetadata)
+func (a *API) ImageMetadata(ctx context.Context, uri string, opts ...RequestOption) (*ImageMetadata, error) {
+	var r struct {
+		Response ImageMetadata `json:"Response"`
+	}
+	if err := a.g.Get(ctx, uri, &r, opts...); err != nil {
+		return nil, err
+	}
+	return &r.Response, nil
+}
+
+// LargestVideo returns the largest version of a video, given its URI (AlbumImage.Uris.LargestVideo)
+func (a *API) LargestVideo(ctx context.Context, uri string, opts ...RequestOption) (*LargestVideo, error) {
+	var r struct {
+		Response VideoResponse `json:"Response"`
+	}
+	if err := a.g.Get(ctx, uri, &r, opts...); err != nil {
+		return nil, err
+	}
+	return &r.Response.LargestVideo, nil
+}
+
+// Nodes iterates over the child nodes of a folder, given their URI (Node.Uris.ChildNodes)
+func (a *API) Nodes(ctx context.Context, uri string, opts ...RequestOption) iter.Seq2[Node, error] {
+	return items(pages[Node](ctx, a.g, uri, "Node", opts))
+}
+
+// pages iterates over the pages of a list, whose items are stored with the given key in the
+// responses. The next page is requested once the current one has been consumed, following the
+// "NextPage" value of the responses until it's empty. The iteration ends after yielding an
+// error, e.g. when ctx is cancelled
+func pages[T any](ctx context.Context, g Getter, uri, key string, opts []RequestOption) iter.Seq2[*Page[T], error] {
+	return func(yield func(*Page[T], error) bool) {
+		for uri != "" {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			p, err := page[T](ctx, g, uri, key, opts)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(p, nil) {
+				return
+			}
+			uri = p.Pages.NextPage
+		}
+	}
+}
+
+// items iterates over the items of the pages
+func items[T any](pages iter.Seq2[*Page[T], error]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for p, err := range pages {
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+			for _, item := range p.Items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// page returns a page of a list, whose items are stored with the given key in the response
+func page[T any](ctx context.Context, g Getter, uri, key string, opts []RequestOption) (*Page[T], error) {
+	var r struct {
+		Response   map[string]json.RawMessage `json:"Response"`
+		Expansions map[string]json.RawMessage `json:"Expansions"`
+	}
+	if err := g.Get(ctx, uri, &r, opts...); err != nil {
+		return nil, err
+	}
+	p := &Page[T]{Expansions: r.Expansions}
+	// Empty lists may miss the key instead of having an empty array
+	if raw, ok := r.Response[key]; ok {
+		if err := json.Unmarshal(raw, &p.Items); err != nil {
+			return nil, fmt.Errorf("%s: decoding %s: %w", uri, key, err)
+		}
+	}
+	if raw, ok := r.Response["Pages"]; ok {
+		if err := json.Unmarshal(raw, &p.Pages); err != nil {
+			return nil, fmt.Errorf("%s: decoding pages: %w", uri, err)
+		}
+	}
+	return p, nil
+}
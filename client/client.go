@@ -0,0 +1,260 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultBaseURL is the base URL of the SmugMug API
+	DefaultBaseURL = "https://api.smugmug.com"
+	// DefaultMaxConcurrency is the max number of concurrent calls when no other is set with
+	// WithMaxConcurrency
+	DefaultMaxConcurrency = 4
+)
+
+// Observer is notified about the HTTP calls made by a Client, e.g. to collect metrics
+type Observer interface {
+	// Response is called for every response received, with its status code
+	Response(statusCode int)
+	// Retry is called when a failed call is going to be retried
+	Retry(err error)
+	// RateLimited is called when SmugMug rate limits a call, with the pause applied to all calls
+	RateLimited(retryAfter time.Duration)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) Response(int)              {}
+func (nopObserver) Retry(error)               {}
+func (nopObserver) RateLimited(time.Duration) {}
+
+// Client makes authenticated calls to the SmugMug API. It's safe for concurrent use.
+//
+// Failed calls are retried according to the retry policy and all the calls of the client share
+// a throttle: when SmugMug rate limits a call, all of them are paused as requested by the
+// Retry-After header
+type Client struct {
+	*API // The typed methods of the endpoints, called with the client
+
+	baseURL        string
+	retry          RetryPolicy
+	signer         *Signer
+	observer       Observer
+	maxConcurrency int
+	throttle       *throttle
+	transport      TransportConfig
+	httpClient     *http.Client
+	stallTimeout   time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithBaseURL sets the base URL of the API, prepended to the URIs passed to the client
+func WithBaseURL(url string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithRetryPolicy sets the policy used to retry the failed calls
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// WithMaxConcurrency sets the max number of concurrent calls (API calls and downloads)
+func WithMaxConcurrency(n int) Option {
+	return func(c *Client) {
+		c.maxConcurrency = n
+	}
+}
+
+// WithTransportConfig sets the configuration of the HTTP transport. It's ignored if an
+// http.Client is set with WithHTTPClient
+func WithTransportConfig(cfg TransportConfig) Option {
+	return func(c *Client) {
+		c.transport = cfg
+	}
+}
+
+// WithHTTPClient sets the http.Client used to make the calls, instead of the one built by
+// NewHTTPClient
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithStallTimeout sets the max time without receiving any byte of a response body, after that
+// the transfer is interrupted and retried. 0 disables the stall detection
+func WithStallTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.stallTimeout = d
+	}
+}
+
+// WithObserver sets an Observer notified about the HTTP calls
+func WithObserver(o Observer) Option {
+	return func(c *Client) {
+		c.observer = o
+	}
+}
+
+// New returns a Client authenticating the calls with the given API and user credentials
+func New(apiKey, apiSecret, userToken, userSecret string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:        DefaultBaseURL,
+		retry:          DefaultRetryPolicy,
+		signer:         NewSigner(apiKey, apiSecret, userToken, userSecret),
+		observer:       nopObserver{},
+		maxConcurrency: DefaultMaxConcurrency,
+		transport:      DefaultTransportConfig,
+		stallTimeout:   DefaultStallTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.API = NewAPI(c)
+	c.throttle = newThrottle(c.maxConcurrency)
+	if c.httpClient == nil {
+		// A single client for all calls, sharing the pool of connections
+		if c.transport.MaxIdleConnsPerHost <= 0 {
+			c.transport.MaxIdleConnsPerHost = max(c.maxConcurrency, 1)
+		}
+		c.httpClient = NewHTTPClient(c.transport)
+	}
+	return c
+}
+
+// Get calls the given API URI (e.g. "/api/v2!authuser"), decoding the JSON response on obj.
+// If the call fails or the body is truncated, the call is retried according to the retry policy
+func (c *Client) Get(ctx context.Context, uri string, obj any, opts ...RequestOption) error {
+	if uri == "" {
+		return errors.New("can't get empty url")
+	}
+	url, err := buildURL(c.baseURL+uri, opts)
+	if err != nil {
+		return err
+	}
+
+	return c.retry.do(ctx, c.observer, url, func() error {
+		log.Debug("Calling ", url)
+		resp, err := c.do(ctx, url, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if err := json.NewDecoder(&transientReader{r: resp.Body}).Decode(obj); err != nil {
+			return fmt.Errorf("%s: reading response: %w", url, err)
+		}
+		return nil
+	})
+}
+
+// Download calls fn with the body of the resource (image or video) at the given url. If the
+// call or fn fail with a transient error (e.g. the connection drops while fn reads the body),
+// the download is retried from scratch, calling fn again, according to the retry policy.
+// The errors reading the body are returned to fn marked as transient, fn must wrap them with %w
+func (c *Client) Download(ctx context.Context, url string, fn func(body io.Reader) error) error {
+	return c.retry.do(ctx, c.observer, url, func() error {
+		resp, err := c.do(ctx, url, nil)
+		if err != nil {
+			return fmt.Errorf("download failed with: %w", err)
+		}
+		defer resp.Body.Close()
+
+		return fn(&transientReader{r: resp.Body})
+	})
+}
+
+// do performs a single HTTP call to the given url with the additional headers, returning the
+// response. Responses with status code >= 400 are returned as *APIError.
+// All calls share a throttle, pausing them when SmugMug rate limits the requests
+func (c *Client) do(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	// The request is cancelled when the transfer of the body stalls
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	req, err := http.NewRequestWithContext(reqCtx, "GET", url, nil)
+	if err != nil {
+		cancel(nil)
+		return nil, fmt.Errorf("cannot create request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+
+	// Wait before signing the request, the pause can be long and the OAuth timestamp must be fresh
+	sent, err := c.throttle.acquire(ctx)
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+
+	// Auth header must be generate every time (nonce must change)
+	if err := c.signer.Sign(req); err != nil {
+		c.throttle.release()
+		cancel(nil)
+		return nil, fmt.Errorf("cannot generate authorization header: %w", err)
+	}
+	log.Debug(req.Header)
+
+	r, err := c.httpClient.Do(req)
+	if err != nil {
+		c.throttle.release()
+		cancel(nil)
+		return nil, transient(err)
+	}
+
+	c.observer.Response(r.StatusCode)
+	if r.StatusCode >= 400 {
+		apiErr := newAPIError(url, r)
+		r.Body.Close()
+		c.throttle.release()
+		cancel(nil)
+
+		if r.StatusCode == http.StatusTooManyRequests {
+			// Header Retry-After tells when the current window ends
+			retryAfter, ok := parseRetryAfter(r.Header.Get("Retry-After"), time.Now())
+			if !ok {
+				retryAfter = defaultRetryAfter
+			}
+			c.observer.RateLimited(retryAfter)
+			c.throttle.rateLimited(sent, retryAfter)
+		}
+
+		return nil, apiErr
+	}
+
+	c.throttle.success()
+	// The slot is released once the body has been consumed
+	body := newStallBody(reqCtx, cancel, r.Body, c.stallTimeout)
+	r.Body = &throttledBody{body: body, release: c.throttle.release}
+	return r, nil
+}
+
+// transientReader marks the read errors as transient: the connection can drop while reading
+// the body, and the call is worth retrying
+type transientReader struct {
+	r io.Reader
+}
+
+func (t *transientReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = transient(err)
+	}
+	return n, err
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// apiServer serves a small account: the user "nick" with two pages of albums
+func apiServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	write := func(w http.ResponseWriter, response any) {
+		json.NewEncoder(w).Encode(map[string]any{"Response": response})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2!authuser", func(w http.ResponseWriter, r *http.Request) {
+		write(w, map[string]any{"User": map[string]any{
+			"NickName": "nick",
+			"Uris":     map[string]any{"UserAlbums": map[string]any{"Uri": "/api/v2/user/nick!albums"}},
+		}})
+	})
+	mux.HandleFunc("/api/v2/user/nick", func(w http.ResponseWriter, r *http.Request) {
+		write(w, map[string]any{"User": map[string]any{"NickName": "nick", "Name": "Nick"}})
+	})
+	mux.HandleFunc("/api/v2/user/nick!albums", func(w http.ResponseWriter, r *http.Request) {
+		// The options are applied to every page
+		if got := r.URL.Query().Get("count"); got != "2" {
+			t.Errorf("count: want 2, got %q", got)
+		}
+		if got := r.URL.Query().Get("_filter"); got != "Name" {
+			t.Errorf("_filter: want Name, got %q", got)
+		}
+		if r.URL.Query().Get("start") == "" {
+			write(w, map[string]any{
+				"Album": []any{map[string]any{"Name": "a1"}, map[string]any{"Name": "a2"}},
+				"Pages": map[string]any{"Total": 3, "NextPage": "/api/v2/user/nick!albums?start=3"},
+			})
+			return
+		}
+		write(w, map[string]any{
+			"Album": []any{map[string]any{"Name": "a3"}},
+			"Pages": map[string]any{"Total": 3},
+		})
+	})
+	mux.HandleFunc("/api/v2/album/empty!images", func(w http.ResponseWriter, r *http.Request) {
+		// Empty albums have no AlbumImage key
+		write(w, map[string]any{"Pages": map[string]any{"Total": 0}})
+	})
+	mux.HandleFunc("/api/v2/image/img!metadata", func(w http.ResponseWriter, r *http.Request) {
+		write(w, map[string]any{"DateTimeCreated": "2020-01-02T03:04:05Z"})
+	})
+	mux.HandleFunc("/api/v2/image/img!largestvideo", func(w http.ResponseWriter, r *http.Request) {
+		write(w, map[string]any{"LargestVideo": map[string]any{"Size": 42, "Url": "https://example.com/v.mp4"}})
+	})
+	mux.HandleFunc("/api/v2/node/root!children", func(w http.ResponseWriter, r *http.Request) {
+		write(w, map[string]any{"Node": []any{
+			map[string]any{"Name": "folder", "Type": "Folder", "HasChildren": true},
+			map[string]any{"Name": "album", "Type": "Album"},
+		}})
+	})
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h := r.Header.Get("Authorization"); !strings.HasPrefix(h, "OAuth ") {
+			t.Errorf("%s: request not signed: %q", r.URL, h)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+func TestClientAPI(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srv := apiServer(t)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := New("key", "secret", "token", "secret", WithBaseURL(srv.URL+"/"))
+
+	u, err := c.AuthUser(ctx)
+	if err != nil {
+		t.Fatalf("auth user: %v", err)
+	}
+	if u.NickName != "nick" || u.Uris.UserAlbums.URI != "/api/v2/user/nick!albums" {
+		t.Fatalf("unexpected auth user %+v", u)
+	}
+
+	// The albums are listed from the URI of the user's albums
+	var names []string
+	for a, err := range c.UserAlbums(ctx, u, Count(2), Filter("Name")) {
+		if err != nil {
+			t.Fatalf("user albums: %v", err)
+		}
+		names = append(names, a.Name)
+	}
+	if got := strings.Join(names, ","); got != "a1,a2,a3" {
+		t.Fatalf("albums: want a1,a2,a3, got %s", got)
+	}
+
+	u, err = c.User(ctx, "nick")
+	if err != nil || u.Name != "Nick" {
+		t.Fatalf("unexpected user %+v, %v", u, err)
+	}
+	var gotErr error
+	for _, err := range c.UserAlbums(ctx, u) {
+		gotErr = err
+	}
+	if gotErr == nil {
+		t.Fatalf("user albums without URI: want error")
+	}
+
+	for _, err := range c.AlbumImages(ctx, "/api/v2/album/empty!images") {
+		t.Fatalf("want no images, got %v", err)
+	}
+
+	md, err := c.ImageMetadata(ctx, "/api/v2/image/img!metadata")
+	if err != nil {
+		t.Fatalf("image metadata: %v", err)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !md.DateTimeCreated.Equal(want) {
+		t.Fatalf("created: want %s, got %s", want, md.DateTimeCreated)
+	}
+
+	v, err := c.LargestVideo(ctx, "/api/v2/image/img!largestvideo")
+	if err != nil || v.Size != 42 || v.Url != "https://example.com/v.mp4" {
+		t.Fatalf("unexpected video %+v, %v", v, err)
+	}
+
+	var nodes []Node
+	for n, err := range c.Nodes(ctx, "/api/v2/node/root!children") {
+		if err != nil {
+			t.Fatalf("nodes: %v", err)
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) != 2 || nodes[0].Type != "Folder" || !nodes[0].HasChildren {
+		t.Fatalf("unexpected nodes %+v", nodes)
+	}
+}
+
+func TestClientListError(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Query().Get("start") != "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"Response":{"Album":[{"Name":"a1"}],"Pages":{"NextPage":"/albums?start=2"}}}`)
+	}))
+	defer srv.Close()
+
+	c := New("key", "secret", "token", "secret", WithBaseURL(srv.URL))
+	u := &User{NickName: "nick"}
+	u.Uris.UserAlbums.URI = "/albums"
+
+	// Stopping the iteration doesn't request the next pages
+	for range c.UserAlbums(context.Background(), u) {
+		break
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("want 1 call, got %d", n)
+	}
+
+	// A failing page is yielded after the albums of the previous ones
+	var albums []Album
+	var gotErr error
+	for a, err := range c.UserAlbums(context.Background(), u) {
+		if err != nil {
+			gotErr = err
+			continue
+		}
+		albums = append(albums, a)
+	}
+	if gotErr == nil {
+		t.Fatalf("want error")
+	}
+	if len(albums) != 1 {
+		t.Fatalf("want the albums of the first page, got %d", len(albums))
+	}
+}
+
+func TestDownload(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "content")
+	}))
+	defer srv.Close()
+
+	c := New("key", "secret", "token", "secret")
+	var got []byte
+	err := c.Download(context.Background(), srv.URL+"/photo.jpg", func(body io.Reader) error {
+		var err error
+		got, err = io.ReadAll(body)
+		return err
+	})
+	if err != nil || string(got) != "content" {
+		t.Fatalf("want content, got %q, %v", got, err)
+	}
+}
+
+func TestClientErrorsDontExit(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	c := New("key", "secret", "token", "secret", WithBaseURL("http://127.0.0.1:1"))
+
+	if err := c.Get(context.Background(), "", &struct{}{}); err == nil {
+		t.Fatalf("get empty uri: want error")
+	}
+	if err := c.Get(context.Background(), "/api/v2\x7f", &struct{}{}); err == nil {
+		t.Fatalf("get invalid uri: want error")
+	}
+	if _, err := c.signer.AuthorizationHeader("GET", "http://[::1"); err == nil {
+		t.Fatalf("authorization header: want error")
+	}
+	if c.throttle.inUse != 0 {
+		t.Fatalf("throttle slots not released: %d", c.throttle.inUse)
+	}
+}
+
+func TestGetConditional(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"etag"` && r.Header.Get("If-Modified-Since") == "yesterday" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "yesterday")
+		w.Write([]byte(`{"Response":{}}`))
+	}))
+	defer srv.Close()
+
+	c := New("key", "secret", "token", "secret", WithBaseURL(srv.URL))
+	body, v, err := c.GetConditional(context.Background(), "/api/v2!authuser", Validators{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(body) != `{"Response":{}}` || v != (Validators{ETag: `"etag"`, LastModified: "yesterday"}) {
+		t.Fatalf("unexpected response %s, %+v", body, v)
+	}
+
+	if _, _, err := c.GetConditional(context.Background(), "/api/v2!authuser", v); !errors.Is(err, ErrNotModified) {
+		t.Fatalf("want ErrNotModified, got %v", err)
+	}
+}
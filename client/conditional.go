@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotModified is returned by GetConditional when the response hasn't changed since the
+// version identified by the validators
+var ErrNotModified = errors.New("not modified")
+
+// Validators identify a version of a response, to ask SmugMug for the response only if it has
+// changed since then
+type Validators struct {
+	ETag         string // ETag header of the response, sent back as If-None-Match
+	LastModified string // Last-Modified header of the response, sent back as If-Modified-Since
+}
+
+// IsZero reports whether no validators are set
+func (v Validators) IsZero() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// GetConditional calls the given API URI like Get, sending the validators of a previously
+// received response. If SmugMug replies that the response hasn't changed (304 Not Modified),
+// it returns ErrNotModified. Otherwise it returns the raw JSON body with its validators, e.g. to
+// cache them
+func (c *Client) GetConditional(ctx context.Context, uri string, v Validators, opts ...RequestOption) ([]byte, Validators, error) {
+	if uri == "" {
+		return nil, Validators{}, errors.New("can't get empty url")
+	}
+	url, err := buildURL(c.baseURL+uri, opts)
+	if err != nil {
+		return nil, Validators{}, err
+	}
+
+	header := http.Header{}
+	if v.ETag != "" {
+		header.Set("If-None-Match", v.ETag)
+	}
+	if v.LastModified != "" {
+		header.Set("If-Modified-Since", v.LastModified)
+	}
+
+	var body []byte
+	var got Validators
+	err = c.retry.do(ctx, c.observer, url, func() error {
+		log.Debug("Calling ", url)
+		resp, err := c.do(ctx, url, header)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotModified {
+			return ErrNotModified
+		}
+		body, err = io.ReadAll(&transientReader{r: resp.Body})
+		if err != nil {
+			return fmt.Errorf("%s: reading response: %w", url, err)
+		}
+		got = Validators{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, Validators{}, err
+	}
+	return body, got, nil
+}
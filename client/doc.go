@@ -0,0 +1,35 @@
+/*
+Package client implements a client for the SmugMug API v2, as used by the backup.
+
+It takes care of the OAuth 1.0a signature of the requests, of the pagination of the lists and
+of the transient failures: failed calls are retried with exponential backoff and, when SmugMug
+rate limits the requests, all the calls of the client are paused as requested by the
+Retry-After header.
+
+	c := client.New(apiKey, apiSecret, userToken, userSecret)
+
+	user, err := c.AuthUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	for album, err := range c.UserAlbums(ctx, user, client.Count(100)) {
+		if err != nil {
+			return err
+		}
+		for image, err := range c.AlbumImages(ctx, album.Uris.AlbumImages.URI) {
+			...
+		}
+	}
+
+The lists are iterated one page at a time: the next page is requested once the items of the
+current one have been consumed and stopping the iteration doesn't request the following pages.
+AlbumPages and AlbumImagePages iterate over the pages themselves, e.g. to read their total or
+the objects inlined with Expand.
+
+The typed methods are those of the API embedded in the Client. NewAPI returns an API calling the
+endpoints through another Getter, e.g. one wrapping the Client to cache the responses.
+
+Errors returned by SmugMug can be inspected with errors.As and *APIError.
+*/
+package client
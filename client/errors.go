@@ -0,0 +1,53 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxErrorBody is the max number of bytes read from an error response
+const maxErrorBody = 64 * 1024
+
+// APIError is returned when SmugMug replies to a request with an error status code (>= 400).
+// Use errors.As to get it from the errors returned by the package
+type APIError struct {
+	StatusCode int    // HTTP status code
+	Code       int    // SmugMug error code, if found in the response body
+	Message    string // SmugMug error message, if found in the response body
+	URL        string // Requested URL
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.Code != 0 && e.Code != e.StatusCode {
+		return fmt.Sprintf("GET %s: %d %s (SmugMug code %d)", e.URL, e.StatusCode, msg, e.Code)
+	}
+	return fmt.Sprintf("GET %s: %d %s", e.URL, e.StatusCode, msg)
+}
+
+// newAPIError builds an APIError from an error response, parsing the JSON body sent by SmugMug:
+//
+//	{"Code": 404, "Message": "Not Found"}
+//
+// Bodies that can't be parsed (e.g. HTML pages from a proxy) are ignored.
+func newAPIError(url string, r *http.Response) *APIError {
+	e := &APIError{
+		StatusCode: r.StatusCode,
+		URL:        url,
+	}
+
+	var body struct {
+		Code    int    `json:"Code"`
+		Message string `json:"Message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxErrorBody)).Decode(&body); err == nil {
+		e.Code = body.Code
+		e.Message = body.Message
+	}
+	return e
+}
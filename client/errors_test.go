@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestAPIError(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		wantCode    int
+		wantMessage string
+		wantString  string
+	}{
+		{
+			name:        "smugmug error",
+			status:      http.StatusUnauthorized,
+			body:        `{"Code":401,"Message":"Unauthorized: invalid user token"}`,
+			wantCode:    401,
+			wantMessage: "Unauthorized: invalid user token",
+			wantString:  "401 Unauthorized: invalid user token",
+		},
+		{
+			name:        "different smugmug code",
+			status:      http.StatusBadRequest,
+			body:        `{"Code":4,"Message":"Invalid parameter"}`,
+			wantCode:    4,
+			wantMessage: "Invalid parameter",
+			wantString:  "400 Invalid parameter (SmugMug code 4)",
+		},
+		{
+			name:       "not json",
+			status:     http.StatusNotFound,
+			body:       `<html>Not found</html>`,
+			wantString: "404 Not Found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			c := New("key", "secret", "token", "secret", WithBaseURL(srv.URL), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+
+			check := func(err error) {
+				t.Helper()
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("want *APIError, got %T: %v", err, err)
+				}
+				if apiErr.StatusCode != tt.status {
+					t.Errorf("status: want %d, got %d", tt.status, apiErr.StatusCode)
+				}
+				if apiErr.Code != tt.wantCode {
+					t.Errorf("code: want %d, got %d", tt.wantCode, apiErr.Code)
+				}
+				if apiErr.Message != tt.wantMessage {
+					t.Errorf("message: want %q, got %q", tt.wantMessage, apiErr.Message)
+				}
+				if !strings.HasPrefix(apiErr.URL, srv.URL) {
+					t.Errorf("url: want prefix %s, got %s", srv.URL, apiErr.URL)
+				}
+				if !strings.Contains(err.Error(), tt.wantString) {
+					t.Errorf("error string: want %q in %q", tt.wantString, err.Error())
+				}
+			}
+
+			_, err := c.AuthUser(context.Background())
+			check(err)
+
+			check(c.Download(context.Background(), srv.URL+"/img.jpg", func(io.Reader) error {
+				t.Fatalf("download of an error response")
+				return nil
+			}))
+		})
+	}
+}
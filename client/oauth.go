@@ -1,4 +1,4 @@
-package smugmug
+package client
 
 import (
 	"bytes"
@@ -7,18 +7,19 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
-type oauthConf struct {
+// Signer signs the requests to the SmugMug API with OAuth 1.0a (HMAC-SHA1)
+type Signer struct {
 	apiKey     string
 	apiSecret  string
 	userToken  string
@@ -52,8 +53,9 @@ func nonce() string {
 	return strconv.FormatUint(atomic.AddUint64(&nonceCounter, 1), 16)
 }
 
-func newOauthConf(apiKey, apiSecret, userToken, userSecret string) *oauthConf {
-	return &oauthConf{
+// NewSigner returns a Signer for the given API and user credentials
+func NewSigner(apiKey, apiSecret, userToken, userSecret string) *Signer {
+	return &Signer{
 		apiKey:     apiKey,
 		apiSecret:  apiSecret,
 		userToken:  userToken,
@@ -61,17 +63,32 @@ func newOauthConf(apiKey, apiSecret, userToken, userSecret string) *oauthConf {
 	}
 }
 
-func (cfg *oauthConf) authorizationHeader(url string) (string, error) {
+// Sign sets the Authorization header of req. A new header must be generated for every request
+func (s *Signer) Sign(req *http.Request) error {
+	h, err := s.AuthorizationHeader(req.Method, req.URL.String())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", h)
+	return nil
+}
+
+// AuthorizationHeader returns the value of the Authorization header for a request with the
+// given method and url
+func (s *Signer) AuthorizationHeader(method, url string) (string, error) {
 	var oauthParams = map[string]string{
-		"oauth_consumer_key":     cfg.apiKey,
+		"oauth_consumer_key":     s.apiKey,
 		"oauth_signature_method": "HMAC-SHA1",
 		"oauth_version":          "1.0",
-		"oauth_token":            cfg.userToken,
+		"oauth_token":            s.userToken,
 		"oauth_timestamp":        strconv.FormatInt(time.Now().Unix(), 10),
 		"oauth_nonce":            nonce(),
 	}
 
-	signature := cfg.getHMACSignature(url, oauthParams)
+	signature, err := s.getHMACSignature(method, url, oauthParams)
+	if err != nil {
+		return "", err
+	}
 	oauthParams["oauth_signature"] = signature
 	var h []byte
 	// Append parameters in a fixed order to support testing.
@@ -92,21 +109,21 @@ func (cfg *oauthConf) authorizationHeader(url string) (string, error) {
 	return string(h), nil
 }
 
-func (cfg *oauthConf) getHMACSignature(urlStr string, oauthParams map[string]string) string {
-	key := encode(cfg.apiSecret, false)
+func (s *Signer) getHMACSignature(method, urlStr string, oauthParams map[string]string) (string, error) {
+	key := encode(s.apiSecret, false)
 	key = append(key, '&')
 	u, err := url.Parse(urlStr)
 	if err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("cannot sign request: %w", err)
 	}
 	// if r.credentials != nil {
-	key = append(key, encode(cfg.userSecret, false)...)
+	key = append(key, encode(s.userSecret, false)...)
 	// }
 	h := hmac.New(sha1.New, key)
-	writeBaseString(h, "GET", u, url.Values{}, oauthParams)
+	writeBaseString(h, method, u, url.Values{}, oauthParams)
 	signature := base64.StdEncoding.EncodeToString(h.Sum(key[:0]))
 	// return string(rawSignature)
-	return signature
+	return signature, nil
 }
 
 // noscape[b] is true if b should not be escaped per section 3.6 of the RFC.
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// RequestOption changes the query of an API call, e.g. to set the page size or to filter the
+// returned fields. For paginated calls, the options are applied to every page
+type RequestOption func(url.Values)
+
+// Param sets the given query parameter
+func Param(key, value string) RequestOption {
+	return func(q url.Values) {
+		q.Set(key, value)
+	}
+}
+
+// Count sets the number of items returned per page
+func Count(n int) RequestOption {
+	return Param("count", strconv.Itoa(n))
+}
+
+// Expand inlines the given related objects (e.g. "LargestVideo" or "ImageMetadata") in the
+// Expansions of the response, saving a call for each of them
+func Expand(names ...string) RequestOption {
+	return Param("_expand", strings.Join(names, ","))
+}
+
+// Filter limits the fields of the returned objects to the given ones
+func Filter(fields ...string) RequestOption {
+	return Param("_filter", strings.Join(fields, ","))
+}
+
+// FilterURI limits the Uris of the returned objects to the given ones
+func FilterURI(names ...string) RequestOption {
+	return Param("_filteruri", strings.Join(names, ","))
+}
+
+// Config sets the JSON configuration of the request, e.g. to filter the fields of the
+// expanded objects:
+//
+//	{"expand": {"LargestVideo": {"filter": ["Size", "Url"]}}}
+func Config(json string) RequestOption {
+	return Param("_config", json)
+}
+
+// ApplyOptions returns the uri with the query changed by the options
+func ApplyOptions(uri string, opts ...RequestOption) (string, error) {
+	return buildURL(uri, opts)
+}
+
+// buildURL applies the options to the query of the given url
+func buildURL(rawURL string, opts []RequestOption) (string, error) {
+	if len(opts) == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %s: %w", rawURL, err)
+	}
+	q := u.Query()
+	for _, opt := range opts {
+		opt(q)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
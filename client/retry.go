@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryPolicy defines how failing HTTP calls are retried: transient errors are retried up to
+// MaxAttempts times (the first call included), waiting an exponentially increasing delay
+// between the attempts. Permanent errors are returned immediately
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration // Delay after the first attempt, doubled after each attempt
+	MaxDelay    time.Duration // Upper bound of the delay, no bound if 0
+	Jitter      float64       // Random variation of the delay, as fraction of it (e.g. 0.2 is ±20%)
+}
+
+// DefaultRetryPolicy is the policy used when no other is set with WithRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+	Jitter:      0.2,
+}
+
+// delay returns the time to wait after the given attempt (starting from 1) failed
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 {
+		d = min(d, p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(float64(d) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return max(d, 0)
+}
+
+// do calls fn until it succeeds, it returns a permanent error, the attempts are exhausted or ctx
+// is done. The returned error is the last one returned by fn
+func (p RetryPolicy) do(ctx context.Context, o Observer, what string, fn func() error) error {
+	attempts := max(p.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || !IsTransient(err) || attempt >= attempts {
+			return err
+		}
+
+		d := p.delay(attempt)
+		log.Debugf("#%d %s: %v, retrying in %s", attempt, what, err, d)
+		o.Retry(err)
+
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// transientError marks an error that is worth retrying (e.g. a truncated response body)
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// IsTransient returns true if err may not happen again retrying the same call: network errors
+// (timeouts of the transport included), truncated bodies, rate limiting and server errors. Client
+// errors (e.g. 401 or 404), malformed responses and cancellations are permanent
+func IsTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	// The timeouts of the transport (e.g. of the response headers) match DeadlineExceeded
+	var te *transientError
+	if errors.As(err, &te) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var se *APIError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusTooManyRequests ||
+			se.StatusCode == http.StatusRequestTimeout ||
+			se.StatusCode >= 500
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Transient marks err as transient, e.g. to retry a Download when fn finds the received content
+// corrupted
+func Transient(err error) error {
+	return transient(err)
+}
+
+// transient wraps err to mark it as transient
+func transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &transientError{err: err}
+}
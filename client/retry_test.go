@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  5 * time.Second,
+		10: 5 * time.Second,
+	} {
+		if got := p.delay(attempt); got != want {
+			t.Errorf("attempt %d: want %s, got %s", attempt, want, got)
+		}
+	}
+
+	// Without MaxDelay the delay keeps doubling
+	unbounded := RetryPolicy{BaseDelay: time.Second}
+	if got := unbounded.delay(4); got != 8*time.Second {
+		t.Errorf("no MaxDelay: want %s, got %s", 8*time.Second, got)
+	}
+
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		if d := p.delay(1); d < 800*time.Millisecond || d > 1200*time.Millisecond {
+			t.Fatalf("delay with jitter out of range: %s", d)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "network", err: transient(errors.New("connection reset")), want: true},
+		{name: "wrapped network", err: fmt.Errorf("url: %w", transient(errors.New("connection reset"))), want: true},
+		{name: "truncated body", err: io.ErrUnexpectedEOF, want: true},
+		{name: "429", err: &APIError{StatusCode: 429}, want: true},
+		{name: "500", err: &APIError{StatusCode: 500}, want: true},
+		{name: "503", err: &APIError{StatusCode: 503}, want: true},
+		{name: "401", err: &APIError{StatusCode: 401}, want: false},
+		{name: "404", err: fmt.Errorf("url: %w", &APIError{StatusCode: 404}), want: false},
+		{name: "canceled", err: transient(context.Canceled), want: false},
+		{name: "transport timeout", err: transient(fmt.Errorf("timeout awaiting response headers: %w", context.DeadlineExceeded)), want: true},
+		{name: "deadline", err: context.DeadlineExceeded, want: false},
+		{name: "other", err: errors.New("invalid character"), want: false},
+	}
+	for _, tt := range tests {
+		if got := IsTransient(tt.err); got != tt.want {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestGetRetries(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	tests := []struct {
+		name      string
+		handler   func(call int32, w http.ResponseWriter)
+		transport *TransportConfig
+		wantCalls int32
+		wantErr   bool
+	}{
+		{
+			name: "server error then ok",
+			handler: func(call int32, w http.ResponseWriter) {
+				if call == 1 {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.Write([]byte(`{"Response":{"User":{"NickName":"nick"}}}`))
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "truncated body then ok",
+			handler: func(call int32, w http.ResponseWriter) {
+				body := `{"Response":{"User":{"NickName":"nick"}}}`
+				if call == 1 {
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+					w.Write([]byte(body[:10]))
+					return
+				}
+				w.Write([]byte(body))
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "response headers timeout then ok",
+			handler: func(call int32, w http.ResponseWriter) {
+				if call == 1 {
+					time.Sleep(200 * time.Millisecond)
+				}
+				w.Write([]byte(`{"Response":{"User":{"NickName":"nick"}}}`))
+			},
+			transport: &TransportConfig{ResponseHeaderTimeout: 50 * time.Millisecond},
+			wantCalls: 2,
+		},
+		{
+			name: "not found is not retried",
+			handler: func(call int32, w http.ResponseWriter) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name: "attempts exhausted",
+			handler: func(call int32, w http.ResponseWriter) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			wantCalls: 3,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(calls.Add(1), w)
+			}))
+			defer srv.Close()
+
+			policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+			opts := []Option{WithBaseURL(srv.URL), WithRetryPolicy(policy)}
+			if tt.transport != nil {
+				opts = append(opts, WithTransportConfig(*tt.transport))
+			}
+			c := New("key", "secret", "token", "secret", opts...)
+
+			u, err := c.AuthUser(context.Background())
+			if tt.wantErr && err == nil {
+				t.Fatalf("want error, got nil")
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if u.NickName != "nick" {
+					t.Fatalf("want nick, got %q", u.NickName)
+				}
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Fatalf("calls: want %d, got %d", tt.wantCalls, calls.Load())
+			}
+		})
+	}
+}
+
+func TestDownloadRetriesTruncatedBody(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	content := []byte("some image content")
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if calls.Add(1) == 1 {
+			w.Write(content[:5])
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	c := New("key", "secret", "token", "secret", WithRetryPolicy(policy))
+
+	var got []byte
+	err := c.Download(context.Background(), srv.URL+"/image.jpg", func(body io.Reader) error {
+		var err error
+		got, err = io.ReadAll(body)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("want %q, got %q", content, got)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("calls: want 2, got %d", calls.Load())
+	}
+}
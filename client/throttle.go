@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRetryAfter is the pause applied when a 429 response has no valid Retry-After header
+	defaultRetryAfter = 10 * time.Second
+	// throttleWindow is the period in which multiple 429 responses lower the concurrency
+	throttleWindow = time.Minute
+	// throttleRepeats is the number of 429 responses in throttleWindow that lower the concurrency
+	throttleRepeats = 2
+	// rampUpAfter is the number of consecutive clean responses that raise the concurrency by one
+	rampUpAfter = 20
+)
+
+// throttle is shared by all the API calls and downloads. When SmugMug rate limits a request, all
+// the calls are paused until the time requested by the Retry-After header. If the rate limiting
+// repeats, the number of concurrent calls is halved and then increased again, one by one, after
+// enough responses are received without errors. The 429 responses of the calls sent before the
+// last pause are part of the same rate limiting and don't count as repeats
+type throttle struct {
+	maxConcurrency int
+	now            func() time.Time
+
+	lock        sync.Mutex
+	changed     chan struct{} // closed and replaced to wake up the waiting calls
+	limit       int           // current max number of concurrent calls
+	inUse       int
+	pausedUntil time.Time
+	pausedAt    time.Time   // time of the last 429 response counted in throttled
+	throttled   []time.Time // recent 429 responses
+	clean       int         // consecutive clean responses
+}
+
+func newThrottle(maxConcurrency int) *throttle {
+	maxConcurrency = max(maxConcurrency, 1)
+	return &throttle{
+		maxConcurrency: maxConcurrency,
+		now:            time.Now,
+		changed:        make(chan struct{}),
+		limit:          maxConcurrency,
+	}
+}
+
+// acquire waits until the calls aren't paused and a slot is available, then takes the slot,
+// returning the time it was taken. Every successful acquire must be followed by a release
+func (t *throttle) acquire(ctx context.Context) (time.Time, error) {
+	for {
+		t.lock.Lock()
+		now := t.now()
+		wait := t.pausedUntil.Sub(now)
+		if wait <= 0 && t.inUse < t.limit {
+			t.inUse++
+			t.lock.Unlock()
+			return now, nil
+		}
+		changed := t.changed
+		t.lock.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return time.Time{}, ctx.Err()
+		case <-changed:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// release frees a slot taken with acquire
+func (t *throttle) release() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.inUse--
+	t.broadcast()
+}
+
+// success records a response received without rate limiting
+func (t *throttle) success() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.limit >= t.maxConcurrency {
+		return
+	}
+	t.clean++
+	if t.clean >= rampUpAfter {
+		t.clean = 0
+		t.limit++
+		log.Infof("No rate limiting in the last %d responses, concurrency raised to %d", rampUpAfter, t.limit)
+		t.broadcast()
+	}
+}
+
+// rateLimited records a 429 response to a call sent at the given time, pausing all calls for
+// the given duration. The responses to the calls sent before the last counted one, e.g. all those
+// in flight when the rate limiting started, aren't counted as repeated rate limiting
+func (t *throttle) rateLimited(sent time.Time, retryAfter time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+	if until := now.Add(retryAfter); until.After(t.pausedUntil) {
+		t.pausedUntil = until
+		log.Warnf("Rate limited by SmugMug, pausing all requests for %s", retryAfter)
+	}
+
+	t.clean = 0
+	if !sent.Before(t.pausedAt) {
+		t.pausedAt = now
+		t.repeated(now)
+	}
+	t.broadcast()
+}
+
+// repeated counts a rate limiting at the given time, halving the concurrency if it repeats in
+// throttleWindow. Must be called with the lock held
+func (t *throttle) repeated(now time.Time) {
+	recent := t.throttled[:0]
+	for _, ts := range t.throttled {
+		if now.Sub(ts) < throttleWindow {
+			recent = append(recent, ts)
+		}
+	}
+	t.throttled = append(recent, now)
+
+	if len(t.throttled) >= throttleRepeats && t.limit > 1 {
+		t.limit = max(t.limit/2, 1)
+		t.throttled = t.throttled[:0]
+		log.Warnf("Repeated rate limiting, concurrency lowered to %d", t.limit)
+	}
+}
+
+// broadcast wakes up all the calls waiting in acquire. Must be called with the lock held
+func (t *throttle) broadcast() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// parseRetryAfter parses the value of the Retry-After header, that can be either a number of
+// seconds or an HTTP date. It returns false if the value is missing or invalid
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// throttledBody releases the throttle slot when the response body is closed
+type throttledBody struct {
+	body    io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	return b.body.Read(p)
+}
+
+func (b *throttledBody) Close() error {
+	b.once.Do(b.release)
+	return b.body.Close()
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{value: "", wantOk: false},
+		{value: "30", want: 30 * time.Second, wantOk: true},
+		{value: " 5 ", want: 5 * time.Second, wantOk: true},
+		{value: "-1", wantOk: false},
+		{value: "Sun, 18 Oct 2026 12:01:00 GMT", want: time.Minute, wantOk: true},
+		{value: "Sun, 18 Oct 2026 11:00:00 GMT", want: 0, wantOk: true},
+		{value: "soon", wantOk: false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if ok != tt.wantOk || got != tt.want {
+			t.Errorf("%q: want %s %v, got %s %v", tt.value, tt.want, tt.wantOk, got, ok)
+		}
+	}
+}
+
+func TestThrottleConcurrency(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	th := newThrottle(8)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	th.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// A single 429 pauses, but doesn't change the concurrency
+	sent := now
+	now = now.Add(time.Second)
+	th.rateLimited(sent, 0)
+	if th.limit != 8 {
+		t.Fatalf("limit: want 8, got %d", th.limit)
+	}
+
+	// Neither do the 429s of the calls sent before it
+	th.rateLimited(sent, 0)
+	if th.limit != 8 {
+		t.Fatalf("limit: want 8, got %d", th.limit)
+	}
+
+	// Repeated 429s halve it
+	sent = now
+	now = now.Add(time.Second)
+	th.rateLimited(sent, 0)
+	if th.limit != 4 {
+		t.Fatalf("limit: want 4, got %d", th.limit)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := th.acquire(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	ctxTimeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := th.acquire(ctxTimeout); err == nil {
+		t.Fatalf("acquire over the limit must block")
+	}
+	th.release()
+	if _, err := th.acquire(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Clean responses ramp the concurrency back up
+	for i := 0; i < rampUpAfter; i++ {
+		th.success()
+	}
+	if th.limit != 5 {
+		t.Fatalf("limit: want 5, got %d", th.limit)
+	}
+}
+
+func TestThrottlePause(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	th := newThrottle(2)
+	th.rateLimited(time.Now(), 200*time.Millisecond)
+
+	start := time.Now()
+	if _, err := th.acquire(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("acquire not paused, took %s", elapsed)
+	}
+}
+
+type countingObserver struct {
+	responses   atomic.Int32
+	retries     atomic.Int32
+	rateLimited atomic.Int32
+}
+
+func (o *countingObserver) Response(int)              { o.responses.Add(1) }
+func (o *countingObserver) Retry(error)               { o.retries.Add(1) }
+func (o *countingObserver) RateLimited(time.Duration) { o.rateLimited.Add(1) }
+
+func TestGetRetryAfter(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	o := &countingObserver{}
+	c := New("key", "secret", "token", "secret",
+		WithBaseURL(srv.URL),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3}),
+		WithMaxConcurrency(2),
+		WithObserver(o),
+	)
+
+	start := time.Now()
+	if _, err := c.AuthUser(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("Retry-After not honoured, took %s", elapsed)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("calls: want 2, got %d", calls.Load())
+	}
+	if o.rateLimited.Load() != 1 || o.retries.Load() != 1 || o.responses.Load() != 2 {
+		t.Fatalf("observer: want 2 responses, 1 retry and 1 rate limited, got %d, %d and %d",
+			o.responses.Load(), o.retries.Load(), o.rateLimited.Load())
+	}
+	if c.throttle.inUse != 0 {
+		t.Fatalf("throttle slots not released: %d", c.throttle.inUse)
+	}
+}
+
+func TestThrottleConcurrentRateLimiting(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	// All the calls in flight are rate limited together
+	const calls = 8
+	var received atomic.Int32
+	inFlight := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := received.Add(1); n <= calls {
+			if n == calls {
+				close(inFlight)
+			}
+			<-inFlight
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	c := New("key", "secret", "token", "secret",
+		WithBaseURL(srv.URL),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2}),
+		WithMaxConcurrency(calls),
+	)
+	var wg sync.WaitGroup
+	for range calls {
+		wg.Go(func() {
+			var r any
+			if err := c.Get(context.Background(), "/api/v2!authuser", &r); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	// They count as a single rate limiting, that doesn't lower the concurrency
+	if c.throttle.limit != calls {
+		t.Fatalf("limit: want %d, got %d", calls, c.throttle.limit)
+	}
+}
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ErrStalled is returned when no bytes of a response body are received for the stall timeout
+var ErrStalled = errors.New("transfer stalled")
+
+// DefaultStallTimeout is the stall timeout used when no other is set with WithStallTimeout
+const DefaultStallTimeout = time.Minute
+
+// TransportConfig configures the HTTP transport built by NewHTTPClient
+type TransportConfig struct {
+	DialTimeout           time.Duration // Max time to establish a TCP connection, 0 means no limit
+	TLSHandshakeTimeout   time.Duration // Max time of the TLS handshake, 0 means no limit
+	ResponseHeaderTimeout time.Duration // Max time waiting for the response headers after sending the request, 0 means no limit
+	IdleConnTimeout       time.Duration // Time an idle connection is kept in the pool, 0 means no limit
+	MaxIdleConnsPerHost   int           // Number of idle connections kept in the pool per host. 0 uses the max concurrency of the client
+
+	// Proxy used for all the calls, with the http, https or socks5 scheme (see ParseProxyURL).
+	// If nil, the proxy is set by the environment variables (HTTPS_PROXY, etc.)
+	Proxy *url.URL
+	// TLS configuration of the connections, e.g. to trust more CAs or to send a client
+	// certificate (see LoadTLSConfig). If nil, the default configuration is used
+	TLSConfig *tls.Config
+}
+
+// DefaultTransportConfig is the configuration used when no other is set with WithTransportConfig
+var DefaultTransportConfig = TransportConfig{
+	DialTimeout:           10 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	IdleConnTimeout:       90 * time.Second,
+}
+
+// NewHTTPClient returns an http.Client with the given transport configuration, using HTTP/2
+// when available. The client has no overall timeout, as downloads can take long: the stalled
+// transfers are detected by the Client instead
+func NewHTTPClient(cfg TransportConfig) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != nil {
+		proxy = http.ProxyURL(cfg.Proxy)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 proxy,
+			TLSClientConfig:       cfg.TLSConfig,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+			IdleConnTimeout:       cfg.IdleConnTimeout,
+			ExpectContinueTimeout: time.Second,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+			// The API host and the hosts serving the images and videos
+			MaxIdleConns: 2 * cfg.MaxIdleConnsPerHost,
+		},
+	}
+}
+
+// stallBody cancels the request when a Read receives no bytes for the given timeout. The time
+// spent by the consumer between the Reads (e.g. waiting for the bandwidth limit or for a slow
+// upload) isn't a stall
+type stallBody struct {
+	body    io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// newStallBody wraps the body of a response to the request made with ctx. cancel must cancel
+// ctx, it's called with ErrStalled when the transfer stalls and with nil when the body is closed
+func newStallBody(ctx context.Context, cancel context.CancelCauseFunc, body io.ReadCloser, timeout time.Duration) *stallBody {
+	b := &stallBody{
+		body:    body,
+		ctx:     ctx,
+		cancel:  cancel,
+		timeout: timeout,
+	}
+	if timeout > 0 {
+		// Armed only while a Read is waiting for data
+		b.timer = time.AfterFunc(timeout, func() { cancel(ErrStalled) })
+		b.timer.Stop()
+	}
+	return b
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	if b.timer != nil {
+		b.timer.Reset(b.timeout)
+	}
+	n, err := b.body.Read(p)
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if err != nil && err != io.EOF && context.Cause(b.ctx) == ErrStalled {
+		err = fmt.Errorf("%w: no data received for %s", ErrStalled, b.timeout)
+	}
+	return n, err
+}
+
+func (b *stallBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.body.Close()
+	b.cancel(nil)
+	return err
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestDownloadStalled(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	content := []byte("some video content")
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if calls.Add(1) == 1 {
+			// Send a few bytes, then stall
+			w.Write(content[:5])
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	c := New("key", "secret", "token", "secret",
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}),
+		WithStallTimeout(100*time.Millisecond),
+	)
+
+	var errs []error
+	var got []byte
+	start := time.Now()
+	err := c.Download(context.Background(), srv.URL+"/video.mp4", func(body io.Reader) error {
+		var err error
+		got, err = io.ReadAll(body)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("stall not detected, took %s", elapsed)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("want %q, got %q", content, got)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrStalled) {
+		t.Fatalf("want a single ErrStalled, got %v", errs)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("calls: want 2, got %d", calls.Load())
+	}
+}
+
+func TestDownloadSlowConsumer(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	content := []byte("some video content")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		// The server sends the content in chunks, faster than the stall timeout
+		for i := 0; i < len(content); i += 4 {
+			w.Write(content[i:min(i+4, len(content))])
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	c := New("key", "secret", "token", "secret",
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithStallTimeout(50*time.Millisecond),
+	)
+
+	// The consumer waits longer than the stall timeout between the Reads, e.g. for the bandwidth
+	// limit: the transfer isn't stalled
+	var got []byte
+	err := c.Download(context.Background(), srv.URL+"/video.mp4", func(body io.Reader) error {
+		buf := make([]byte, 4)
+		for {
+			n, err := body.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			time.Sleep(80 * time.Millisecond)
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("want %q, got %q", content, got)
+	}
+}
+
+type countingTransport struct {
+	calls atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.calls.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+
+	tr := &countingTransport{}
+	c := New("key", "secret", "token", "secret", WithBaseURL(srv.URL), WithHTTPClient(&http.Client{Transport: tr}))
+	for i := 0; i < 3; i++ {
+		if _, err := c.AuthUser(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if tr.calls.Load() != 3 {
+		t.Fatalf("calls: want 3, got %d", tr.calls.Load())
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	c := New("key", "secret", "token", "secret", WithMaxConcurrency(6))
+	tr, ok := c.httpClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("unexpected transport %T", c.httpClient.Transport)
+	}
+	if tr.MaxIdleConnsPerHost != 6 {
+		t.Fatalf("idle connections per host: want 6, got %d", tr.MaxIdleConnsPerHost)
+	}
+	if tr.ResponseHeaderTimeout != DefaultTransportConfig.ResponseHeaderTimeout || !tr.ForceAttemptHTTP2 {
+		t.Fatalf("unexpected transport configuration %+v", tr)
+	}
+}
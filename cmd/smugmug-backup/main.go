@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
@@ -20,7 +22,11 @@ var statsAddr = "localhost:6060"
 var version = "-- unknown --"
 var flagVersion = flag.Bool("version", false, "print version number")
 var flagStats = flag.Bool("stats", false, fmt.Sprintf("show stats at %s", statsAddr))
+var metricsAddr = flag.String("metrics", "", "expose Prometheus metrics at http://<address>/metrics (e.g. localhost:9100)")
+var metricsFile = flag.String("metrics-file", "", "write the Prometheus metrics to the file at the end of the backup (e.g. for the node exporter textfile collector)")
+var flagProgress = flag.Bool("progress", false, "show a live progress view (disabled if stdout isn't a terminal)")
 var cfgPath = flag.String("cfg", "", "folder containing configuration file")
+var flagNoCache = flag.Bool("no-cache", false, "don't use the cache of the API responses, calling again all the endpoints")
 var mockServer = flag.Bool("mock", false, "use the included mock server (must be running on localhost:3000)")
 
 func init() {
@@ -60,30 +66,139 @@ func main() {
 	if *mockServer {
 		cfg.HTTPBaseUrl = "http://localhost:3000"
 	}
+	if *flagNoCache {
+		cfg.HTTPCacheDir = ""
+	}
+
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "restore", "decrypt":
+			restore(cfg, flag.Args()[1:])
+		case "seed":
+			seed(cfg, flag.Args()[1:])
+		default:
+			log.Fatalf("Unknown command %s", flag.Arg(0))
+		}
+		return
+	}
 
 	wrk, err := smugmug.New(cfg)
 	if err != nil {
 		log.WithError(err).Fatal("Can't initialize the package")
 	}
 
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", wrk.MetricsHandler())
+		go func() {
+			log.Infof("Metrics available at: http://%s/metrics\n", *metricsAddr)
+			log.Println(http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
+
+	var progress *progressView
+	level := log.GetLevel()
+	if *flagProgress {
+		if isTerminal(os.Stdout) {
+			progress = newProgressView(os.Stdout, wrk)
+			log.SetOutput(progress)
+			// Per-file logs would flood the progress view
+			if log.GetLevel() < log.DebugLevel {
+				log.SetLevel(log.WarnLevel)
+			}
+			progress.Start()
+		} else {
+			log.Info("stdout isn't a terminal, progress view disabled")
+		}
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	end := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	end := make(chan error)
 	go func() {
-		if err := wrk.Run(); err != nil {
-			log.Fatal(err)
+		err := wrk.Run(ctx)
+		if *metricsFile != "" {
+			if err := wrk.WriteMetrics(*metricsFile); err != nil {
+				log.WithError(err).Error("cannot write the metrics file")
+			}
 		}
-		end <- struct{}{}
+		end <- err
 	}()
 
 	go func() {
 		<-sigs
-		log.Info("Stopping...")
-		wrk.Stop()
+		log.Warn("Stopping, waiting for the downloads in progress to complete. Send the signal again to abort them")
+		cancel()
+		<-sigs
+		log.Warn("Aborting...")
+		wrk.Abort()
 	}()
 
-	<-end
+	err = <-end
+	// The progress view is stopped also before exiting with an error, to restore the terminal
+	if progress != nil {
+		progress.Stop()
+		log.SetOutput(os.Stdout)
+		log.SetLevel(level)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
 	duration := time.Since(start)
+	if ctx.Err() != nil {
+		log.Infof("Backup stopped after %s", duration)
+		return
+	}
 	log.Infof("Backup completed in %s", duration)
 }
+
+// restore runs the restore command, copying the files of the backup (decrypted, if encrypted) to
+// a local folder
+func restore(cfg *smugmug.Conf, args []string) {
+	cmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := cmd.String("to", "", "folder where the files are restored")
+	identity := cmd.String("identity", "", "age identities file decrypting the files, overrides encryption.identity_file")
+	cmd.Parse(args)
+	if *to == "" {
+		log.Fatal("restore: the -to folder is required")
+	}
+	if *identity != "" {
+		cfg.EncryptIdentity = *identity
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	start := time.Now()
+	if err := smugmug.Restore(ctx, cfg, *to); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Restore completed in %s", time.Since(start))
+}
+
+// seed runs the seed command, saving the files of a local library to the backup so that they
+// aren't downloaded
+func seed(cfg *smugmug.Conf, args []string) {
+	cmd := flag.NewFlagSet("seed", flag.ExitOnError)
+	from := cmd.String("from", "", "local folder with the images and videos to save to the backup")
+	link := cmd.Bool("link", false, "hard link the files instead of copying them (local destinations on the same filesystem)")
+	cmd.Parse(args)
+	if *from == "" {
+		log.Fatal("seed: the -from folder is required")
+	}
+
+	wrk, err := smugmug.New(cfg)
+	if err != nil {
+		log.WithError(err).Fatal("Can't initialize the package")
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	start := time.Now()
+	if err := wrk.Seed(ctx, *from, *link); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Seed completed in %s", time.Since(start))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup"
+)
+
+const progressRefresh = 500 * time.Millisecond
+
+// progressView periodically draws the backup progress on a terminal. It also implements
+// io.Writer, so that it can be used as the logs output: log lines are printed above the
+// progress block, that is then redrawn
+type progressView struct {
+	out      io.Writer
+	wrk      *smugmug.Worker
+	lock     sync.Mutex
+	lines    int // number of lines drawn by the last refresh
+	samples  []progressSample
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	barWidth int
+}
+
+// progressSample is used to compute the throughput over a sliding window
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// isTerminal returns true if the given file is a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgressView(out io.Writer, wrk *smugmug.Worker) *progressView {
+	return &progressView{
+		out:      out,
+		wrk:      wrk,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+		barWidth: 20,
+	}
+}
+
+// Start draws the progress until Stop is called
+func (p *progressView) Start() {
+	go func() {
+		defer close(p.doneCh)
+		ticker := time.NewTicker(progressRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopCh:
+				p.refresh()
+				return
+			case <-ticker.C:
+				p.refresh()
+			}
+		}
+	}()
+}
+
+// Stop draws the progress one last time and stops the refresh
+func (p *progressView) Stop() {
+	close(p.stopCh)
+	<-p.doneCh
+}
+
+// Write prints a log line above the progress block
+func (p *progressView) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	p.draw()
+	return n, err
+}
+
+func (p *progressView) refresh() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	p.draw()
+}
+
+// clear removes the progress block, moving the cursor up to its first line
+func (p *progressView) clear() {
+	if p.lines > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.lines)
+		p.lines = 0
+	}
+}
+
+func (p *progressView) draw() {
+	var buf bytes.Buffer
+	p.render(&buf, p.wrk.Progress(), time.Now())
+	p.lines = bytes.Count(buf.Bytes(), []byte{'\n'})
+	p.out.Write(buf.Bytes())
+}
+
+// render writes the progress block to w. Each line is terminated by a newline
+func (p *progressView) render(w io.Writer, pr smugmug.Progress, now time.Time) {
+	throughput := p.throughput(pr.BytesDownloaded, now)
+
+	eta := "--"
+	if remaining := pr.BytesRemaining(); throughput > 0 && remaining > 0 {
+		eta = (time.Duration(float64(remaining)/throughput) * time.Second).Round(time.Second).String()
+	} else if remaining == 0 && pr.AlbumsTotal > 0 && pr.AlbumsDone == pr.AlbumsTotal {
+		eta = "0s"
+	}
+
+	fmt.Fprintf(w, "Albums %d/%d | Files: %d downloaded, %d skipped, %d failed | %s/s | ETA %s\n",
+		pr.AlbumsDone, pr.AlbumsTotal,
+		pr.ItemsDownloaded, pr.ItemsSkipped, pr.ItemsFailed,
+		humanBytes(int64(throughput)), eta)
+
+	for _, d := range pr.Downloads {
+		fmt.Fprintf(w, "  %s %s\n", p.bar(d.Written, d.Size), truncate(filepath.Base(d.Name), 40))
+	}
+}
+
+// truncate shortens s to n runes, to avoid lines wrapping on the terminal
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// bar returns a progress bar for a single download
+func (p *progressView) bar(written, size int64) string {
+	if size <= 0 {
+		return fmt.Sprintf("[%s] %10s", strings.Repeat("?", p.barWidth), humanBytes(written))
+	}
+	ratio := min(float64(written)/float64(size), 1)
+	done := int(ratio * float64(p.barWidth))
+	return fmt.Sprintf("[%s%s] %3.0f%% %10s",
+		strings.Repeat("#", done), strings.Repeat("-", p.barWidth-done), ratio*100, humanBytes(size))
+}
+
+// throughput returns the download speed, in bytes per second, over the last 10 seconds
+func (p *progressView) throughput(downloaded int64, now time.Time) float64 {
+	p.samples = append(p.samples, progressSample{at: now, bytes: downloaded})
+	for len(p.samples) > 1 && now.Sub(p.samples[0].at) > 10*time.Second {
+		p.samples = p.samples[1:]
+	}
+
+	first := p.samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(downloaded-first.bytes) / elapsed
+}
+
+// humanBytes formats a number of bytes using binary units
+func humanBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
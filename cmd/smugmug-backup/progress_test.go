@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup"
+)
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+		{2 << 40, "2.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := humanBytes(tt.bytes); got != tt.want {
+			t.Errorf("%d: want %q, got %q", tt.bytes, tt.want, got)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short.jpg", 10, "short.jpg"},
+		{"exactly10!", 10, "exactly10!"},
+		{"a_long_file_name.jpg", 10, "a_long_fi…"},
+		{"àèìòùàèìòùà", 10, "àèìòùàèìò…"},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("%q: want %q, got %q", tt.s, tt.want, got)
+		}
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	p := newProgressView(io.Discard, nil)
+	p.barWidth = 10
+	tests := []struct {
+		written, size int64
+		want          string
+	}{
+		{0, 1000, "[----------]   0%     1000 B"},
+		{500, 1000, "[#####-----]  50%     1000 B"},
+		{2000, 1000, "[##########] 100%     1000 B"},
+		{2048, 0, "[??????????]    2.0 KiB"},
+	}
+	for _, tt := range tests {
+		if got := p.bar(tt.written, tt.size); got != tt.want {
+			t.Errorf("%d/%d: want %q, got %q", tt.written, tt.size, tt.want, got)
+		}
+	}
+}
+
+func TestProgressRender(t *testing.T) {
+	start := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		pr   smugmug.Progress
+		want string
+	}{
+		{
+			name: "just started",
+			pr:   smugmug.Progress{AlbumsTotal: 2, BytesQueued: 10 << 20},
+			want: "Albums 0/2 | Files: 0 downloaded, 0 skipped, 0 failed | 0 B/s | ETA --\n",
+		},
+		{
+			// 2 MiB in 2 seconds, 10 - 4 - 1 MiB remaining
+			name: "downloading",
+			pr: smugmug.Progress{
+				AlbumsTotal: 2, AlbumsDone: 1, ItemsDownloaded: 3, ItemsSkipped: 1,
+				BytesQueued: 10 << 20, BytesHandled: 4 << 20, BytesDownloaded: 2 << 20,
+				Downloads: []smugmug.DownloadProgress{{Name: "album/img.jpg", Size: 2 << 20, Written: 1 << 20}},
+			},
+			want: "Albums 1/2 | Files: 3 downloaded, 1 skipped, 0 failed | 1.0 MiB/s | ETA 5s\n" +
+				"  [##########----------]  50%    2.0 MiB img.jpg\n",
+		},
+		{
+			// 2 MiB in 4 seconds
+			name: "completed",
+			pr: smugmug.Progress{
+				AlbumsTotal: 2, AlbumsDone: 2, ItemsDownloaded: 5, ItemsFailed: 1,
+				BytesQueued: 10 << 20, BytesHandled: 10 << 20, BytesDownloaded: 2 << 20,
+			},
+			want: "Albums 2/2 | Files: 5 downloaded, 0 skipped, 1 failed | 512.0 KiB/s | ETA 0s\n",
+		},
+	}
+
+	// Each render is 2 seconds after the previous one
+	p := newProgressView(io.Discard, nil)
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		p.render(&buf, tt.pr, start.Add(time.Duration(i)*2*time.Second))
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: want\n%q, got\n%q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestProgressThroughput(t *testing.T) {
+	start := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	p := newProgressView(io.Discard, nil)
+	tests := []struct {
+		after      time.Duration
+		downloaded int64
+		want       float64
+	}{
+		{0, 0, 0},
+		{5 * time.Second, 5000, 1000},
+		{10 * time.Second, 20000, 2000},
+		// The samples older than 10 seconds are dropped
+		{15 * time.Second, 25000, 2000},
+	}
+	for _, tt := range tests {
+		if got := p.throughput(tt.downloaded, start.Add(tt.after)); got != tt.want {
+			t.Errorf("after %s: want %.0f, got %.0f", tt.after, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+)
+
+// Age is a Cipher encrypting each file to the age recipients: the files are regular age files,
+// they can be decrypted with any of the identities of the recipients, also with the age tool
+type Age struct {
+	recipients []age.Recipient
+	identities []age.Identity
+	header     int64 // Size of the header and of the nonce of the encrypted files
+}
+
+// NewAge returns a cipher encrypting to the recipients and to the ones of the identities, and
+// decrypting with the identities. Without identities the files can only be encrypted
+func NewAge(recipients []age.Recipient, identities []age.Identity) (*Age, error) {
+	recipients = append([]age.Recipient(nil), recipients...)
+	for _, id := range identities {
+		switch id := id.(type) {
+		case *age.X25519Identity:
+			recipients = append(recipients, id.Recipient())
+		case *age.HybridIdentity:
+			recipients = append(recipients, id.Recipient())
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("no age recipients")
+	}
+
+	// The header has the same size for all the files, it's measured encrypting an empty file
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipients: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &Age{recipients: recipients, identities: identities, header: int64(buf.Len() - tagSize)}, nil
+}
+
+func (c *Age) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(w, c.recipients...)
+}
+
+func (c *Age) Decrypt(r io.Reader) (io.Reader, error) {
+	if len(c.identities) == 0 {
+		return nil, ErrNoIdentity
+	}
+	return age.Decrypt(r, c.identities...)
+}
+
+func (c *Age) PlainSize(size int64) int64 {
+	return plainSize(size, c.header)
+}
+
+// NamesSecret returns the secret encrypting the names (see NewNames), derived from the first
+// identity. It returns nil without identities: the recipients are public
+func (c *Age) NamesSecret() []byte {
+	for _, id := range c.identities {
+		if s, ok := id.(fmt.Stringer); ok {
+			sum := sha256.Sum256([]byte("smugmug-backup names\n" + s.String()))
+			return sum[:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+/*
+Package crypt encrypts the files of the backups before they are saved, so that the destination
+never sees their content (and optionally their names).
+
+Two ciphers are available: Age encrypts each file to the age recipients (public keys), the files
+can be decrypted with the age tool too. Passphrase encrypts the files with AES-256-GCM keys
+derived from a passphrase. Both encrypt the content in chunks while it's written, without
+buffering whole files, and the encrypted size depends only on the size of the content.
+*/
+package crypt
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrWrongPassphrase is returned when the passphrase doesn't match the one of the key parameters
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// ErrNoIdentity is returned decrypting with a cipher that can only encrypt, e.g. Age without
+// identities
+var ErrNoIdentity = errors.New("no identity to decrypt the files")
+
+// Cipher encrypts and decrypts the content of the files
+type Cipher interface {
+	// Encrypt returns a writer encrypting the content to w. The encrypted content is complete
+	// only when the writer is closed
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+	// Decrypt returns a reader of the content decrypted from r. The content is authenticated
+	// while it's read, tampered content is reported with an error
+	Decrypt(r io.Reader) (io.Reader, error)
+	// PlainSize returns the size of the content of an encrypted file of the given size
+	PlainSize(size int64) int64
+}
+
+// chunkSize is the size of the chunks of content encrypted separately, as in age
+const chunkSize = 64 << 10
+
+// tagSize is the size of the authentication tag of each chunk
+const tagSize = 16
+
+// plainSize returns the size of the content of an encrypted file with a header of the given
+// size followed by the chunks, the last one possibly shorter. Empty files have an empty chunk
+func plainSize(size, header int64) int64 {
+	chunks := size - header
+	if chunks < tagSize {
+		return 0
+	}
+	n := (chunks + chunkSize + tagSize - 1) / (chunkSize + tagSize)
+	return chunks - n*tagSize
+}
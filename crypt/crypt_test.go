@@ -0,0 +1,174 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// testKeyParams are cheap key parameters, to keep the tests fast
+func testKeyParams() *KeyParams {
+	return &KeyParams{Salt: []byte("0123456789abcdef"), N: 1 << 10, R: 8, P: 1}
+}
+
+func TestCiphers(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withIdentity, err := NewAge(nil, []age.Identity{id})
+	if err != nil {
+		t.Fatalf("age: %v", err)
+	}
+	passphrase, err := NewPassphrase("secret", testKeyParams())
+	if err != nil {
+		t.Fatalf("passphrase: %v", err)
+	}
+
+	for name, c := range map[string]Cipher{"age": withIdentity, "passphrase": passphrase} {
+		t.Run(name, func(t *testing.T) {
+			for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+				content := make([]byte, size)
+				rand.Read(content)
+
+				var buf bytes.Buffer
+				w, err := c.Encrypt(&buf)
+				if err != nil {
+					t.Fatalf("encrypt: %v", err)
+				}
+				// Written in small pieces, as by io.Copy
+				for p := content; len(p) > 0; p = p[min(len(p), 1000):] {
+					if _, err := w.Write(p[:min(len(p), 1000)]); err != nil {
+						t.Fatalf("write: %v", err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("close: %v", err)
+				}
+				if got := c.PlainSize(int64(buf.Len())); got != int64(size) {
+					t.Fatalf("size %d: plain size of %d bytes is %d", size, buf.Len(), got)
+				}
+
+				encrypted := buf.Bytes()
+				r, err := c.Decrypt(bytes.NewReader(encrypted))
+				if err != nil {
+					t.Fatalf("decrypt: %v", err)
+				}
+				got, err := io.ReadAll(r)
+				if err != nil || !bytes.Equal(got, content) {
+					t.Fatalf("size %d: decrypted %d bytes, %v", size, len(got), err)
+				}
+
+				// Tampered and truncated content is detected
+				if size > 0 {
+					tampered := bytes.Clone(encrypted)
+					tampered[len(tampered)-20] ^= 1
+					if _, err := readAll(c, tampered); err == nil {
+						t.Fatalf("size %d: want error decrypting tampered content", size)
+					}
+				}
+				if size > chunkSize {
+					if _, err := readAll(c, encrypted[:len(encrypted)-tagSize-1]); err == nil {
+						t.Fatalf("size %d: want error decrypting truncated content", size)
+					}
+				}
+			}
+		})
+	}
+
+	// The age files can be decrypted by age
+	var buf bytes.Buffer
+	w, _ := withIdentity.Encrypt(&buf)
+	io.WriteString(w, "content")
+	w.Close()
+	r, err := age.Decrypt(&buf, id)
+	if err != nil {
+		t.Fatalf("age decrypt: %v", err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "content" {
+		t.Fatalf("unexpected content %q", got)
+	}
+
+	// Without identities the files can only be encrypted
+	recipientOnly, err := NewAge([]age.Recipient{id.Recipient()}, nil)
+	if err != nil {
+		t.Fatalf("age: %v", err)
+	}
+	if _, err := recipientOnly.Decrypt(&buf); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("want ErrNoIdentity, got %v", err)
+	}
+	if recipientOnly.NamesSecret() != nil {
+		t.Fatalf("want no names secret without identities")
+	}
+}
+
+func readAll(c Cipher, encrypted []byte) ([]byte, error) {
+	r, err := c.Decrypt(bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestPassphrase(t *testing.T) {
+	params := testKeyParams()
+	c, err := NewPassphrase("secret", params)
+	if err != nil || params.Check == nil {
+		t.Fatalf("want check set, got %v", err)
+	}
+	if _, err := NewPassphrase("wrong", params); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("want ErrWrongPassphrase, got %v", err)
+	}
+
+	// The same passphrase and parameters decrypt the files
+	var buf bytes.Buffer
+	w, _ := c.Encrypt(&buf)
+	io.WriteString(w, "content")
+	w.Close()
+	again, err := NewPassphrase("secret", params)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got, err := readAll(again, buf.Bytes()); err != nil || string(got) != "content" {
+		t.Fatalf("unexpected content %q, %v", got, err)
+	}
+
+	other, err := NewPassphrase("secret", &KeyParams{Salt: []byte("another salt...."), N: 1 << 10, R: 8, P: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := readAll(other, buf.Bytes()); err == nil {
+		t.Fatalf("want error decrypting with another key")
+	}
+}
+
+func TestNames(t *testing.T) {
+	n, err := NewNames([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"IMG_0001.jpg", "Vacation 2020", "ü", ""} {
+		enc := n.Encrypt(name)
+		if enc != n.Encrypt(name) {
+			t.Fatalf("%q: want deterministic encryption", name)
+		}
+		if got, err := n.Decrypt(enc); err != nil || got != name {
+			t.Fatalf("%q: decrypted %q, %v", name, got, err)
+		}
+	}
+	if n.Encrypt("a.jpg") == n.Encrypt("b.jpg") {
+		t.Fatalf("want different encrypted names")
+	}
+
+	other, _ := NewNames([]byte("other"))
+	if _, err := other.Decrypt(n.Encrypt("IMG_0001.jpg")); err == nil {
+		t.Fatalf("want error decrypting with another secret")
+	}
+	if _, err := n.Decrypt("metadata.csv"); err == nil {
+		t.Fatalf("want error decrypting a plain name")
+	}
+}
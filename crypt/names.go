@@ -0,0 +1,78 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+)
+
+// namesEncoding encodes the encrypted names with lowercase letters and digits, safe on case
+// insensitive filesystems
+var namesEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// ivSize is the size of the synthetic IV prefixed to the encrypted names
+const ivSize = 16
+
+// Names encrypts the names of the files (single path elements) deterministically: the same name
+// is always encrypted the same way, so that the files can be found by name. The IV is the MAC of
+// the name (as in SIV), authenticating it when decrypted. An encrypted name is 1.6 times longer
+// than the name plus 26 characters
+type Names struct {
+	enc cipher.Block
+	mac []byte
+}
+
+// NewNames returns the names encryption with keys derived from the secret
+func NewNames(secret []byte) (*Names, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty names secret")
+	}
+	encKey, err := hkdf.Key(sha256.New, secret, nil, "smugmug-backup names encryption", 32)
+	if err != nil {
+		return nil, err
+	}
+	macKey, err := hkdf.Key(sha256.New, secret, nil, "smugmug-backup names authentication", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Names{enc: block, mac: macKey}, nil
+}
+
+func (n *Names) iv(name []byte) []byte {
+	mac := hmac.New(sha256.New, n.mac)
+	mac.Write(name)
+	return mac.Sum(nil)[:ivSize]
+}
+
+// Encrypt returns the encrypted name
+func (n *Names) Encrypt(name string) string {
+	iv := n.iv([]byte(name))
+	out := make([]byte, ivSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(n.enc, iv).XORKeyStream(out[ivSize:], []byte(name))
+	return namesEncoding.EncodeToString(out)
+}
+
+// Decrypt returns the name of an encrypted name, an error if it isn't an encrypted name
+func (n *Names) Decrypt(encrypted string) (string, error) {
+	data, err := namesEncoding.DecodeString(strings.ToLower(encrypted))
+	if err != nil || len(data) < ivSize {
+		return "", errors.New("not an encrypted name")
+	}
+	iv := data[:ivSize]
+	name := make([]byte, len(data)-ivSize)
+	cipher.NewCTR(n.enc, iv).XORKeyStream(name, data[ivSize:])
+	if !hmac.Equal(iv, n.iv(name)) {
+		return "", errors.New("not an encrypted name")
+	}
+	return string(name), nil
+}
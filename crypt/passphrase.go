@@ -0,0 +1,132 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// passphraseMagic starts the files encrypted by Passphrase, followed by the salt of the file
+const passphraseMagic = "SMGBAES1"
+
+const saltSize = 16
+
+// passphraseHeader is the size of the header of the files encrypted by Passphrase
+const passphraseHeader = len(passphraseMagic) + saltSize
+
+// Default scrypt cost parameters, the key is derived once per run
+const (
+	scryptN = 1 << 17
+	scryptR = 8
+	scryptP = 1
+)
+
+// KeyParams are the parameters deriving the key from the passphrase. They aren't secret and are
+// saved with the backup: the same parameters and passphrase are needed to decrypt the files
+type KeyParams struct {
+	Salt  []byte `json:"salt"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Check []byte `json:"check,omitempty"` // MAC of a constant with the key, verifying the passphrase
+}
+
+// NewKeyParams returns parameters with a random salt, for a new backup
+func NewKeyParams() (*KeyParams, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &KeyParams{Salt: salt, N: scryptN, R: scryptR, P: scryptP}, nil
+}
+
+// Passphrase is a Cipher encrypting the files with AES-256-GCM. The key of each file is derived
+// (HKDF-SHA256) from the key of the passphrase and a random salt stored in the file header
+type Passphrase struct {
+	key []byte
+}
+
+// NewPassphrase derives the key from the passphrase with scrypt. If params has no Check (new
+// parameters) it's set, otherwise the passphrase is verified with it
+func NewPassphrase(passphrase string, params *KeyParams) (*Passphrase, error) {
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	key, err := scrypt.Key([]byte(passphrase), params.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("cannot derive the key: %w", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("smugmug-backup passphrase check"))
+	check := mac.Sum(nil)
+	if params.Check == nil {
+		params.Check = check
+	} else if !hmac.Equal(check, params.Check) {
+		return nil, ErrWrongPassphrase
+	}
+	return &Passphrase{key: key}, nil
+}
+
+func (c *Passphrase) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, c.key, salt, "smugmug-backup file", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *Passphrase) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, passphraseMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return newStreamWriter(aead, w), nil
+}
+
+func (c *Passphrase) Decrypt(r io.Reader) (io.Reader, error) {
+	header := make([]byte, passphraseHeader)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("cannot read header: %w", err)
+	}
+	if !bytes.HasPrefix(header, []byte(passphraseMagic)) {
+		return nil, errors.New("not encrypted with a passphrase")
+	}
+	aead, err := c.aead(header[len(passphraseMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return newStreamReader(aead, r), nil
+}
+
+func (c *Passphrase) PlainSize(size int64) int64 {
+	return plainSize(size, int64(passphraseHeader))
+}
+
+// NamesSecret returns the secret encrypting the names (see NewNames), derived from the key
+func (c *Passphrase) NamesSecret() []byte {
+	secret, _ := hkdf.Key(sha256.New, c.key, nil, "smugmug-backup names", 32)
+	return secret
+}
@@ -0,0 +1,143 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The content is encrypted with the STREAM construction used by age: chunks of chunkSize bytes
+// are sealed with a nonce made of their counter and a flag set on the last chunk, so that
+// reordered, dropped or truncated chunks are detected
+
+// nonce returns the nonce of the chunk with the given counter
+func nonce(counter uint64, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[3:11], counter)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+// streamWriter encrypts the content written to w
+type streamWriter struct {
+	aead    cipher.AEAD
+	w       io.Writer
+	buf     []byte
+	counter uint64
+	err     error
+}
+
+func newStreamWriter(aead cipher.AEAD, w io.Writer) *streamWriter {
+	return &streamWriter{aead: aead, w: w, buf: make([]byte, 0, chunkSize+tagSize)}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is sealed only when more content follows: it may be the last one
+		if len(s.buf) == chunkSize {
+			if s.err = s.flush(false); s.err != nil {
+				return n, s.err
+			}
+		}
+		c := copy(s.buf[len(s.buf):chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (s *streamWriter) flush(last bool) error {
+	sealed := s.aead.Seal(s.buf[:0], nonce(s.counter, last), s.buf, nil)
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+	s.counter++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// errClosed is returned writing to a closed stream
+var errClosed = errors.New("write to closed stream")
+
+// Close seals the last chunk, it doesn't close the underlying writer
+func (s *streamWriter) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.flush(true); err != nil {
+		s.err = err
+		return err
+	}
+	s.err = errClosed
+	return nil
+}
+
+// streamReader decrypts the content read from r
+type streamReader struct {
+	aead    cipher.AEAD
+	r       *bufio.Reader
+	chunk   []byte // Decrypted content not read yet
+	buf     []byte
+	counter uint64
+	last    bool
+}
+
+func newStreamReader(aead cipher.AEAD, r io.Reader) *streamReader {
+	return &streamReader{aead: aead, r: bufio.NewReader(r), buf: make([]byte, chunkSize+tagSize)}
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.chunk) == 0 {
+		if s.last {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk. A chunk is the last one if it's shorter than a full chunk or if
+// nothing follows it
+func (s *streamReader) next() error {
+	n, err := io.ReadFull(s.r, s.buf)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		s.last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := s.r.Peek(1); errors.Is(err, io.EOF) {
+			s.last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < tagSize {
+		return fmt.Errorf("decrypt: %w", io.ErrUnexpectedEOF)
+	}
+	chunk, err := s.aead.Open(s.buf[:0], nonce(s.counter, s.last), s.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("decrypt: corrupted or truncated content")
+	}
+	if len(chunk) == 0 && s.counter > 0 {
+		// Only empty files have an empty chunk
+		return fmt.Errorf("decrypt: corrupted content")
+	}
+	s.counter++
+	s.chunk = chunk
+	return nil
+}
@@ -3,14 +3,17 @@ package smugmug
 import (
 	"encoding/csv"
 	"fmt"
-	"os"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
 )
 
 // METADATA_FNAME is the name of the CSV file used to store files metadata
 const METADATA_FNAME = "metadata.csv"
 
+// csvBatchSize is the max number of images buffered before writing their metadata to the CSV file
+const csvBatchSize = 500
+
 var csvHeader = []string{
 	"Filename",
 	"Type",
@@ -21,18 +24,20 @@ var csvHeader = []string{
 	"Longitude",
 }
 
-// createMetadataCSV creates the metadata CSV file and writes the header line
-func createMetadataCSV(fpath string) error {
-	file, err := os.Create(fpath)
+// createMetadataCSV creates the metadata CSV file in the storage and writes the header line
+func createMetadataCSV(store storage.Storage, fpath string) error {
+	file, err := store.Create(fpath)
 	if err != nil {
 		return fmt.Errorf("failed creating metadata CSV file: %v", err)
 	}
-	defer file.Close()
-
 	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	return writer.Write(csvHeader)
+	writer.Write(csvHeader)
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed writing metadata CSV file: %v", err)
+	}
+	return file.Close()
 }
 
 // buildMetadata returns the data to be added to the metadata CSV file
@@ -58,9 +63,10 @@ func (w *Worker) writeToCSV(images []albumImage, folder string) {
 	w.csvLock.Lock()
 	defer w.csvLock.Unlock()
 
-	file, err := os.OpenFile(w.cfg.metadataFile, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+	file, err := w.store.Append(w.cfg.metadataFile)
 	if err != nil {
 		log.Errorf("cannot open metadata CSV file: %v", err)
+		return
 	}
 	defer file.Close()
 
@@ -3,18 +3,20 @@ package smugmug
 import (
 	"bytes"
 	"io"
-	"os"
-	"path/filepath"
 	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tommyblue/smugmug-backup/client"
+	"github.com/tommyblue/smugmug-backup/storage"
 )
 
 func Test_createMetadataCSV(t *testing.T) {
-	fpath := filepath.Join(t.TempDir(), "file.csv")
-	if err := createMetadataCSV(fpath); err != nil {
+	fs := afero.NewMemMapFs()
+	if err := createMetadataCSV(storage.NewFs(fs), "file.csv"); err != nil {
 		t.Fatalf("cannot create csv file: %v", err)
 	}
 
-	f, err := os.Open(fpath)
+	f, err := fs.Open("file.csv")
 	if err != nil {
 		t.Fatalf("cannot open csv file: %v", err)
 	}
@@ -30,47 +32,55 @@ func Test_createMetadataCSV(t *testing.T) {
 }
 
 func Test_writeToCSV(t *testing.T) {
-	fpath := filepath.Join(t.TempDir(), "file.csv")
-	if err := createMetadataCSV(fpath); err != nil {
+	fs := afero.NewMemMapFs()
+	store := storage.NewFs(fs)
+	if err := createMetadataCSV(store, "file.csv"); err != nil {
 		t.Fatalf("cannot create csv file: %v", err)
 	}
 
 	w := &Worker{
 		cfg: &Conf{
-			metadataFile: fpath,
+			metadataFile: "file.csv",
 		},
+		store: store,
 	}
 
 	images := []albumImage{
 		{
 			builtFilename: "fname1",
-			ArchivedUri:   "url",
-			Caption:       "asdsad",
-			Keywords:      "a,b,c",
-			Latitude:      "40.123",
-			Longitude:     "11.11",
+			AlbumImage: client.AlbumImage{
+				ArchivedUri: "url",
+				Caption:     "asdsad",
+				Keywords:    "a,b,c",
+				Latitude:    "40.123",
+				Longitude:   "11.11",
+			},
 		},
 		{
 			builtFilename: "fname2",
-			ArchivedUri:   "url",
-			Caption:       "asdsad",
-			Keywords:      "a,b,c",
-			Latitude:      "40.123",
-			Longitude:     "11.11",
+			AlbumImage: client.AlbumImage{
+				ArchivedUri: "url",
+				Caption:     "asdsad",
+				Keywords:    "a,b,c",
+				Latitude:    "40.123",
+				Longitude:   "11.11",
+			},
 		},
 		{
 			builtFilename: "fname3",
-			ArchivedUri:   "url",
-			Caption:       "asdsad",
-			Keywords:      "a,b,c",
-			Latitude:      "40.123",
-			Longitude:     "11.11",
+			AlbumImage: client.AlbumImage{
+				ArchivedUri: "url",
+				Caption:     "asdsad",
+				Keywords:    "a,b,c",
+				Latitude:    "40.123",
+				Longitude:   "11.11",
+			},
 		},
 	}
 
 	w.writeToCSV(images, "test")
 
-	f, err := os.Open(fpath)
+	f, err := fs.Open("file.csv")
 	if err != nil {
 		t.Fatalf("cannot open csv file: %v", err)
 	}
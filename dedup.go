@@ -0,0 +1,211 @@
+package smugmug
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
+)
+
+// How the duplicated images and videos are saved
+const (
+	dedupHardlink = "hardlink"
+	dedupSymlink  = "symlink"
+	dedupReflink  = "reflink"
+)
+
+// validateDedup checks store.dedup and that it isn't used with the options saving the files
+// in a different form
+func (cfg *Conf) validateDedup() error {
+	switch cfg.Dedup {
+	case "":
+		return nil
+	case dedupHardlink, dedupSymlink, dedupReflink:
+	default:
+		return fmt.Errorf("invalid store.dedup %q, it must be hardlink, symlink or reflink", cfg.Dedup)
+	}
+	if cfg.Archive != "" {
+		return errors.New("store.dedup can't be used with store.archive")
+	}
+	if cfg.encrypted() {
+		return errors.New("store.dedup can't be used with encryption")
+	}
+	return nil
+}
+
+// dedup saves the images and videos with the same content, found in several albums, only once.
+// The first file is downloaded, the others are links to it. The files saved by the previous
+// backups are replaced by links too, so that enabling dedup on an existing backup frees the space
+// of the duplicates
+type dedup struct {
+	store    storage.Storage
+	mode     string
+	versions *versionKeeper // nil if the replaced files aren't kept
+
+	mu    sync.Mutex
+	files map[string]*dedupFile // By MD5 and size
+}
+
+// dedupFile is the first file saved with a content
+type dedupFile struct {
+	name string
+	done chan struct{} // Closed when the file has been saved
+	err  error
+}
+
+// newDedup returns a dedup linking the duplicated files in store with the given mode
+func newDedup(store storage.Storage, mode string) (*dedup, error) {
+	if _, ok := store.(storage.Linker); !ok && mode != dedupReflink {
+		return nil, fmt.Errorf("store.dedup %s requires a destination supporting links, like a local folder or sftp", mode)
+	}
+	if _, ok := store.(storage.Cloner); !ok && mode == dedupReflink {
+		return nil, errors.New("store.dedup reflink requires a local destination")
+	}
+	return &dedup{store: store, mode: mode, files: make(map[string]*dedupFile)}, nil
+}
+
+// fetch saves the named file with the given MD5 and size. The first file with that content is
+// saved with download, the following ones are linked to it once it's saved. It returns true if
+// the file has been downloaded
+func (d *dedup) fetch(ctx context.Context, name, md5 string, size int64, download func() (bool, error)) (bool, error) {
+	key := fmt.Sprintf("%s/%d", strings.ToLower(md5), size)
+	d.mu.Lock()
+	first, ok := d.files[key]
+	if !ok {
+		first = &dedupFile{name: name, done: make(chan struct{})}
+		d.files[key] = first
+	}
+	d.mu.Unlock()
+
+	if !ok || first.name == name {
+		if ok {
+			// The same file listed twice
+			return download()
+		}
+		downloaded, err := download()
+		first.err = err
+		close(first.done)
+		return downloaded, err
+	}
+
+	select {
+	case <-first.done:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	if first.err != nil {
+		return download()
+	}
+
+	fi, err := d.store.Stat(name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("cannot check file size: %w", err)
+	}
+	same := exists && fi.Size == size
+	src := d.source(first.name)
+	if same && (src == name || d.linked(src, name)) {
+		return false, nil
+	}
+	if err := d.link(src, name, exists && !same); err != nil {
+		if same {
+			log.WithError(err).Warnf("cannot link %s to %s, keeping it", name, src)
+			return false, nil
+		}
+		log.WithError(err).Warnf("cannot link %s to %s, downloading it", name, src)
+		return download()
+	}
+	if same && d.mode == dedupReflink {
+		// The clone replacing a file saved by a previous backup keeps its modification time
+		if err := d.store.Chtimes(name, time.Now(), fi.ModTime); err != nil {
+			return false, err
+		}
+	}
+	if same {
+		log.Debugf("%s linked to %s", name, src)
+	} else {
+		log.Infof("%s linked to %s", name, src)
+	}
+	return false, nil
+}
+
+// source returns the file the duplicates are linked to: the first one saved or, if it's a
+// symbolic link saved by a previous backup, its target
+func (d *dedup) source(first string) string {
+	if d.mode != dedupSymlink {
+		return first
+	}
+	target, err := d.store.(storage.Linker).Readlink(first)
+	if err != nil {
+		return first
+	}
+	return path.Join(path.Dir(first), target)
+}
+
+// linked returns true if the named file is already a link to src. The reflinks can't be told
+// apart from the copies, they're cloned again
+func (d *dedup) linked(src, name string) bool {
+	switch d.mode {
+	case dedupHardlink:
+		same, err := d.store.(storage.Linker).SameFile(src, name)
+		return err == nil && same
+	case dedupSymlink:
+		target, err := d.store.(storage.Linker).Readlink(name)
+		return err == nil && path.Join(path.Dir(name), target) == src
+	}
+	return false
+}
+
+// link replaces the named file with a link to src. If replaced is true the content of the file
+// differs from src and, if the versions are kept, it's moved to the versions folder
+func (d *dedup) link(src, name string, replaced bool) error {
+	partial := name + storage.PartialSuffix
+	if err := d.store.Remove(partial); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var err error
+	switch d.mode {
+	case dedupHardlink:
+		err = d.store.(storage.Linker).Link(src, partial)
+	case dedupSymlink:
+		// Relative, so that the backup can be moved
+		var target string
+		if target, err = filepath.Rel(filepath.FromSlash(path.Dir(name)), filepath.FromSlash(src)); err == nil {
+			err = d.store.(storage.Linker).Symlink(filepath.ToSlash(target), partial)
+		}
+	case dedupReflink:
+		err = d.store.(storage.Cloner).Clone(src, partial)
+	}
+	if err != nil {
+		return err
+	}
+	rename := func() error { return d.store.Rename(partial, name) }
+	if replaced && d.versions != nil {
+		err = d.versions.keep(name, rename)
+	} else {
+		err = rename()
+	}
+	if err != nil {
+		d.store.Remove(partial)
+		return err
+	}
+	return nil
+}
+
+// fetch saves the image or video to dest with downloadFn, unless a file with the same content
+// has already been saved and dest can be linked to it
+func (w *Worker) fetch(ctx context.Context, dest, downloadURL string, fileSize int64, wantMD5 string) (bool, error) {
+	download := func() (bool, error) { return w.downloadFn(ctx, dest, downloadURL, fileSize, wantMD5) }
+	if w.dedup == nil || wantMD5 == "" {
+		return download()
+	}
+	return w.dedup.fetch(ctx, dest, wantMD5, fileSize, download)
+}
@@ -0,0 +1,183 @@
+package smugmug
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tommyblue/smugmug-backup/storage"
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestDedup(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	for _, mode := range []string{dedupHardlink, dedupSymlink, dedupReflink} {
+		t.Run(mode, func(t *testing.T) {
+			dir := t.TempDir()
+			store := storage.NewLocal(dir)
+			var downloads atomic.Int32
+			w := newTestWorker(t, func(_ context.Context, dest, _ string, size int64, _ string) (bool, error) {
+				if same, _ := sameFile(store, dest, size, ""); same {
+					return false, nil
+				}
+				downloads.Add(1)
+				f, err := storage.CreateAtomic(store, dest)
+				if err != nil {
+					return false, err
+				}
+				io.WriteString(f, "image")
+				return true, f.Close()
+			})
+			w.store = store
+			var err error
+			if w.dedup, err = newDedup(store, mode); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The same image in several albums, saved concurrently
+			var wg sync.WaitGroup
+			for i := range 5 {
+				store.MkdirAll(fmt.Sprintf("album_%d", i))
+				wg.Go(func() {
+					if _, err := w.fetch(context.Background(), fmt.Sprintf("album_%d/img.jpg", i), "", 5, "ABC"); err != nil {
+						t.Errorf("unexpected error: %v", err)
+					}
+				})
+			}
+			wg.Wait()
+			// A different image with the same name
+			w.fetch(context.Background(), "album_0/other.jpg", "", 5, "def")
+
+			// Reflinks fall back to the downloads on the filesystems not supporting them
+			if n := downloads.Load(); n != 2 && mode != dedupReflink {
+				t.Fatalf("want 2 downloads, got %d", n)
+			}
+			var link string
+			for i := range 5 {
+				name := filepath.Join(dir, fmt.Sprintf("album_%d/img.jpg", i))
+				if content, err := os.ReadFile(name); err != nil || string(content) != "image" {
+					t.Fatalf("unexpected content of %s: %q, %v", name, content, err)
+				}
+				fi, _ := os.Lstat(name)
+				if mode == dedupSymlink && fi.Mode()&os.ModeSymlink != 0 {
+					link = name
+				}
+			}
+			if mode == dedupSymlink {
+				// Only the first one saved is a file
+				target, err := os.Readlink(link)
+				if err != nil || filepath.Dir(target) == "." || filepath.IsAbs(target) {
+					t.Fatalf("want relative link, got %q, %v", target, err)
+				}
+			}
+			if mode == dedupHardlink {
+				a, _ := os.Stat(filepath.Join(dir, "album_0/img.jpg"))
+				b, _ := os.Stat(filepath.Join(dir, "album_4/img.jpg"))
+				if !os.SameFile(a, b) {
+					t.Fatalf("want hard links")
+				}
+			}
+
+			// The links are kept by the following backups
+			downloads.Store(0)
+			w.dedup, _ = newDedup(store, mode)
+			for i := range 5 {
+				w.fetch(context.Background(), fmt.Sprintf("album_%d/img.jpg", i), "", 5, "abc")
+			}
+			if n := downloads.Load(); n != 0 {
+				t.Fatalf("want no downloads, got %d", n)
+			}
+
+			// The copies saved without dedup are replaced by links, whatever the order of the
+			// albums
+			for _, name := range []string{"copy_a/img.jpg", "copy_b/img.jpg"} {
+				os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+				os.WriteFile(filepath.Join(dir, name), []byte("other"), 0o644)
+			}
+			for _, albums := range [][]string{{"copy_a", "copy_b"}, {"copy_b", "copy_a"}} {
+				w.dedup, _ = newDedup(store, mode)
+				for _, album := range albums {
+					if _, err := w.fetch(context.Background(), album+"/img.jpg", "", 5, "123"); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+				}
+			}
+			if n := downloads.Load(); n != 0 {
+				t.Fatalf("want no downloads, got %d", n)
+			}
+			var symlinks int
+			for _, name := range []string{"copy_a/img.jpg", "copy_b/img.jpg"} {
+				if content, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(content) != "other" {
+					t.Fatalf("unexpected content of %s: %q, %v", name, content, err)
+				}
+				if fi, _ := os.Lstat(filepath.Join(dir, name)); fi.Mode()&os.ModeSymlink != 0 {
+					symlinks++
+				}
+			}
+			if mode == dedupSymlink && symlinks != 1 {
+				t.Fatalf("want 1 symlink, got %d", symlinks)
+			}
+			if mode == dedupHardlink {
+				if same, _ := store.SameFile("copy_a/img.jpg", "copy_b/img.jpg"); !same {
+					t.Fatalf("want hard links")
+				}
+			}
+		})
+	}
+}
+
+func TestDedupVersions(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	dir := t.TempDir()
+	store := storage.NewLocal(dir)
+	for name, content := range map[string]string{"a/img.jpg": "image", "b/img.jpg": "old"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	}
+	d, err := newDedup(store, dedupHardlink)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d.versions = newVersionKeeper(store, 0, 0)
+
+	// The replaced file is kept as a previous version
+	download := func() (bool, error) { return false, nil }
+	for _, name := range []string{"a/img.jpg", "b/img.jpg"} {
+		if _, err := d.fetch(context.Background(), name, "abc", 5, download); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "b/img.jpg")); string(content) != "image" {
+		t.Fatalf("want b/img.jpg linked, got %q", content)
+	}
+	versions, err := os.ReadDir(filepath.Join(dir, versionsFolder, "b"))
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("want 1 version, got %d, %v", len(versions), err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, versionsFolder, "b", versions[0].Name())); string(content) != "old" {
+		t.Fatalf("unexpected version content %q", content)
+	}
+}
+
+func TestValidateDedup(t *testing.T) {
+	for name, cfg := range map[string]Conf{
+		"invalid":    {Dedup: "copy"},
+		"archive":    {Dedup: dedupHardlink, Archive: "zip"},
+		"encryption": {Dedup: dedupSymlink, EncryptPassphrase: "secret"},
+	} {
+		if err := cfg.validateDedup(); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+	cfg := Conf{Dedup: dedupReflink}
+	if err := cfg.validateDedup(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package smugmug
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpDialTimeout is the max time to connect and log in to the SFTP servers
+const sftpDialTimeout = 30 * time.Second
+
+// defaultSSHKeys are the keys of ~/.ssh tried when sftp.key_file isn't set
+var defaultSSHKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// isRemoteDestination returns true if the destination is the URL of a remote storage instead of
+// a local folder
+func isRemoteDestination(dest string) bool {
+	return strings.HasPrefix(dest, "s3://") || strings.HasPrefix(dest, "sftp://")
+}
+
+// openStorage returns the destination of the backup, encrypting the files and saving them in
+// archives if configured
+func (cfg *Conf) openStorage() (storage.Storage, error) {
+	store := cfg.Storage
+	if store == nil {
+		var err error
+		if store, err = cfg.newStorage(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.encrypted() {
+		var err error
+		if store, err = cfg.encryptStorage(store); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Archive != "" {
+		store = storage.NewArchive(store, storage.ArchiveFormat(cfg.Archive), cfg.ArchiveTempDir)
+	}
+	return store, nil
+}
+
+// newStorage returns the storage of the backup destination: the bucket of "s3://bucket/prefix"
+// destinations, the remote folder of "sftp://user@host/path" destinations, the local folder
+// otherwise
+func (cfg *Conf) newStorage() (storage.Storage, error) {
+	if !isRemoteDestination(cfg.Destination) {
+		return storage.NewLocal(cfg.Destination), nil
+	}
+
+	u, err := url.Parse(cfg.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination: %w", err)
+	}
+	if u.Scheme == "sftp" {
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid destination %s: missing host", cfg.Destination)
+		}
+		return cfg.newSFTPStorage(u)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid destination %s: missing bucket", cfg.Destination)
+	}
+	return cfg.newS3Storage(u.Host, u.Path)
+}
+
+// newS3Storage returns the storage of an S3 bucket, using the static credentials of the
+// configuration or, if not set, the ones of the environment (AWS_ACCESS_KEY_ID, ~/.aws, IAM roles)
+func (cfg *Conf) newS3Storage(bucket, prefix string) (storage.Storage, error) {
+	var creds *credentials.Credentials
+	switch {
+	case cfg.S3AccessKey != "" && cfg.S3SecretKey != "":
+		creds = credentials.NewStaticV4(cfg.S3AccessKey, cfg.S3SecretKey, "")
+	case cfg.S3AccessKey != "" || cfg.S3SecretKey != "":
+		return nil, errors.New("both s3.access_key and s3.secret_key are required")
+	default:
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	endpoint := cfg.S3Endpoint
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	opts := &minio.Options{
+		Creds:  creds,
+		Secure: !cfg.S3Insecure,
+		Region: cfg.S3Region,
+	}
+	if cfg.HTTPClient != nil {
+		opts.Transport = cfg.HTTPClient.Transport
+	}
+	c, err := minio.New(endpoint, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the S3 client: %w", err)
+	}
+	return storage.NewS3(c, bucket, prefix, cfg.S3PartSize), nil
+}
+
+// newSFTPStorage connects to the server of a "sftp://user@host:port/path" destination. The server
+// is verified with the known_hosts file, the user is authenticated with sftp.key_file or, if not
+// set, with the keys of the SSH agent and the default keys of ~/.ssh
+func (cfg *Conf) newSFTPStorage(u *url.URL) (storage.Storage, error) {
+	if _, ok := u.User.Password(); ok {
+		return nil, errors.New("sftp destinations don't support passwords, use SSH keys")
+	}
+	username := u.User.Username()
+	if username == "" {
+		cur, err := osuser.Current()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get the current user: %w", err)
+		}
+		username = cur.Username
+	}
+
+	var signers []ssh.Signer
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" && cfg.SFTPKeyFile == "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			// The agent is used only to log in
+			defer conn.Close()
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	keys, err := cfg.sshKeys()
+	if err != nil {
+		return nil, err
+	}
+	signers = append(signers, keys...)
+	if len(signers) == 0 {
+		return nil, errors.New("no SSH keys found for the sftp destination, set sftp.key_file")
+	}
+
+	knownHosts := cfg.SFTPKnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("cannot find the known_hosts file: %w", err)
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts: %w", err)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:              username,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeys, addr),
+		Timeout:           sftpDialTimeout,
+	})
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+		return nil, fmt.Errorf("cannot connect to %s: unknown host, add its key to %s (e.g. with ssh-keyscan)", addr, knownHosts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", addr, err)
+	}
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot start sftp on %s: %w", addr, err)
+	}
+
+	// Paths starting with "/~/" are relative to the home of the user
+	root := u.Path
+	if root == "/~" || strings.HasPrefix(root, "/~/") {
+		root = strings.TrimPrefix(strings.TrimPrefix(root, "/~"), "/")
+	}
+	return storage.NewSFTP(c, root), nil
+}
+
+// sshKeys returns the signer of sftp.key_file or, if not set, the ones of the default keys found
+// in ~/.ssh. The keys are decrypted with sftp.key_passphrase, if set
+func (cfg *Conf) sshKeys() ([]ssh.Signer, error) {
+	if cfg.SFTPKeyFile != "" {
+		signer, err := loadSSHKey(cfg.SFTPKeyFile, cfg.SFTPKeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("sftp.key_file: %w", err)
+		}
+		return []ssh.Signer{signer}, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil
+	}
+	var signers []ssh.Signer
+	for _, name := range defaultSSHKeys {
+		signer, err := loadSSHKey(filepath.Join(home, ".ssh", name), cfg.SFTPKeyPassphrase)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("Ignoring SSH key %s: %v", name, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// loadSSHKey reads a private key, decrypting it with the passphrase if it's protected
+func loadSSHKey(file, passphrase string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("%s is protected by a passphrase, set sftp.key_passphrase", file)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s: %w", file, err)
+	}
+	return signer, nil
+}
+
+// hostKeyAlgorithms returns the algorithms of the keys of addr in known_hosts, so that the server
+// presents one of the known keys instead of its preferred one. It returns nil for unknown hosts
+func hostKeyAlgorithms(hostKeys ssh.HostKeyCallback, addr string) []string {
+	// Checking a key not matching the known ones, the error reports them
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	placeholder, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if err := hostKeys(addr, &net.TCPAddr{IP: net.IPv4zero}, placeholder); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, k := range keyErr.Want {
+		if k.Key.Type() == ssh.KeyAlgoRSA {
+			// The same RSA key signs with SHA-2 too
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algos = append(algos, k.Key.Type())
+	}
+	return algos
+}
@@ -14,12 +14,14 @@ Creating a binary with this package is as simple as:
 	package main
 
 	import (
+		"context"
+
 		log "github.com/sirupsen/logrus"
 		"github.com/tommyblue/smugmug-backup"
 	)
 
 	func main() {
-		cfg, err := smugmug.ReadConf()
+		cfg, err := smugmug.ReadConf("")
 		if err != nil {
 			log.WithError(err).Fatal("Configuration error")
 		}
@@ -29,11 +31,14 @@ Creating a binary with this package is as simple as:
 			log.WithError(err).Fatal("Can't initialize the package")
 		}
 
-		if err := wrk.Run(); err != nil {
+		if err := wrk.Run(context.Background()); err != nil {
 			log.Fatal(err)
 		}
 	}
 
+Cancelling the context passed to Run interrupts the backup, aborting the pending
+API calls and downloads.
+
 The app reads its configuration from ./config.toml or $HOME/.smgmg/config.toml.
 
 The supported configuration keys/values are the following:
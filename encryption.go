@@ -0,0 +1,180 @@
+package smugmug
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/crypt"
+	"github.com/tommyblue/smugmug-backup/storage"
+)
+
+// keyParamsFile stores the parameters deriving the key from encryption.passphrase
+var keyParamsFile = path.Join(storage.MetaFolder, "key.json")
+
+// encrypted returns true if the files of the backup are encrypted
+func (cfg *Conf) encrypted() bool {
+	return cfg.EncryptPassphrase != "" || len(cfg.EncryptRecipients) > 0 || cfg.EncryptIdentity != ""
+}
+
+// validateEncryption checks that the encryption settings can be used together
+func (cfg *Conf) validateEncryption() error {
+	if !cfg.encrypted() {
+		if cfg.EncryptNames {
+			return errors.New("encryption.encrypt_names requires encryption.passphrase or encryption.recipients")
+		}
+		return nil
+	}
+	if cfg.EncryptPassphrase != "" && (len(cfg.EncryptRecipients) > 0 || cfg.EncryptIdentity != "") {
+		return errors.New("use either encryption.passphrase or the age recipients and identity, not both")
+	}
+	if cfg.WriteCSV {
+		// The CSV file is appended at each run, the encrypted files can't be
+		return errors.New("store.write_csv can't be used with encryption")
+	}
+	return nil
+}
+
+// encryptStorage returns a storage encrypting the files saved on store, with the key derived from
+// encryption.passphrase or to the age recipients
+func (cfg *Conf) encryptStorage(store storage.Storage) (*storage.Encrypted, error) {
+	var (
+		c           crypt.Cipher
+		namesSecret []byte
+	)
+	if cfg.EncryptPassphrase != "" {
+		p, err := passphraseCipher(store, cfg.EncryptPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		c, namesSecret = p, p.NamesSecret()
+	} else {
+		a, err := cfg.ageCipher()
+		if err != nil {
+			return nil, err
+		}
+		c, namesSecret = a, a.NamesSecret()
+	}
+
+	var names *crypt.Names
+	if cfg.EncryptNames {
+		if namesSecret == nil {
+			// The recipients are public, the names would be encrypted with a known key
+			return nil, errors.New("encryption.encrypt_names requires encryption.identity_file with the age recipients")
+		}
+		var err error
+		if names, err = crypt.NewNames(namesSecret); err != nil {
+			return nil, err
+		}
+	}
+	return storage.NewEncrypted(store, c, names), nil
+}
+
+// passphraseCipher derives the key from the passphrase with the parameters saved in the backup,
+// saving new parameters on the first run
+func passphraseCipher(store storage.Storage, passphrase string) (*crypt.Passphrase, error) {
+	params, err := readKeyParams(store)
+	isNew := errors.Is(err, fs.ErrNotExist)
+	if isNew {
+		params, err = crypt.NewKeyParams()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the key parameters %s: %w", keyParamsFile, err)
+	}
+
+	p, err := crypt.NewPassphrase(passphrase, params)
+	if errors.Is(err, crypt.ErrWrongPassphrase) {
+		return nil, errors.New("encryption.passphrase doesn't match the one of the backup")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encryption.passphrase: %w", err)
+	}
+	if isNew {
+		if err := writeKeyParams(store, params); err != nil {
+			return nil, fmt.Errorf("cannot save the key parameters %s: %w", keyParamsFile, err)
+		}
+	}
+	return p, nil
+}
+
+func readKeyParams(store storage.Storage) (*crypt.KeyParams, error) {
+	r, err := store.Open(keyParamsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var params crypt.KeyParams
+	if err := json.NewDecoder(r).Decode(&params); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+func writeKeyParams(store storage.Storage, params *crypt.KeyParams) error {
+	data, err := json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.MkdirAll(storage.MetaFolder); err != nil {
+		return err
+	}
+	w, err := storage.CreateAtomic(store, keyParamsFile)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// ageCipher returns the cipher encrypting to encryption.recipients and to the identities of
+// encryption.identity_file, which also decrypt the files
+func (cfg *Conf) ageCipher() (*crypt.Age, error) {
+	var recipients []age.Recipient
+	if len(cfg.EncryptRecipients) > 0 {
+		var err error
+		recipients, err = age.ParseRecipients(strings.NewReader(strings.Join(cfg.EncryptRecipients, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("encryption.recipients: %w", err)
+		}
+	}
+
+	var identities []age.Identity
+	if cfg.EncryptIdentity != "" {
+		f, err := os.Open(cfg.EncryptIdentity)
+		if err != nil {
+			return nil, fmt.Errorf("encryption.identity_file: %w", err)
+		}
+		defer f.Close()
+		identities, err = age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("encryption.identity_file: %w", err)
+		}
+	}
+
+	a, err := crypt.NewAge(recipients, identities)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	return a, nil
+}
+
+// flushStorage saves the pending data of the storage, e.g. the manifest of the encrypted files
+func (w *Worker) flushStorage() {
+	f, ok := w.store.(storage.Flusher)
+	if !ok {
+		return
+	}
+	if err := f.Flush(); err != nil {
+		log.WithError(err).Error("cannot save the manifest of the backup")
+		w.errors.Add(1)
+	}
+}
@@ -0,0 +1,7 @@
+package smugmug
+
+import "github.com/tommyblue/smugmug-backup/client"
+
+// APIError is returned when SmugMug replies to a request with an error status code (>= 400).
+// Use errors.As to get it from the errors returned by the package
+type APIError = client.APIError
@@ -3,14 +3,18 @@ package smugmug
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
 )
 
-func createFolder(path string) error {
-	_, err := os.Stat(path)
+func createFolder(store storage.Storage, path string) error {
+	_, err := store.Stat(path)
 
 	// Folder exists
 	if err == nil {
@@ -18,13 +22,34 @@ func createFolder(path string) error {
 	}
 
 	log.Infof("Creating folder %s\n", path)
-	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+	if err := store.MkdirAll(path); err != nil {
 		return fmt.Errorf("cannot create folder: %v", err)
 	}
 
 	return nil
 }
 
+// removePartials removes the temporary files of the downloads left in folder by a previous run,
+// e.g. when the process has been killed before cleaning them up
+func removePartials(store storage.Storage, folder string) {
+	files, err := store.List(folder)
+	if err != nil {
+		log.WithError(err).Warnf("cannot look for partial downloads in %s", folder)
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir || !strings.HasSuffix(fi.Name, storage.PartialSuffix) {
+			continue
+		}
+		name := path.Join(folder, fi.Name)
+		if err := store.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.WithError(err).Warnf("cannot remove the partial download %s", name)
+			continue
+		}
+		log.Infof("Removed the partial download %s", name)
+	}
+}
+
 func checkDestFolder(folderPath string) error {
 	if !filepath.IsAbs(folderPath) {
 		return errors.New("destination path must be an absolute path")
@@ -42,10 +67,18 @@ func checkDestFolder(folderPath string) error {
 	return nil
 }
 
-func sameFileSizes(path string, fileSize int64) bool {
-	fi, err := os.Stat(path)
+// sameFile returns true if the file at path exists in the storage and has the given size. If
+// both wantMD5 and the MD5 of the file are known (e.g. from the S3 metadata), they must match too
+func sameFile(store storage.Storage, path string, fileSize int64, wantMD5 string) (bool, error) {
+	fi, err := store.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		return false, fmt.Errorf("cannot check file size: %w", err)
+	}
+	if fi.Size != fileSize {
+		return false, nil
 	}
-	return fi.Size() == fileSize
+	return wantMD5 == "" || fi.MD5 == "" || strings.EqualFold(fi.MD5, wantMD5), nil
 }
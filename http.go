@@ -1,165 +1,163 @@
 package smugmug
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
-	"os"
-	"time"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/client"
+	"github.com/tommyblue/smugmug-backup/storage"
 )
 
-type header struct {
-	name  string
-	value string
-}
-
+// handler makes the API calls and downloads of the worker with a single client, sharing the
+// pool of connections
 type handler struct {
-	baseUrl    string
-	maxRetries int
-	oauth      *oauthConf
+	client    *client.Client
+	metrics   *metrics
+	bandwidth *bandwidthLimiter
+	cache     *responseCache // nil if the API responses aren't cached
+	store     storage.Storage
+	versions  *versionKeeper // nil if the replaced files aren't kept
+	snapshots *snapshots     // nil if the backup isn't saved in snapshots
 }
 
-func newHTTPHandler(baseUrl string, maxRetries int, apiKey, apiSecret, userToken, userSecret string) *handler {
+// newHTTPHandler returns a handler calling the API at baseUrl and saving the downloads to store.
+// The options are applied to the client after the ones set by the handler
+func newHTTPHandler(baseUrl string, maxConcurrency int, apiKey, apiSecret, userToken, userSecret string, m *metrics, bw *bandwidthLimiter, store storage.Storage, opts ...client.Option) *handler {
+	opts = append([]client.Option{
+		client.WithBaseURL(baseUrl),
+		client.WithMaxConcurrency(maxConcurrency),
+		client.WithObserver(m),
+	}, opts...)
 	return &handler{
-		baseUrl:    baseUrl,
-		maxRetries: maxRetries,
-		oauth:      newOauthConf(apiKey, apiSecret, userToken, userSecret),
-	}
-}
-
-// get calls getJSON with the given url
-func (s *handler) get(url string, obj interface{}) error {
-	if url == "" {
-		return errors.New("can't get empty url")
+		client:    client.New(apiKey, apiSecret, userToken, userSecret, opts...),
+		metrics:   m,
+		bandwidth: bw,
+		store:     store,
 	}
-	return s.getJSON(fmt.Sprintf("%s%s", s.baseUrl, url), obj)
 }
 
-// download the resource (image or video) from the given url to the given destination, checking
-// if a file with the same size exists (and skipping the download in that case, returning false)
-func (s *handler) download(dest, downloadURL string, fileSize int64) (bool, error) {
-	if _, err := os.Stat(dest); err == nil {
-		if sameFileSizes(dest, fileSize) {
-			log.Debug("File exists with same size:", downloadURL)
-			return false, nil
-		}
+// Get calls the given API uri with the options, decoding the JSON response on obj. If the
+// responses are cached, the call is conditional and the cached response is used if it hasn't
+// changed
+func (s *handler) Get(ctx context.Context, uri string, obj any, opts ...client.RequestOption) error {
+	if s.cache == nil {
+		return s.client.Get(ctx, uri, obj, opts...)
 	}
-	log.Info("Getting ", downloadURL)
 
-	response, err := s.makeAPICall(downloadURL)
+	url, err := client.ApplyOptions(uri, opts...)
 	if err != nil {
-		return false, fmt.Errorf("%s: download failed with: %s", downloadURL, err)
+		return err
 	}
-	defer response.Body.Close()
-
-	// Create empty destination file
-	file, err := os.Create(dest)
+	cached, err := s.cache.load(url)
 	if err != nil {
-		return false, fmt.Errorf("%s: file creation failed with: %s", dest, err)
+		log.WithError(err).Warn("API cache")
+	}
+	var validators client.Validators
+	if cached != nil {
+		validators = cached.validators()
 	}
-	defer file.Close()
 
-	// Copy the content to the file
-	_, err = io.Copy(file, response.Body)
+	body, validators, err := s.client.GetConditional(ctx, url, validators)
+	if errors.Is(err, client.ErrNotModified) && cached != nil {
+		log.Debug("Not modified, using cached response of ", url)
+		s.metrics.cacheHits.Add(1)
+		return json.Unmarshal(cached.Body, obj)
+	}
 	if err != nil {
-		return false, fmt.Errorf("%s: file content copy failed with: %s", dest, err)
+		return err
 	}
+	s.metrics.cacheMisses.Add(1)
 
-	log.Info("Saved ", dest)
-	return true, nil
-}
-
-// getJSON makes a http calls to the given url, trying to decode the JSON response on the given obj
-func (s *handler) getJSON(url string, obj interface{}) error {
-	var result interface{}
-	for i := 1; i <= s.maxRetries; i++ {
-		log.Debug("Calling ", url)
-		resp, err := s.makeAPICall(url)
-		if err != nil {
-			return err
-		}
-		err = json.NewDecoder(resp.Body).Decode(&obj)
-		defer resp.Body.Close()
-		if err != nil {
-			log.Errorf("%s: reading response. %s", url, err)
-			if i >= s.maxRetries {
-				return err
-			}
-		} else {
-			obj = result
-			break
+	if err := json.Unmarshal(body, obj); err != nil {
+		return fmt.Errorf("%s: reading response: %w", url, err)
+	}
+	if !validators.IsZero() {
+		r := &cachedResponse{URL: url, ETag: validators.ETag, LastModified: validators.LastModified, Body: body}
+		if err := s.cache.store(r); err != nil {
+			log.WithError(err).Warn("API cache")
 		}
 	}
 	return nil
 }
 
-// makeAPICall performs an HTTP call to the given url, returning the response
-func (s *handler) makeAPICall(url string) (*http.Response, error) {
-	client := &http.Client{}
-
-	var resp *http.Response
-	var errorsList []error
-	for i := 1; i <= s.maxRetries; i++ {
-		req, _ := http.NewRequest("GET", url, nil)
-
-		// Auth header must be generate every time (nonce must change)
-		h, err := s.oauth.authorizationHeader(url)
-		if err != nil {
-			panic(err)
-		}
-		headers := []header{
-			{name: "Accept", value: "application/json"},
-			{name: "Authorization", value: h},
+// download the resource (image or video) from the given url to the given destination, checking
+// if a file with the same size (and MD5, if known) exists (and skipping the download in that
+// case, returning false).
+// With snapshots, the file with the same size of the previous snapshot is linked instead.
+// If wantMD5 isn't empty, the content must match it. Failed downloads are retried from scratch
+// according to the retry policy
+func (s *handler) download(ctx context.Context, dest, downloadURL string, fileSize int64, wantMD5 string) (bool, error) {
+	same, err := sameFile(s.store, dest, fileSize, wantMD5)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", dest, err)
+	}
+	if same {
+		log.Debug("File exists with same size:", downloadURL)
+		return false, nil
+	}
+	if s.snapshots != nil {
+		linked, err := s.snapshots.link(dest, fileSize)
+		if err != nil || linked {
+			return false, err
 		}
-		log.Debug(headers)
-		addHeaders(req, headers)
+	}
+	log.Info("Getting ", downloadURL)
 
-		r, err := client.Do(req)
-		if err != nil {
-			log.Debugf("#%d %s: %s\n", i, url, err)
-			errorsList = append(errorsList, err)
-			if i >= s.maxRetries {
-				for _, e := range errorsList {
-					log.Error(e)
-				}
-				return nil, errors.New("too many errors")
-			}
-			// Go on and try again after a little pause
-			time.Sleep(2 * time.Second)
-			continue
-		}
+	err = s.client.Download(ctx, downloadURL, func(body io.Reader) error {
+		return s.save(ctx, dest, body, fileSize, wantMD5)
+	})
+	if err != nil {
+		return false, err
+	}
 
-		if r.StatusCode >= 400 {
-			errorsList = append(errorsList, errors.New(r.Status))
-			if i >= s.maxRetries {
-				for _, e := range errorsList {
-					log.Error(e)
-				}
-				return nil, errors.New("too many errors")
-			}
+	log.Info("Saved ", dest)
+	return true, nil
+}
 
-			if r.StatusCode == 429 {
-				// Header Retry-After tells the number of seconds until the end of the current window
-				log.Error("Got 429 too many requests, let's try to wait 10 seconds...")
-				log.Errorf("Retry-After header: %s\n", r.Header.Get("Retry-After"))
-				time.Sleep(10 * time.Second)
-			}
-			continue
+// save streams the downloaded body to dest, overwriting its content only once complete (see
+// storage.CreateAtomic). The content is hashed while written: if it doesn't match wantMD5, dest is left
+// unchanged and the error is transient, so that the download is restarted. If the versions are
+// kept, the previous content of dest is saved to the versions folder when it's overwritten
+func (s *handler) save(ctx context.Context, dest string, body io.Reader, fileSize int64, wantMD5 string) error {
+	file, err := storage.CreateAtomic(s.store, dest)
+	if err != nil {
+		return err
+	}
+	if m, ok := file.(storage.MD5Setter); ok && wantMD5 != "" {
+		m.SetMD5(wantMD5)
+	}
+	complete := false
+	defer func() {
+		if !complete {
+			file.Abort()
 		}
-		resp = r
-		break
-
+	}()
+
+	// Copy the content to the file, tracking the progress
+	t := s.metrics.startTransfer(dest, fileSize)
+	defer s.metrics.endTransfer(t)
+	hash := md5.New()
+	body = io.TeeReader(s.bandwidth.reader(ctx, body), io.MultiWriter(t, hash))
+	if _, err := io.Copy(file, body); err != nil {
+		return fmt.Errorf("%s: file content copy failed with: %w", dest, err)
 	}
-	return resp, nil
-}
 
-// addHeaders to the provided http request
-func addHeaders(req *http.Request, headers []header) {
-	for _, h := range headers {
-		req.Header.Add(h.name, h.value)
+	if sum := hex.EncodeToString(hash.Sum(nil)); wantMD5 != "" && !strings.EqualFold(sum, wantMD5) {
+		return client.Transient(fmt.Errorf("%s: corrupted download, MD5 is %s instead of %s", dest, sum, wantMD5))
+	}
+	commit := func() error {
+		complete = true
+		return file.Close()
+	}
+	if s.versions != nil {
+		return s.versions.keep(dest, commit)
 	}
+	return commit()
 }
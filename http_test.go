@@ -0,0 +1,334 @@
+package smugmug
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tommyblue/smugmug-backup/client"
+	"github.com/tommyblue/smugmug-backup/storage"
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestDownloadRemovesPartialFile(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write(make([]byte, 100))
+		w.(http.Flusher).Flush()
+		// Interrupt the download while the body is being received
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", newMetrics(), nil, storage.NewLocal(dir), client.WithRetryPolicy(client.RetryPolicy{MaxAttempts: 3}))
+
+	if _, err := h.download(ctx, "video.mp4", srv.URL+"/video.mp4", 1000, ""); err == nil {
+		t.Fatalf("want error")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("cannot read dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("want no files, found %s", entries[0].Name())
+	}
+}
+
+func TestHandlerErrorsDontExit(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", newMetrics(), nil, storage.NewLocal(dir), client.WithRetryPolicy(client.RetryPolicy{MaxAttempts: 3}))
+
+	// The destination can't be checked: its parent is a file
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0o644); err != nil {
+		t.Fatalf("cannot create file: %v", err)
+	}
+	if _, err := h.download(context.Background(), "file/img.jpg", srv.URL+"/img.jpg", 10, ""); err == nil {
+		t.Fatalf("download: want error")
+	}
+
+	var r any
+	if err := h.Get(context.Background(), "/api/v2\x7f", &r); err == nil {
+		t.Fatalf("get: want error")
+	}
+
+	if calls.Load() != 0 {
+		t.Fatalf("calls: want 0, got %d", calls.Load())
+	}
+}
+
+func TestDownloadRetriesTruncatedBody(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	content := []byte("some image content")
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if calls.Add(1) == 1 {
+			w.Write(content[:5])
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	policy := client.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	m := newMetrics()
+	fs := afero.NewMemMapFs()
+	h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", m, nil, storage.NewFs(fs), client.WithRetryPolicy(policy))
+
+	ok, err := h.download(context.Background(), "album/image.jpg", srv.URL+"/image.jpg", int64(len(content)), "")
+	if err != nil || !ok {
+		t.Fatalf("want downloaded, got %v %v", ok, err)
+	}
+
+	got, err := afero.ReadFile(fs, "album/image.jpg")
+	if err != nil {
+		t.Fatalf("cannot read file: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("want %q, got %q", content, got)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("calls: want 2, got %d", calls.Load())
+	}
+	if m.httpRetries.Load() != 1 {
+		t.Fatalf("retries: want 1, got %d", m.httpRetries.Load())
+	}
+}
+
+// atomicStore is a storage creating the files atomically, buffering their content until closed.
+// It records the files created with Create
+type atomicStore struct {
+	storage.Storage
+	created []string
+}
+
+func (s *atomicStore) Create(name string) (io.WriteCloser, error) {
+	s.created = append(s.created, name)
+	return s.Storage.Create(name)
+}
+
+func (s *atomicStore) CreateAtomic(name string) (storage.AtomicWriter, error) {
+	return &atomicBuffer{store: s.Storage, name: name}, nil
+}
+
+type atomicBuffer struct {
+	bytes.Buffer
+	store storage.Storage
+	name  string
+}
+
+func (b *atomicBuffer) Close() error {
+	w, err := b.store.Create(b.name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (b *atomicBuffer) Abort() {}
+
+func TestDownloadChecksMD5(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	content := []byte("some image content")
+	sum := md5.Sum(content)
+	wantMD5 := hex.EncodeToString(sum[:])
+	var calls atomic.Int32
+	corrupted := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(calls.Add(1)) <= corrupted {
+			w.Write([]byte("some image c0ntent"))
+			return
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	policy := client.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	fs := afero.NewMemMapFs()
+	store := &atomicStore{Storage: storage.NewFs(fs)}
+	h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", newMetrics(), nil, store, client.WithRetryPolicy(policy))
+
+	// The corrupted transfer is restarted, the content is streamed to the storage without
+	// temporary files
+	ok, err := h.download(context.Background(), "album/image.jpg", srv.URL+"/image.jpg", int64(len(content)), wantMD5)
+	if err != nil || !ok {
+		t.Fatalf("want downloaded, got %v %v", ok, err)
+	}
+	if got, _ := afero.ReadFile(fs, "album/image.jpg"); string(got) != string(content) {
+		t.Fatalf("want %q, got %q", content, got)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("calls: want 2, got %d", calls.Load())
+	}
+	if len(store.created) != 0 {
+		t.Fatalf("want no temporary files, got %v", store.created)
+	}
+
+	// Always corrupted, the existing file is left unchanged
+	calls.Store(0)
+	corrupted = 3
+	h.store = storage.NewFs(fs)
+	if err := afero.WriteFile(fs, "album/image.jpg", []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.download(context.Background(), "album/image.jpg", srv.URL+"/image.jpg", int64(len(content)), wantMD5); err == nil {
+		t.Fatalf("want error")
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("calls: want 3, got %d", calls.Load())
+	}
+	if got, _ := afero.ReadFile(fs, "album/image.jpg"); string(got) != "old" {
+		t.Fatalf("want the old content, got %q", got)
+	}
+	if _, err := fs.Stat("album/image.jpg" + storage.PartialSuffix); err == nil {
+		t.Fatalf("want the partial file removed")
+	}
+}
+
+// md5Store reports the MD5 of the files, like the S3 storage does with the object metadata
+type md5Store struct {
+	storage.Storage
+	md5s map[string]string
+}
+
+func (s *md5Store) Stat(name string) (storage.FileInfo, error) {
+	fi, err := s.Storage.Stat(name)
+	fi.MD5 = s.md5s[name]
+	return fi, err
+}
+
+func TestDownloadComparesStoredMD5(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	content := []byte("some image content")
+	sum := md5.Sum(content)
+	wantMD5 := hex.EncodeToString(sum[:])
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	// A replaced image with the same size, whose stored MD5 differs
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "album/image.jpg", []byte("some image c0ntent"), 0o644)
+	store := &md5Store{Storage: storage.NewFs(fs), md5s: map[string]string{"album/image.jpg": md5Hex("some image c0ntent")}}
+	h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", newMetrics(), nil, store)
+	ok, err := h.download(context.Background(), "album/image.jpg", srv.URL+"/image.jpg", int64(len(content)), wantMD5)
+	if err != nil || !ok {
+		t.Fatalf("want downloaded, got %v %v", ok, err)
+	}
+	if got, _ := afero.ReadFile(fs, "album/image.jpg"); string(got) != string(content) {
+		t.Fatalf("want %q, got %q", content, got)
+	}
+
+	// The same MD5, in any case, is skipped
+	store.md5s["album/image.jpg"] = strings.ToUpper(wantMD5)
+	ok, err = h.download(context.Background(), "album/image.jpg", srv.URL+"/image.jpg", int64(len(content)), wantMD5)
+	if err != nil || ok {
+		t.Fatalf("want skipped, got %v %v", ok, err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("calls: want 1, got %d", calls.Load())
+	}
+}
+
+func TestHandlerCache(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	etag := `"v1"`
+	var calls, notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"Response":{"User":{"NickName":%q}}}`, etag)
+	}))
+	defer srv.Close()
+
+	m := newMetrics()
+	h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", m, nil, nil)
+	cache, err := newResponseCache(t.TempDir(), "token")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.cache = cache
+
+	get := func() string {
+		t.Helper()
+		u, err := client.NewAPI(h).AuthUser(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return u.NickName
+	}
+
+	// The first response is stored, the second is reused
+	if got := get(); got != `"v1"` {
+		t.Fatalf("want v1, got %s", got)
+	}
+	if got := get(); got != `"v1"` {
+		t.Fatalf("want cached v1, got %s", got)
+	}
+	if notModified.Load() != 1 {
+		t.Fatalf("want 1 not modified response, got %d", notModified.Load())
+	}
+
+	// A changed response replaces the cached one
+	etag = `"v2"`
+	if got := get(); got != `"v2"` {
+		t.Fatalf("want v2, got %s", got)
+	}
+	if got := get(); got != `"v2"` {
+		t.Fatalf("want cached v2, got %s", got)
+	}
+	if calls.Load() != 4 || m.cacheHits.Load() != 2 || m.cacheMisses.Load() != 2 {
+		t.Fatalf("want 4 calls, 2 hits and 2 misses, got %d, %d and %d", calls.Load(), m.cacheHits.Load(), m.cacheMisses.Load())
+	}
+
+	// Other accounts don't share the responses
+	other, _ := newResponseCache(cache.dir, "other token")
+	if r, err := other.load("/api/v2!authuser"); r != nil || err != nil {
+		t.Fatalf("want no cached response, got %+v, %v", r, err)
+	}
+}
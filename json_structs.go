@@ -7,92 +7,25 @@ import (
 	"strings"
 	"text/template"
 	"time"
-)
-
-type currentUser struct {
-	Response struct {
-		User struct {
-			NickName string `json:"NickName"`
-		}
-	}
-}
-
-type user struct {
-	Response struct {
-		User struct {
-			Uris struct {
-				UserAlbums struct {
-					URI string `json:"Uri"`
-				} `json:"UserAlbums"`
-			} `json:"Uris"`
-		} `json:"User"`
-	} `json:"Response"`
-}
-
-type albumsResponse struct {
-	Response struct {
-		URI   string  `json:"Uri"`
-		Album []album `json:"Album"`
-		Pages struct {
-			NextPage string `json:"NextPage"`
-		} `json:"Pages"`
-	} `json:"Response"`
-}
 
-type album struct {
-	URLPath string `json:"UrlPath"`
-	Uris    struct {
-		AlbumImages struct {
-			URI string `json:"Uri"`
-		} `json:"AlbumImages"`
-	} `json:"Uris"`
-}
+	"github.com/tommyblue/smugmug-backup/client"
+)
 
-type albumImagesResponse struct {
-	Response struct {
-		URI        string       `json:"Uri"`
-		AlbumImage []albumImage `json:"AlbumImage"`
-		Pages      struct {
-			NextPage string `json:"NextPage"`
-		} `json:"Pages"`
-	} `json:"Response"`
-}
+// albumImage is an image or a video of an album, with the details used by the backup
+type albumImage struct {
+	client.AlbumImage
+	AlbumPath string // From the URLPath of the album
 
-type imageMetadataResponse struct {
-	Response struct {
-		DateTimeCreated  time.Time `json:"DateTimeCreated"`
-		DateTimeModified time.Time `json:"DateTimeModified"`
-	} `json:"Response"`
+	builtFilename string               // The final filename, after template replacements
+	largestVideo  *client.LargestVideo // From the response expansions, if found
+	created       time.Time            // Creation time from the metadata in the response expansions, if found
 }
 
-type albumImage struct {
-	AlbumPath        string // From album.URLPath
-	FileName         string `json:"FileName"`
-	ImageKey         string `json:"ImageKey"` // Use as unique ID if FileName is empty
-	ArchivedMD5      string `json:"ArchivedMD5"`
-	ArchivedSize     int64  `json:"ArchivedSize"`
-	ArchivedUri      string `json:"ArchivedUri"`
-	IsVideo          bool   `json:"IsVideo"`
-	Processing       bool   `json:"Processing"`
-	UploadKey        string `json:"UploadKey"`
-	DateTimeOriginal string `json:"DateTimeOriginal"`
-	Caption          string `json:"Caption"`
-	DateTimeUploaded string `json:"DateTimeUploaded"`
-	Keywords         string `json:"Keywords"`
-	Latitude         string `json:"Latitude"`
-	Longitude        string `json:"Longitude"`
-	Status           string `json:"Status"`
-	SubStatus        string `json:"SubStatus"`
-	Uris             struct {
-		ImageMetadata struct {
-			Uri string `json:"Uri"`
-		} `json:"ImageMetadata"`
-		LargestVideo struct {
-			Uri string `json:"Uri"`
-		} `json:"LargestVideo"`
-	} `json:"Uris"`
-
-	builtFilename string // The final filename, after template replacements
+// albumImageFields are the fields of albumImage requested to SmugMug
+var albumImageFields = []string{
+	"FileName", "ImageKey", "ArchivedMD5", "ArchivedSize", "ArchivedUri", "IsVideo", "Processing",
+	"UploadKey", "DateTimeOriginal", "Caption", "DateTimeUploaded", "Keywords", "Latitude",
+	"Longitude", "Status", "SubStatus",
 }
 
 func (a *albumImage) buildFilename(tmpl *template.Template) error {
@@ -137,11 +70,14 @@ func (a *albumImage) Name() string {
 	return a.ImageKey
 }
 
-type albumVideo struct {
-	Response struct {
-		LargestVideo struct {
-			Size int64  `json:"Size"`
-			Url  string `json:"Url"`
-		} `json:"LargestVideo"`
-	} `json:"Response"`
+// downloadSize returns the size of the file downloaded for the image or video: the largest
+// version of the videos, 0 if not known yet
+func (a *albumImage) downloadSize() int64 {
+	if !a.IsVideo {
+		return a.ArchivedSize
+	}
+	if a.largestVideo != nil {
+		return a.largestVideo.Size
+	}
+	return 0
 }
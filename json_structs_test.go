@@ -3,6 +3,8 @@ package smugmug
 import (
 	"testing"
 	"text/template"
+
+	"github.com/tommyblue/smugmug-backup/client"
 )
 
 func Test_albumImage_buildFilename(t *testing.T) {
@@ -112,13 +114,13 @@ func Test_albumImage_buildFilename(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			a := &albumImage{
+			a := &albumImage{AlbumImage: client.AlbumImage{
 				FileName:         tt.fields.FileName,
 				ImageKey:         tt.fields.ImageKey,
 				ArchivedMD5:      tt.fields.ArchivedMD5,
 				UploadKey:        tt.fields.UploadKey,
 				DateTimeOriginal: tt.fields.DateTimeOriginal,
-			}
+			}}
 
 			tmpl, err := template.New("image_filename").Option("missingkey=error").Parse(tt.filenameConf)
 			if err != nil {
@@ -136,3 +138,27 @@ func Test_albumImage_buildFilename(t *testing.T) {
 		})
 	}
 }
+
+func Test_albumImage_downloadSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		image albumImage
+		want  int64
+	}{
+		{name: "image", image: albumImage{AlbumImage: client.AlbumImage{ArchivedSize: 100}}, want: 100},
+		{
+			name: "video",
+			image: albumImage{
+				AlbumImage:   client.AlbumImage{ArchivedSize: 100, IsVideo: true},
+				largestVideo: &client.LargestVideo{Size: 300},
+			},
+			want: 300,
+		},
+		{name: "video not expanded", image: albumImage{AlbumImage: client.AlbumImage{ArchivedSize: 100, IsVideo: true}}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := tt.image.downloadSize(); got != tt.want {
+			t.Errorf("%s: want %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
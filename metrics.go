@@ -0,0 +1,231 @@
+package smugmug
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lastSuccessMetric is the name of the metric with the timestamp of the last backup completed
+// without errors
+const lastSuccessMetric = "smugmug_backup_last_success_timestamp_seconds"
+
+// metrics collects the counters and gauges describing the backup progress and health.
+// They are exposed in the Prometheus text format by Worker.MetricsHandler while the backup runs,
+// and written to a file by Worker.WriteMetrics once it ends
+type metrics struct {
+	albumsTotal     atomic.Int64
+	albumsProcessed atomic.Int64
+	itemsDownloaded atomic.Int64
+	itemsSkipped    atomic.Int64
+	itemsFailed     atomic.Int64
+	itemsAborted    atomic.Int64 // downloads not started or interrupted because of a stop
+	bytesDownloaded atomic.Int64
+	httpRetries     atomic.Int64
+	httpThrottled   atomic.Int64
+	cacheHits       atomic.Int64 // API responses not modified, taken from the cache
+	cacheMisses     atomic.Int64 // API responses received while the cache is enabled
+	albumsQueue     atomic.Int64
+	downloadsQueue  atomic.Int64
+	lastSuccess     atomic.Int64 // unix timestamp of the last backup completed without errors
+	bytesQueued     atomic.Int64 // sum of the sizes of the items sent to the downloaders
+	bytesHandled    atomic.Int64 // sum of the sizes of the items downloaded, skipped or failed
+
+	statusLock sync.Mutex
+	httpStatus map[int]int64
+
+	transfersLock sync.Mutex
+	transfers     map[*transfer]struct{}
+}
+
+// transfer tracks a download in progress
+type transfer struct {
+	name    string
+	size    int64
+	started time.Time
+	written atomic.Int64
+	m       *metrics
+}
+
+// Write counts the bytes written to the destination file
+func (t *transfer) Write(p []byte) (int, error) {
+	t.written.Add(int64(len(p)))
+	t.m.bytesDownloaded.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		httpStatus: make(map[int]int64),
+		transfers:  make(map[*transfer]struct{}),
+	}
+}
+
+// startTransfer registers a new download in progress. The returned transfer must be used as
+// writer (e.g. with io.TeeReader) to count the downloaded bytes and must be passed to endTransfer
+// when the download ends
+func (m *metrics) startTransfer(name string, size int64) *transfer {
+	t := &transfer{name: name, size: size, started: time.Now(), m: m}
+	m.transfersLock.Lock()
+	defer m.transfersLock.Unlock()
+	m.transfers[t] = struct{}{}
+	return t
+}
+
+func (m *metrics) endTransfer(t *transfer) {
+	m.transfersLock.Lock()
+	defer m.transfersLock.Unlock()
+	delete(m.transfers, t)
+}
+
+// Response counts a response received with the given status code. Together with Retry and
+// RateLimited, it makes metrics a client.Observer
+func (m *metrics) Response(code int) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.httpStatus[code]++
+}
+
+// Retry counts a retried HTTP call
+func (m *metrics) Retry(error) {
+	m.httpRetries.Add(1)
+}
+
+// RateLimited counts an HTTP call rate limited by SmugMug
+func (m *metrics) RateLimited(time.Duration) {
+	m.httpThrottled.Add(1)
+}
+
+// downloadResult counts the result of a call to downloadFn
+func (m *metrics) downloadResult(downloaded bool, err error) {
+	switch {
+	case err != nil:
+		m.itemsFailed.Add(1)
+	case downloaded:
+		m.itemsDownloaded.Add(1)
+	default:
+		m.itemsSkipped.Add(1)
+	}
+}
+
+func (m *metrics) backupCompleted(t time.Time) {
+	m.lastSuccess.Store(t.Unix())
+}
+
+// ServeHTTP writes the metrics using the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *metrics) write(w io.Writer) {
+	writeMetric(w, "smugmug_backup_albums_total", "gauge", "Number of albums found in the account.", m.albumsTotal.Load())
+	writeMetric(w, "smugmug_backup_albums_processed_total", "counter", "Number of albums analyzed.", m.albumsProcessed.Load())
+
+	writeHeader(w, "smugmug_backup_items_total", "counter", "Number of images and videos handled, by result.")
+	fmt.Fprintf(w, "smugmug_backup_items_total{result=\"downloaded\"} %d\n", m.itemsDownloaded.Load())
+	fmt.Fprintf(w, "smugmug_backup_items_total{result=\"skipped\"} %d\n", m.itemsSkipped.Load())
+	fmt.Fprintf(w, "smugmug_backup_items_total{result=\"failed\"} %d\n", m.itemsFailed.Load())
+	fmt.Fprintf(w, "smugmug_backup_items_total{result=\"aborted\"} %d\n", m.itemsAborted.Load())
+
+	writeMetric(w, "smugmug_backup_downloaded_bytes_total", "counter", "Number of bytes downloaded.", m.bytesDownloaded.Load())
+
+	writeHeader(w, "smugmug_backup_http_responses_total", "counter", "Number of HTTP responses, by status code.")
+	m.statusLock.Lock()
+	codes := make([]int, 0, len(m.httpStatus))
+	for code := range m.httpStatus {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "smugmug_backup_http_responses_total{code=\"%d\"} %d\n", code, m.httpStatus[code])
+	}
+	m.statusLock.Unlock()
+
+	writeMetric(w, "smugmug_backup_http_retries_total", "counter", "Number of retried HTTP calls.", m.httpRetries.Load())
+	writeMetric(w, "smugmug_backup_http_throttled_total", "counter", "Number of HTTP calls rate limited by SmugMug (status 429).", m.httpThrottled.Load())
+
+	writeHeader(w, "smugmug_backup_api_cache_total", "counter", "Number of API calls with the response cache enabled, by result.")
+	fmt.Fprintf(w, "smugmug_backup_api_cache_total{result=\"hit\"} %d\n", m.cacheHits.Load())
+	fmt.Fprintf(w, "smugmug_backup_api_cache_total{result=\"miss\"} %d\n", m.cacheMisses.Load())
+
+	writeHeader(w, "smugmug_backup_queue_depth", "gauge", "Number of items waiting to be picked up by a worker, by queue.")
+	fmt.Fprintf(w, "smugmug_backup_queue_depth{queue=\"albums\"} %d\n", m.albumsQueue.Load())
+	fmt.Fprintf(w, "smugmug_backup_queue_depth{queue=\"downloads\"} %d\n", m.downloadsQueue.Load())
+
+	writeMetric(w, lastSuccessMetric, "gauge", "Unix timestamp of the last backup completed without errors.", m.lastSuccess.Load())
+}
+
+// writeFile writes the metrics to the named file, replacing it atomically, e.g. for the textfile
+// collector of the Prometheus node exporter. If no backup has completed, the timestamp of the last
+// success is kept from the previous file
+func (m *metrics) writeFile(name string) error {
+	if m.lastSuccess.Load() == 0 {
+		last, err := readLastSuccess(name)
+		if err != nil {
+			return err
+		}
+		m.lastSuccess.CompareAndSwap(0, last)
+	}
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// CreateTemp creates files readable only by the owner, the exporter may run as another user
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// readLastSuccess returns the timestamp of the last success in the named metrics file, 0 if the
+// file or the metric are missing
+func readLastSuccess(name string) (int64, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), lastSuccessMetric+" "); ok {
+			return strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return 0, scanner.Err()
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	writeHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
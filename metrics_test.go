@@ -0,0 +1,90 @@
+package smugmug
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	m := newMetrics()
+	m.albumsTotal.Store(3)
+	m.albumsProcessed.Add(2)
+	m.downloadResult(true, nil)
+	m.downloadResult(true, nil)
+	m.downloadResult(false, nil)
+	m.downloadResult(false, errors.New("boom"))
+	m.bytesDownloaded.Add(1024)
+	m.Response(200)
+	m.Response(200)
+	m.Response(429)
+	m.RateLimited(time.Second)
+	m.Retry(errors.New("boom"))
+	m.downloadsQueue.Add(4)
+	m.backupCompleted(time.Unix(1700000000, 0))
+
+	rec := httptest.NewRecorder()
+	(&Worker{metrics: m}).MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type: want text/plain, got %s", ct)
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"smugmug_backup_albums_total 3\n",
+		"smugmug_backup_albums_processed_total 2\n",
+		`smugmug_backup_items_total{result="downloaded"} 2` + "\n",
+		`smugmug_backup_items_total{result="skipped"} 1` + "\n",
+		`smugmug_backup_items_total{result="failed"} 1` + "\n",
+		"smugmug_backup_downloaded_bytes_total 1024\n",
+		`smugmug_backup_http_responses_total{code="200"} 2` + "\n",
+		`smugmug_backup_http_responses_total{code="429"} 1` + "\n",
+		"smugmug_backup_http_retries_total 1\n",
+		"smugmug_backup_http_throttled_total 1\n",
+		`smugmug_backup_queue_depth{queue="albums"} 0` + "\n",
+		`smugmug_backup_queue_depth{queue="downloads"} 4` + "\n",
+		"smugmug_backup_last_success_timestamp_seconds 1700000000\n",
+		"# TYPE smugmug_backup_items_total counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "smugmug_backup.prom")
+
+	m := newMetrics()
+	m.backupCompleted(time.Unix(1700000000, 0))
+	if err := (&Worker{metrics: m}).WriteMetrics(name); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A failed backup keeps the timestamp of the last success
+	m = newMetrics()
+	m.downloadResult(false, errors.New("boom"))
+	if err := (&Worker{metrics: m}).WriteMetrics(name); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"smugmug_backup_last_success_timestamp_seconds 1700000000\n",
+		`smugmug_backup_items_total{result="failed"} 1` + "\n",
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("missing %q in:\n%s", want, content)
+		}
+	}
+	if fi, _ := os.Stat(name); fi.Mode().Perm() != 0o644 {
+		t.Fatalf("want mode 0644, got %s", fi.Mode())
+	}
+}
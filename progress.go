@@ -0,0 +1,117 @@
+package smugmug
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Progress is a snapshot of the backup progress, as returned by Worker.Progress
+type Progress struct {
+	AlbumsTotal     int64              // Number of albums found in the account
+	AlbumsDone      int64              // Number of albums analyzed
+	ItemsDownloaded int64              // Number of images and videos downloaded
+	ItemsSkipped    int64              // Number of images and videos skipped because already existing
+	ItemsFailed     int64              // Number of images and videos that failed
+	BytesQueued     int64              // Size of the images and videos found so far (of the largest versions of the videos, once known)
+	BytesHandled    int64              // Size of the images and videos already downloaded, skipped or failed
+	BytesDownloaded int64              // Number of bytes actually downloaded
+	Downloads       []DownloadProgress // Downloads in progress, ordered by start time
+}
+
+// DownloadProgress describes a download in progress
+type DownloadProgress struct {
+	Name    string    // Destination file
+	Size    int64     // Expected size of the file, can be 0 if unknown
+	Written int64     // Bytes downloaded so far
+	Started time.Time // Start time of the download
+}
+
+// BytesRemaining returns the number of bytes still to be handled among the known images and
+// videos, considering also the bytes of the downloads in progress
+func (p Progress) BytesRemaining() int64 {
+	remaining := p.BytesQueued - p.BytesHandled
+	for _, d := range p.Downloads {
+		remaining -= min(d.Written, d.Size)
+	}
+	return max(remaining, 0)
+}
+
+// Progress returns a snapshot of the backup progress. It is safe to call it while the backup
+// is running, e.g. to display a progress bar
+func (w *Worker) Progress() Progress {
+	m := w.metrics
+	p := Progress{
+		AlbumsTotal:     m.albumsTotal.Load(),
+		AlbumsDone:      m.albumsProcessed.Load(),
+		ItemsDownloaded: m.itemsDownloaded.Load(),
+		ItemsSkipped:    m.itemsSkipped.Load(),
+		ItemsFailed:     m.itemsFailed.Load(),
+		BytesQueued:     m.bytesQueued.Load(),
+		BytesHandled:    m.bytesHandled.Load(),
+		BytesDownloaded: m.bytesDownloaded.Load(),
+	}
+
+	m.transfersLock.Lock()
+	for t := range m.transfers {
+		p.Downloads = append(p.Downloads, DownloadProgress{
+			Name:    t.name,
+			Size:    t.size,
+			Written: t.written.Load(),
+			Started: t.started,
+		})
+	}
+	m.transfersLock.Unlock()
+
+	sort.Slice(p.Downloads, func(i, j int) bool {
+		return p.Downloads[i].Started.Before(p.Downloads[j].Started)
+	})
+	return p
+}
+
+// Summary reports the outcome of a backup, as returned by Worker.Summary
+type Summary struct {
+	AlbumsTotal int64 // Number of albums found in the account
+	AlbumsDone  int64 // Number of albums completely analyzed
+	Downloaded  int64 // Number of images and videos downloaded
+	Skipped     int64 // Number of images and videos skipped because already existing
+	Failed      int64 // Number of images and videos that failed
+	Aborted     int64 // Number of downloads not started or interrupted because of a stop
+	Errors      int64 // Number of albums that couldn't be analyzed because of errors
+	CacheHits   int64 // Number of API responses taken from the cache because not modified
+	CacheMisses int64 // Number of API responses received while the cache is enabled
+}
+
+// AlbumsLeft returns the number of albums not analyzed because of a stop
+func (s Summary) AlbumsLeft() int64 {
+	return max(s.AlbumsTotal-s.AlbumsDone, 0)
+}
+
+func (s Summary) String() string {
+	msg := fmt.Sprintf("%d/%d albums analyzed (%d errors), %d files downloaded, %d skipped, %d failed",
+		s.AlbumsDone, s.AlbumsTotal, s.Errors, s.Downloaded, s.Skipped, s.Failed)
+	if s.AlbumsLeft() > 0 || s.Aborted > 0 {
+		msg += fmt.Sprintf(". Left undone: %d albums and %d downloads", s.AlbumsLeft(), s.Aborted)
+	}
+	if s.CacheHits > 0 || s.CacheMisses > 0 {
+		msg += fmt.Sprintf(". API cache: %d hits, %d misses", s.CacheHits, s.CacheMisses)
+	}
+	return msg
+}
+
+// Summary returns the outcome of the backup. When called after a stop, it reports what was
+// left undone
+func (w *Worker) Summary() Summary {
+	m := w.metrics
+	return Summary{
+		AlbumsTotal: m.albumsTotal.Load(),
+		AlbumsDone:  m.albumsProcessed.Load(),
+		Downloaded:  m.itemsDownloaded.Load(),
+		Skipped:     m.itemsSkipped.Load(),
+		Failed:      m.itemsFailed.Load(),
+		Aborted:     m.itemsAborted.Load(),
+		Errors:      w.errors.Load(),
+		CacheHits:   m.cacheHits.Load(),
+		CacheMisses: m.cacheMisses.Load(),
+	}
+}
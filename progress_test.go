@@ -0,0 +1,46 @@
+package smugmug
+
+import (
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	m := newMetrics()
+	w := &Worker{metrics: m}
+
+	m.albumsTotal.Store(2)
+	m.albumsProcessed.Add(1)
+	m.bytesQueued.Add(1000)
+	m.bytesHandled.Add(300)
+	m.downloadResult(false, nil)
+
+	first := m.startTransfer("/dest/album/first.jpg", 200)
+	first.Write(make([]byte, 50))
+	second := m.startTransfer("/dest/album/second.mp4", 400)
+	second.Write(make([]byte, 100))
+
+	p := w.Progress()
+	if p.AlbumsTotal != 2 || p.AlbumsDone != 1 {
+		t.Fatalf("albums: want 1/2, got %d/%d", p.AlbumsDone, p.AlbumsTotal)
+	}
+	if p.ItemsSkipped != 1 {
+		t.Fatalf("skipped: want 1, got %d", p.ItemsSkipped)
+	}
+	if len(p.Downloads) != 2 {
+		t.Fatalf("downloads: want 2, got %d", len(p.Downloads))
+	}
+	if p.Downloads[0].Name != "/dest/album/first.jpg" || p.Downloads[0].Written != 50 {
+		t.Fatalf("unexpected first download %+v", p.Downloads[0])
+	}
+	if p.BytesDownloaded != 150 {
+		t.Fatalf("downloaded bytes: want 150, got %d", p.BytesDownloaded)
+	}
+	if r := p.BytesRemaining(); r != 550 {
+		t.Fatalf("remaining bytes: want 550, got %d", r)
+	}
+
+	m.endTransfer(first)
+	if p := w.Progress(); len(p.Downloads) != 1 {
+		t.Fatalf("downloads: want 1, got %d", len(p.Downloads))
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"os"
 	"testing"
 
+	"github.com/spf13/afero"
 	"github.com/tommyblue/smugmug-backup"
+	"github.com/tommyblue/smugmug-backup/storage"
 )
 
 func TestNew(t *testing.T) {
@@ -98,6 +100,19 @@ func TestNew(t *testing.T) {
 		},
 	}
 
+	t.Run("custom storage", func(t *testing.T) {
+		_, err := smugmug.New(&smugmug.Conf{
+			ApiKey:     "value",
+			ApiSecret:  "value",
+			UserToken:  "value",
+			UserSecret: "value",
+			Storage:    storage.NewFs(afero.NewMemMapFs()),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			_, err := smugmug.New(&smugmug.Conf{
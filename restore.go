@@ -0,0 +1,155 @@
+package smugmug
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
+)
+
+// Restore copies the files of the backup destination to the dir folder of the local filesystem,
+// decrypting them if the backup is encrypted. The SmugMug credentials aren't needed.
+//
+// The files already restored, with the same size, are skipped. The content of the files is
+// verified with the MD5 of the manifests of the encrypted backups, or with the one known by the
+// storage (e.g. from the indexes of the archives), and their modification times are restored.
+// With snapshots, the last snapshot is restored
+func Restore(ctx context.Context, cfg *Conf, dir string) error {
+	if err := cfg.validateEncryption(); err != nil {
+		return err
+	}
+	if cfg.Storage == nil && cfg.Destination == "" {
+		return errors.New("destination can't be empty")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create the restore folder: %w", err)
+	}
+	src, err := cfg.openStorage()
+	if err != nil {
+		return err
+	}
+	if cfg.Snapshots {
+		if src, err = lastSnapshot(src); err != nil {
+			return err
+		}
+	}
+
+	r := &restorer{src: src, dst: storage.NewLocal(dir)}
+	if enc, ok := src.(*storage.Encrypted); ok {
+		if r.manifest, err = enc.Manifest(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.restoreFolder(ctx, ""); err != nil {
+		return err
+	}
+	log.Infof("Restored %d files, %d already restored", r.restored, r.skipped)
+	if r.errors > 0 {
+		return fmt.Errorf("restore completed with %d errors, please check logs", r.errors)
+	}
+	return nil
+}
+
+// restorer copies the files of the src storage to the dst one
+type restorer struct {
+	src      storage.Storage
+	dst      storage.Storage
+	manifest map[string]storage.ManifestEntry // Files of the encrypted backups, by name
+
+	restored int
+	skipped  int
+	errors   int
+}
+
+func (r *restorer) restoreFolder(ctx context.Context, folder string) error {
+	files, err := r.src.List(folder)
+	if err != nil {
+		return fmt.Errorf("cannot list %s: %w", folder, err)
+	}
+	if err := r.dst.MkdirAll(folder); err != nil {
+		return fmt.Errorf("cannot create the folder %s: %w", folder, err)
+	}
+	for _, fi := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := path.Join(folder, fi.Name)
+		switch {
+		case fi.IsDir && name == storage.MetaFolder:
+		case fi.IsDir:
+			if err := r.restoreFolder(ctx, name); err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, storage.PartialSuffix):
+			// Left by an interrupted backup
+		default:
+			if err := r.restoreFile(name, fi); err != nil {
+				log.WithError(err).Errorf("cannot restore %s", name)
+				r.errors++
+			}
+		}
+	}
+	return nil
+}
+
+func (r *restorer) restoreFile(name string, fi storage.FileInfo) error {
+	// The MD5 is known from the manifests of the encrypted backups, or from the storage
+	mtime, wantMD5 := fi.ModTime, fi.MD5
+	if entry, ok := r.manifest[name]; ok {
+		wantMD5 = entry.MD5
+		if !entry.ModTime.IsZero() {
+			mtime = entry.ModTime
+		}
+	}
+
+	restored, err := r.dst.Stat(name)
+	if err == nil && restored.Size == fi.Size {
+		log.Debugf("%s already restored", name)
+		r.skipped++
+		return nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	in, err := r.src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := storage.CreateAtomic(r.dst, name)
+	if err != nil {
+		return err
+	}
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		out.Abort()
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); wantMD5 != "" && !strings.EqualFold(sum, wantMD5) {
+		out.Abort()
+		return fmt.Errorf("corrupted file, MD5 is %s instead of %s", sum, wantMD5)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		if err := r.dst.Chtimes(name, time.Now(), mtime); err != nil {
+			return err
+		}
+	}
+	log.Infof("%s restored", name)
+	r.restored++
+	return nil
+}
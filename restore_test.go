@@ -0,0 +1,103 @@
+package smugmug
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tommyblue/smugmug-backup/crypt"
+	"github.com/tommyblue/smugmug-backup/storage"
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestRestore(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	fs := afero.NewMemMapFs()
+	// Cheap key parameters, to keep the test fast
+	params := &crypt.KeyParams{Salt: []byte("0123456789abcdef"), N: 1 << 10, R: 8, P: 1}
+	if _, err := crypt.NewPassphrase("secret", params); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyParams(storage.NewFs(fs), params); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Conf{Storage: storage.NewFs(fs), EncryptPassphrase: "secret", EncryptNames: true}
+	store, err := cfg.openStorage()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.MkdirAll("album")
+	w, err := storage.CreateAtomic(store, "album/img.jpg")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	io.WriteString(w, "image")
+	w.Close()
+	store.Chtimes("album/img.jpg", time.Now(), mtime)
+	if err := store.(storage.Flusher).Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if _, err := fs.Stat("album"); err == nil {
+		t.Fatalf("want encrypted folder names")
+	}
+
+	dir := t.TempDir()
+	if err := Restore(context.Background(), cfg, dir); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	file := filepath.Join(dir, "album", "img.jpg")
+	got, err := os.ReadFile(file)
+	if err != nil || string(got) != "image" {
+		t.Fatalf("restored %q, %v", got, err)
+	}
+	if fi, _ := os.Stat(file); !fi.ModTime().Equal(mtime) {
+		t.Fatalf("want mtime %s, got %s", mtime, fi.ModTime())
+	}
+	if _, err := os.Stat(filepath.Join(dir, storage.MetaFolder)); err == nil {
+		t.Fatalf("want metadata folder not restored")
+	}
+
+	// The restored files are skipped
+	os.WriteFile(file, []byte("IMAGE"), 0644)
+	if err := Restore(context.Background(), cfg, dir); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got, _ := os.ReadFile(file); string(got) != "IMAGE" {
+		t.Fatalf("want file skipped, got %q", got)
+	}
+
+	cfg.EncryptPassphrase = "wrong"
+	if err := Restore(context.Background(), cfg, dir); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Fatalf("want wrong passphrase error, got %v", err)
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Conf
+		wantErr bool
+	}{
+		{name: "no encryption", cfg: Conf{}},
+		{name: "passphrase", cfg: Conf{EncryptPassphrase: "secret", EncryptNames: true}},
+		{name: "age", cfg: Conf{EncryptRecipients: []string{"age1..."}}},
+		{name: "passphrase and age", cfg: Conf{EncryptPassphrase: "secret", EncryptRecipients: []string{"age1..."}}, wantErr: true},
+		{name: "csv", cfg: Conf{EncryptPassphrase: "secret", WriteCSV: true}, wantErr: true},
+		{name: "names without encryption", cfg: Conf{EncryptNames: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validateEncryption(); (err != nil) != tt.wantErr {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
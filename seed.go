@@ -0,0 +1,272 @@
+package smugmug
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
+)
+
+// library is a local tree of files, e.g. the originals uploaded to SmugMug. The files are hashed
+// only when an image or video with the same size is looked for
+type library struct {
+	bySize map[int64][]string // Paths of the files, by size
+	md5s   map[string]string  // MD5 of the hashed files, by path
+}
+
+// scanLibrary returns the regular files of the root folder and of its subfolders
+func scanLibrary(ctx context.Context, root string) (*library, int, error) {
+	lib := &library{bySize: make(map[int64][]string), md5s: make(map[string]string)}
+	var count int
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Size() > 0 {
+			lib.bySize[fi.Size()] = append(lib.bySize[fi.Size()], name)
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot scan %s: %w", root, err)
+	}
+	return lib, count, nil
+}
+
+// find returns the path of a file with the given size and MD5, or an empty string if not found
+func (l *library) find(size int64, wantMD5 string) string {
+	for _, name := range l.bySize[size] {
+		sum, ok := l.md5s[name]
+		if !ok {
+			var err error
+			if sum, err = fileMD5(name); err != nil {
+				log.WithError(err).Warnf("cannot hash %s", name)
+			}
+			l.md5s[name] = sum
+		}
+		if sum != "" && strings.EqualFold(sum, wantMD5) {
+			return name
+		}
+	}
+	return ""
+}
+
+// fileMD5 returns the hex MD5 of the content of the named local file
+func fileMD5(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// seeder saves the files of a library to the backup
+type seeder struct {
+	lib      *library
+	linkRoot string // Local folder of the backup where the files are linked, empty if copied
+	seeded   int
+	present  int
+	missing  int
+}
+
+// Seed saves the files of the from local folder (e.g. a library with the originals uploaded to
+// SmugMug) to the backup, so that the following backups download only the missing images and
+// videos. The files are matched by size and MD5 and saved with the names and in the folders of
+// the backup. With link, they're hard links to the files of the folder instead of copies: the
+// destination must be a local folder on the same filesystem
+func (w *Worker) Seed(ctx context.Context, from string, link bool) error {
+	s := &seeder{}
+	if link {
+		var err error
+		if s.linkRoot, err = w.localRoot(); err != nil {
+			return err
+		}
+	}
+
+	lib, count, err := scanLibrary(ctx, from)
+	if err != nil {
+		return err
+	}
+	s.lib = lib
+	log.Infof("Found %d files in %s", count, from)
+
+	if w.cfg.username, err = w.currentUser(ctx); err != nil {
+		return fmt.Errorf("error checking credentials: %w", err)
+	}
+	for album, err := range w.userAlbums(ctx) {
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("error getting user albums: %w", err)
+		}
+		folder := strings.TrimPrefix(album.URLPath, "/")
+		for image, err := range w.albumImages(ctx, album.Uris.AlbumImages.URI, album.URLPath) {
+			if err != nil {
+				if ctx.Err() == nil {
+					log.WithError(err).Errorf("cannot get album images for %s", album.Uris.AlbumImages.URI)
+					w.errors.Add(1)
+				}
+				break
+			}
+			if err := w.seedItem(ctx, s, image, folder); err != nil {
+				log.WithError(err).Errorf("cannot seed %s/%s", folder, image.Name())
+				w.errors.Add(1)
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	w.flushStorage()
+	log.Infof("Seeded %d files, %d already in the backup, %d to download", s.seeded, s.present, s.missing)
+
+	if errs := w.errors.Load(); errs > 0 {
+		return fmt.Errorf("seed completed with %d errors, please check logs", errs)
+	}
+	return ctx.Err()
+}
+
+// localRoot returns the local folder where the files are saved, if the destination is a local
+// folder whose files are saved as they are
+func (w *Worker) localRoot() (string, error) {
+	cfg := w.cfg
+	if cfg.Storage != nil || isRemoteDestination(cfg.Destination) || cfg.encrypted() || cfg.Archive != "" {
+		return "", errors.New("the files can be linked only to a local destination, without archives or encryption")
+	}
+	root := cfg.Destination
+	if w.snapshots != nil {
+		root = filepath.Join(root, filepath.FromSlash(w.snapshots.current))
+	}
+	return root, nil
+}
+
+// seedItem saves the image or video to the folder, if found in the library and missing
+func (w *Worker) seedItem(ctx context.Context, s *seeder, image albumImage, folder string) error {
+	if image.Name() == "" || image.IsVideo && image.Processing {
+		return nil
+	}
+	size, wantMD5 := image.ArchivedSize, image.ArchivedMD5
+	if image.IsVideo {
+		video, err := w.largestVideo(ctx, image)
+		if err != nil {
+			return err
+		}
+		size, wantMD5 = video.Size, video.MD5
+	}
+	if wantMD5 == "" {
+		s.missing++
+		return nil
+	}
+
+	dest := fmt.Sprintf("%s/%s", folder, image.Name())
+	same, err := sameFile(w.store, dest, size, wantMD5)
+	if err != nil {
+		return err
+	}
+	if same {
+		s.present++
+		return nil
+	}
+	src := s.lib.find(size, wantMD5)
+	if src == "" {
+		s.missing++
+		return nil
+	}
+
+	if err := w.store.MkdirAll(folder); err != nil {
+		return err
+	}
+	if s.linkRoot != "" {
+		err = linkLocal(src, filepath.Join(s.linkRoot, filepath.FromSlash(dest)))
+	} else {
+		err = w.copyLocal(ctx, src, dest, wantMD5, image)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("%s seeded from %s", dest, src)
+	s.seeded++
+	return nil
+}
+
+// linkLocal replaces the dest local file with a hard link to src
+func linkLocal(src, dest string) error {
+	partial := dest + storage.PartialSuffix
+	if err := os.Remove(partial); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(src, partial); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, dest); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return nil
+}
+
+// copyLocal copies the src local file to dest, checking that its content still matches wantMD5.
+// The modification time is the one of src or, if configured, the one of the image metadata
+func (w *Worker) copyLocal(ctx context.Context, src, dest, wantMD5 string, image albumImage) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := storage.CreateAtomic(w.store, dest)
+	if err != nil {
+		return err
+	}
+	if m, ok := out.(storage.MD5Setter); ok {
+		m.SetMD5(wantMD5)
+	}
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		out.Abort()
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, wantMD5) {
+		out.Abort()
+		return fmt.Errorf("%s changed while seeding, MD5 is %s instead of %s", src, sum, wantMD5)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if w.cfg.UseMetadataTimes {
+		return w.setChTime(ctx, image, dest)
+	}
+	return w.store.Chtimes(dest, time.Now(), fi.ModTime())
+}
@@ -0,0 +1,102 @@
+package smugmug
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/tommyblue/smugmug-backup/client"
+	"github.com/tommyblue/smugmug-backup/storage"
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+// seedAccountHandler mocks an account with an album of the given images
+type seedAccountHandler struct {
+	images []client.AlbumImage
+}
+
+func (m *seedAccountHandler) Get(_ context.Context, url string, obj any, _ ...client.RequestOption) error {
+	switch url {
+	case "/api/v2!authuser":
+		return respond(obj, map[string]any{"User": client.User{NickName: testUsername}})
+	case "/api/v2/user/" + testUsername:
+		var u client.User
+		u.Uris.UserAlbums.URI = userAlbumsURI
+		return respond(obj, map[string]any{"User": u})
+	case userAlbumsURI:
+		a := client.Album{URLPath: "/2024/holidays"}
+		a.Uris.AlbumImages.URI = "/album/1/images"
+		return respond(obj, map[string]any{"Album": []client.Album{a}})
+	default:
+		return respond(obj, map[string]any{"AlbumImage": m.images})
+	}
+}
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSeed(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	lib := t.TempDir()
+	os.MkdirAll(filepath.Join(lib, "2024", "summer"), 0o755)
+	os.WriteFile(filepath.Join(lib, "2024", "summer", "IMG_0001.jpg"), []byte("first"), 0o644)
+	os.WriteFile(filepath.Join(lib, "2024", "other.jpg"), []byte("other"), 0o644)
+
+	images := []client.AlbumImage{
+		{FileName: "a.jpg", ArchivedMD5: md5Hex("first"), ArchivedSize: 5},
+		{FileName: "b.jpg", ArchivedMD5: md5Hex("missing"), ArchivedSize: 7},
+		// Same size of the files of the library, different content
+		{FileName: "c.jpg", ArchivedMD5: md5Hex("third"), ArchivedSize: 5},
+		{FileName: "d.jpg", ArchivedMD5: md5Hex("other"), ArchivedSize: 5},
+	}
+
+	t.Run("copy", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, "2024/holidays/d.jpg", []byte("other"), 0o644)
+		w := newTestWorker(t, nil)
+		w.req = &seedAccountHandler{images: images}
+		w.store = storage.NewFs(fs)
+		if err := w.Seed(context.Background(), lib, false); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if content, _ := afero.ReadFile(fs, "2024/holidays/a.jpg"); string(content) != "first" {
+			t.Fatalf("want a.jpg seeded, got %q", content)
+		}
+		for _, name := range []string{"b.jpg", "c.jpg"} {
+			if exists, _ := afero.Exists(fs, "2024/holidays/"+name); exists {
+				t.Fatalf("want %s missing", name)
+			}
+		}
+	})
+
+	t.Run("link", func(t *testing.T) {
+		dest := t.TempDir()
+		w := newTestWorker(t, nil)
+		w.req = &seedAccountHandler{images: images}
+		w.store = storage.NewLocal(dest)
+		w.cfg.Destination = dest
+		if err := w.Seed(context.Background(), lib, true); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		src, _ := os.Stat(filepath.Join(lib, "2024", "summer", "IMG_0001.jpg"))
+		seeded, err := os.Stat(filepath.Join(dest, "2024", "holidays", "a.jpg"))
+		if err != nil || !os.SameFile(src, seeded) {
+			t.Fatalf("want a.jpg linked, got %v", err)
+		}
+
+		// Remote destinations can't be linked
+		w.cfg.Destination = "s3://bucket/backup"
+		if err := w.Seed(context.Background(), lib, true); err == nil {
+			t.Fatalf("want error")
+		}
+	})
+}
@@ -1,33 +1,91 @@
 package smugmug
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/tommyblue/smugmug-backup/client"
+	"github.com/tommyblue/smugmug-backup/storage"
 )
 
 // Conf is the configuration of the smugmug worker
 type Conf struct {
-	ApiKey              string // API key
-	ApiSecret           string // API secret
-	UserToken           string // User token
-	UserSecret          string // User secret
-	Destination         string // Backup destination folder
-	Filenames           string // Template for files naming
-	UseMetadataTimes    bool   // When true, the last update timestamp will be retrieved from metadata
-	ForceMetadataTimes  bool   // When true, then the last update timestamp is always retrieved and overwritten, also for existing files
-	WriteCSV            bool   // When true, a CSV file including downloaded files metadata is written
-	ForceVideoDownload  bool   // When true, download videos also if marked as under processing
-	ConcurrentDownloads int    // number of concurrent downloads of images and videos, default is 1
-	ConcurrentAlbums    int    // number of concurrent albums analyzed via API calls
-	HTTPBaseUrl         string // Smugmug API URL, defaults to https://api.smugmug.com
-	HTTPMaxRetries      int    // Max number of retries for HTTP calls, defaults to 3
+	ApiKey              string        // API key
+	ApiSecret           string        // API secret
+	UserToken           string        // User token
+	UserSecret          string        // User secret
+	Destination         string        // Backup destination folder, "s3://bucket/prefix" or "sftp://user@host/path"
+	Filenames           string        // Template for files naming
+	UseMetadataTimes    bool          // When true, the last update timestamp will be retrieved from metadata
+	ForceMetadataTimes  bool          // When true, then the last update timestamp is always retrieved and overwritten, also for existing files
+	WriteCSV            bool          // When true, a CSV file including downloaded files metadata is written
+	ForceVideoDownload  bool          // When true, download videos also if marked as under processing
+	Archive             string        // Format of the per-album archives, "tar" or "zip". If empty, the files are saved as they are
+	ArchiveTempDir      string        // Local folder staging the files before they are added to the archives, defaults to the system one
+	Dedup               string        // How the images and videos found in several albums are saved after the first: "hardlink", "symlink" or "reflink". If empty, they're downloaded again
+	KeepVersions        bool          // When true, the replaced images and videos are moved to the .versions folder
+	VersionsKeepLast    int           // Max number of previous versions kept for each file, 0 means no limit
+	VersionsKeepDays    int           // Days the previous versions are kept, 0 means no limit
+	Snapshots           bool          // When true, each backup is saved in a dated snapshot, linking the unchanged files to the previous one
+	SnapshotsDaily      int           // Number of daily snapshots kept. If all the counts are 0, all the snapshots are kept
+	SnapshotsWeekly     int           // Number of weekly snapshots kept
+	SnapshotsMonthly    int           // Number of monthly snapshots kept
+	ConcurrentDownloads int           // number of concurrent downloads of images and videos, default is 1
+	ConcurrentAlbums    int           // number of concurrent albums analyzed via API calls
+	HTTPBaseUrl         string        // Smugmug API URL, defaults to https://api.smugmug.com
+	HTTPMaxRetries      int           // Max number of attempts for HTTP calls failing with transient errors, defaults to 3
+	HTTPRetryBaseDelay  time.Duration // Delay before the first retry, doubled at each retry. Defaults to 1s
+	HTTPRetryMaxDelay   time.Duration // Max delay between retries, defaults to 30s
+	HTTPRetryJitter     float64       // Random variation of the retry delay, as fraction of it. Defaults to 0.2 (±20%)
+	HTTPDialTimeout     time.Duration // Max time to establish a connection, defaults to 10s. 0 means no limit
+	HTTPTLSTimeout      time.Duration // Max time of the TLS handshake, defaults to 10s. 0 means no limit
+	HTTPHeaderTimeout   time.Duration // Max time waiting for the response headers, defaults to 30s. 0 means no limit
+	HTTPIdleTimeout     time.Duration // Time an idle connection is kept open for reuse, defaults to 90s. 0 means no limit
+	HTTPStallTimeout    time.Duration // Max time without receiving data, then the transfer is retried. Defaults to 1m. 0 disables it
+	HTTPPageSize        int           // Number of albums or images requested per page, if 0 the SmugMug default is used
+	HTTPExpansions      bool          // When true, the album images responses inline the largest videos and metadata, saving API calls
+	HTTPCacheDir        string        // Folder caching the API responses, reused when not modified. If empty, the responses aren't cached
+	HTTPProxy           string        // Proxy URL (http, https or socks5), if empty the proxy is set by the environment variables
+	HTTPCAFiles         []string      // PEM files with additional CAs to trust, e.g. the CA of a proxy intercepting TLS
+	HTTPClientCert      string        // PEM file of the TLS client certificate, if required by the proxy
+	HTTPClientKey       string        // PEM file of the key of the TLS client certificate
+	S3Endpoint          string        // Endpoint of the S3 compatible service, defaults to s3.amazonaws.com
+	S3Region            string        // Region of the bucket, if empty it's detected
+	S3AccessKey         string        // S3 access key, if empty the credentials are read from the environment
+	S3SecretKey         string        // S3 secret key
+	S3Insecure          bool          // When true, the S3 endpoint is called with HTTP instead of HTTPS
+	S3PartSize          int64         // Size of the parts of the multipart uploads, defaults to 16MB
+	SFTPKeyFile         string        // Private key used to log in to the SFTP server, if empty the SSH agent and the keys of ~/.ssh are used
+	SFTPKeyPassphrase   string        // Passphrase of the private key, if protected
+	SFTPKnownHosts      string        // known_hosts file verifying the SFTP server, defaults to ~/.ssh/known_hosts
+	EncryptPassphrase   string        // Passphrase encrypting the files with AES-256-GCM. If empty, the age recipients are used
+	EncryptRecipients   []string      // age recipients (public keys) the files are encrypted to
+	EncryptIdentity     string        // age identities file decrypting the files, its recipients are added to EncryptRecipients
+	EncryptNames        bool          // When true, the names of the files and folders are encrypted too
+	BandwidthLimit      int64         // Download bandwidth limit in bytes per second, shared by all downloads. 0 means unlimited
+	ShutdownGrace       time.Duration // Time given to the downloads in progress to complete after a graceful stop. 0 means no limit
+
+	// Time of day windows overriding BandwidthLimit, e.g. to limit the bandwidth during working hours
+	BandwidthSchedule []BandwidthWindow
+
+	// HTTPClient, if set, is used for the API calls and downloads instead of the client built
+	// from the HTTP* timeouts, e.g. to customize the transport when embedding the package
+	HTTPClient *http.Client
+
+	// Storage, if set, is the destination of the backup instead of the Destination folder of the
+	// local filesystem, e.g. to back up to other targets when embedding the package
+	Storage storage.Storage
 
 	username     string
 	metadataFile string
@@ -59,6 +117,10 @@ func (cfg *Conf) overrideEnvConf() {
 	if os.Getenv("SMGMG_BK_FILE_NAMES") != "" {
 		cfg.Filenames = os.Getenv("SMGMG_BK_FILE_NAMES")
 	}
+
+	if os.Getenv("SMGMG_BK_ENCRYPTION_PASSPHRASE") != "" {
+		cfg.EncryptPassphrase = os.Getenv("SMGMG_BK_ENCRYPTION_PASSPHRASE")
+	}
 }
 
 func (cfg *Conf) validate() error {
@@ -78,10 +140,38 @@ func (cfg *Conf) validate() error {
 		return errors.New("UserSecret can't be empty")
 	}
 
+	if err := cfg.validateEncryption(); err != nil {
+		return err
+	}
+
+	if cfg.Archive != "" && cfg.Archive != string(storage.Tar) && cfg.Archive != string(storage.Zip) {
+		return fmt.Errorf("invalid store.archive %q, it must be tar or zip", cfg.Archive)
+	}
+
+	if cfg.VersionsKeepLast < 0 || cfg.VersionsKeepDays < 0 {
+		return errors.New("versions.keep_last and versions.keep_days can't be negative")
+	}
+
+	if err := cfg.validateSnapshots(); err != nil {
+		return err
+	}
+
+	if err := cfg.validateDedup(); err != nil {
+		return err
+	}
+
+	if cfg.Storage != nil {
+		return nil
+	}
+
 	if cfg.Destination == "" {
 		return errors.New("destination can't be empty")
 	}
 
+	if isRemoteDestination(cfg.Destination) {
+		return nil
+	}
+
 	// Check exising and writeability of destination folder
 	if err := checkDestFolder(cfg.Destination); err != nil {
 		return fmt.Errorf("can't find in the destination folder %s: %v", cfg.Destination, err)
@@ -90,6 +180,35 @@ func (cfg *Conf) validate() error {
 	return nil
 }
 
+// transportConfig returns the configuration of the HTTP transport used by the API calls and the
+// downloads
+func (cfg *Conf) transportConfig() (client.TransportConfig, error) {
+	tc := client.TransportConfig{
+		DialTimeout:           cfg.HTTPDialTimeout,
+		TLSHandshakeTimeout:   cfg.HTTPTLSTimeout,
+		ResponseHeaderTimeout: cfg.HTTPHeaderTimeout,
+		IdleConnTimeout:       cfg.HTTPIdleTimeout,
+	}
+
+	if cfg.HTTPProxy != "" {
+		proxy, err := client.ParseProxyURL(cfg.HTTPProxy)
+		if err != nil {
+			return tc, fmt.Errorf("http.proxy: %w", err)
+		}
+		tc.Proxy = proxy
+	}
+
+	if len(cfg.HTTPCAFiles) > 0 || cfg.HTTPClientCert != "" || cfg.HTTPClientKey != "" {
+		tlsConfig, err := client.LoadTLSConfig(cfg.HTTPCAFiles, cfg.HTTPClientCert, cfg.HTTPClientKey)
+		if err != nil {
+			return tc, fmt.Errorf("http TLS configuration: %w", err)
+		}
+		tc.TLSConfig = tlsConfig
+	}
+
+	return tc, nil
+}
+
 // ReadConf produces a configuration object for the Smugmug worker.
 //
 // It reads the configuration from ./config.toml or "$HOME/.smgmg/config.toml"
@@ -105,9 +224,24 @@ func ReadConf(cfgPath string) (*Conf, error) {
 	// defaults
 	viper.SetDefault("http.base_url", "https://api.smugmug.com")
 	viper.SetDefault("http.max_retries", 3)
+	viper.SetDefault("http.retry_base_delay", "1s")
+	viper.SetDefault("http.retry_max_delay", "30s")
+	viper.SetDefault("http.retry_jitter", 0.2)
+	viper.SetDefault("http.dial_timeout", "10s")
+	viper.SetDefault("http.tls_timeout", "10s")
+	viper.SetDefault("http.header_timeout", "30s")
+	viper.SetDefault("http.idle_timeout", "90s")
+	viper.SetDefault("http.stall_timeout", "1m")
+	viper.SetDefault("http.page_size", 100)
+	viper.SetDefault("http.expansions", true)
+	if dir, err := os.UserCacheDir(); err == nil {
+		viper.SetDefault("http.cache_dir", filepath.Join(dir, "smugmug-backup"))
+	}
 	viper.SetDefault("store.file_names", "{{.FileName}}")
 	viper.SetDefault("store.concurrent_downloads", 1)
 	viper.SetDefault("store.concurrent_albums", 1)
+	viper.SetDefault("store.shutdown_grace", "1m")
+	viper.SetDefault("s3.part_size", "16MB")
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
@@ -132,10 +266,64 @@ func ReadConf(cfgPath string) (*Conf, error) {
 		ForceMetadataTimes:  viper.GetBool("store.force_metadata_times"),
 		WriteCSV:            viper.GetBool("store.write_csv"),
 		ForceVideoDownload:  viper.GetBool("store.force_video_download"),
+		Archive:             viper.GetString("store.archive"),
+		ArchiveTempDir:      viper.GetString("store.archive_temp_dir"),
+		Dedup:               viper.GetString("store.dedup"),
+		KeepVersions:        viper.GetBool("versions.keep"),
+		VersionsKeepLast:    viper.GetInt("versions.keep_last"),
+		VersionsKeepDays:    viper.GetInt("versions.keep_days"),
+		Snapshots:           viper.GetBool("snapshots.enabled"),
+		SnapshotsDaily:      viper.GetInt("snapshots.keep_daily"),
+		SnapshotsWeekly:     viper.GetInt("snapshots.keep_weekly"),
+		SnapshotsMonthly:    viper.GetInt("snapshots.keep_monthly"),
 		ConcurrentDownloads: viper.GetInt("store.concurrent_downloads"),
 		ConcurrentAlbums:    viper.GetInt("store.concurrent_albums"),
+		ShutdownGrace:       viper.GetDuration("store.shutdown_grace"),
 		HTTPBaseUrl:         viper.GetString("http.base_url"),
 		HTTPMaxRetries:      viper.GetInt("http.max_retries"),
+		HTTPRetryBaseDelay:  viper.GetDuration("http.retry_base_delay"),
+		HTTPRetryMaxDelay:   viper.GetDuration("http.retry_max_delay"),
+		HTTPRetryJitter:     viper.GetFloat64("http.retry_jitter"),
+		HTTPDialTimeout:     viper.GetDuration("http.dial_timeout"),
+		HTTPTLSTimeout:      viper.GetDuration("http.tls_timeout"),
+		HTTPHeaderTimeout:   viper.GetDuration("http.header_timeout"),
+		HTTPIdleTimeout:     viper.GetDuration("http.idle_timeout"),
+		HTTPStallTimeout:    viper.GetDuration("http.stall_timeout"),
+		HTTPPageSize:        viper.GetInt("http.page_size"),
+		HTTPExpansions:      viper.GetBool("http.expansions"),
+		HTTPCacheDir:        viper.GetString("http.cache_dir"),
+		HTTPProxy:           viper.GetString("http.proxy"),
+		HTTPCAFiles:         viper.GetStringSlice("http.ca_files"),
+		HTTPClientCert:      viper.GetString("http.client_cert"),
+		HTTPClientKey:       viper.GetString("http.client_key"),
+		S3Endpoint:          viper.GetString("s3.endpoint"),
+		S3Region:            viper.GetString("s3.region"),
+		S3AccessKey:         viper.GetString("s3.access_key"),
+		S3SecretKey:         viper.GetString("s3.secret_key"),
+		S3Insecure:          viper.GetBool("s3.insecure"),
+		SFTPKeyFile:         viper.GetString("sftp.key_file"),
+		SFTPKeyPassphrase:   viper.GetString("sftp.key_passphrase"),
+		SFTPKnownHosts:      viper.GetString("sftp.known_hosts"),
+		EncryptPassphrase:   viper.GetString("encryption.passphrase"),
+		EncryptRecipients:   viper.GetStringSlice("encryption.recipients"),
+		EncryptIdentity:     viper.GetString("encryption.identity_file"),
+		EncryptNames:        viper.GetBool("encryption.encrypt_names"),
+	}
+
+	var err error
+	cfg.BandwidthLimit, err = parseByteSize(viper.GetString("bandwidth.limit"))
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth.limit: %v", err)
+	}
+
+	cfg.S3PartSize, err = parseByteSize(viper.GetString("s3.part_size"))
+	if err != nil {
+		return nil, fmt.Errorf("s3.part_size: %v", err)
+	}
+
+	cfg.BandwidthSchedule, err = readBandwidthSchedule()
+	if err != nil {
+		return nil, fmt.Errorf("bandwidth.schedule: %v", err)
 	}
 
 	cfg.overrideEnvConf()
@@ -147,6 +335,36 @@ func ReadConf(cfgPath string) (*Conf, error) {
 	return cfg, nil
 }
 
+// readBandwidthSchedule reads the [[bandwidth.schedule]] configuration tables
+func readBandwidthSchedule() ([]BandwidthWindow, error) {
+	var raw []struct {
+		From  string
+		To    string
+		Limit string
+	}
+	if err := viper.UnmarshalKey("bandwidth.schedule", &raw); err != nil {
+		return nil, err
+	}
+
+	var schedule []BandwidthWindow
+	for _, r := range raw {
+		from, err := parseTimeOfDay(r.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseTimeOfDay(r.To)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := parseByteSize(r.Limit)
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, BandwidthWindow{From: from, To: to, Limit: limit})
+	}
+	return schedule, nil
+}
+
 type FileMetadata struct {
 	FileName    string
 	ArchivedUri string
@@ -157,24 +375,32 @@ type FileMetadata struct {
 type downloadInfo struct {
 	image  albumImage
 	folder string
+	album  *albumProgress // nil if the completion of the album isn't tracked
 }
 
 // Worker actually implements the backup logic
 type Worker struct {
-	req              requestsHandler
+	req              client.Getter
 	cfg              *Conf
-	errors           int
-	downloadFn       func(string, string, int64) (bool, error) // defined in struct for better testing
+	errors           atomic.Int64
+	downloadFn       func(context.Context, string, string, int64, string) (bool, error) // defined in struct for better testing
 	filenameTmpl     *template.Template
 	downloadsCh      chan *downloadInfo
 	downloadsWorkers int
 	downloadWg       sync.WaitGroup
 	stopCh           chan struct{}
-	quitting         bool
-	albumCh          chan album
+	stopOnce         sync.Once
+	abortCh          chan struct{}
+	abortOnce        sync.Once
+	albumCh          chan client.Album
 	albumsWorkers    int
 	albumWg          sync.WaitGroup
 	csvLock          sync.Mutex
+	metrics          *metrics
+	store            storage.Storage
+	versions         *versionKeeper // nil if the replaced files aren't kept
+	snapshots        *snapshots     // nil if the backup isn't saved in snapshots
+	dedup            *dedup         // nil if the duplicated files are downloaded again
 }
 
 // New return a SmugMug backup configuration. It returns an error if it fails parsing
@@ -184,7 +410,64 @@ func New(cfg *Conf) (*Worker, error) {
 		return nil, err
 	}
 
-	handler := newHTTPHandler(cfg.HTTPBaseUrl, cfg.HTTPMaxRetries, cfg.ApiKey, cfg.ApiSecret, cfg.UserToken, cfg.UserSecret)
+	m := newMetrics()
+	bw := newBandwidthLimiter(cfg.BandwidthLimit, cfg.BandwidthSchedule)
+	// Each album worker and downloader makes a single call at a time
+	concurrency := cfg.ConcurrentAlbums + cfg.ConcurrentDownloads
+	opts := []client.Option{
+		client.WithRetryPolicy(client.RetryPolicy{
+			MaxAttempts: cfg.HTTPMaxRetries,
+			BaseDelay:   cfg.HTTPRetryBaseDelay,
+			MaxDelay:    cfg.HTTPRetryMaxDelay,
+			Jitter:      cfg.HTTPRetryJitter,
+		}),
+		client.WithStallTimeout(cfg.HTTPStallTimeout),
+	}
+	if cfg.HTTPClient != nil {
+		opts = append(opts, client.WithHTTPClient(cfg.HTTPClient))
+	} else {
+		transport, err := cfg.transportConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, client.WithTransportConfig(transport))
+	}
+	store, err := cfg.openStorage()
+	if err != nil {
+		return nil, err
+	}
+	var snaps *snapshots
+	if cfg.Snapshots {
+		snaps, err = newSnapshots(store, time.Now(), cfg.SnapshotsDaily, cfg.SnapshotsWeekly, cfg.SnapshotsMonthly)
+		if err != nil {
+			return nil, err
+		}
+		store = snaps.store()
+	}
+	handler := newHTTPHandler(cfg.HTTPBaseUrl, concurrency, cfg.ApiKey, cfg.ApiSecret, cfg.UserToken, cfg.UserSecret, m, bw, store, opts...)
+	handler.snapshots = snaps
+	if cfg.HTTPCacheDir != "" {
+		// The responses depend on the account and on the API
+		cache, err := newResponseCache(cfg.HTTPCacheDir, cfg.UserToken+"@"+cfg.HTTPBaseUrl)
+		if err != nil {
+			return nil, err
+		}
+		handler.cache = cache
+	}
+	var dd *dedup
+	if cfg.Dedup != "" {
+		if dd, err = newDedup(store, cfg.Dedup); err != nil {
+			return nil, err
+		}
+	}
+	var versions *versionKeeper
+	if cfg.KeepVersions {
+		versions = newVersionKeeper(store, cfg.VersionsKeepLast, cfg.VersionsKeepDays)
+		handler.versions = versions
+		if dd != nil {
+			dd.versions = versions
+		}
+	}
 
 	tmpl, err := buildFilenameTemplate(cfg.Filenames)
 	if err != nil {
@@ -192,8 +475,10 @@ func New(cfg *Conf) (*Worker, error) {
 	}
 
 	if cfg.WriteCSV {
-		cfg.metadataFile = filepath.Join(cfg.Destination, METADATA_FNAME)
-		createMetadataCSV(cfg.metadataFile)
+		cfg.metadataFile = METADATA_FNAME
+		if err := createMetadataCSV(store, cfg.metadataFile); err != nil {
+			return nil, err
+		}
 	}
 
 	return &Worker{
@@ -205,17 +490,38 @@ func New(cfg *Conf) (*Worker, error) {
 		downloadsWorkers: cfg.ConcurrentDownloads,
 		downloadWg:       sync.WaitGroup{},
 		stopCh:           make(chan struct{}),
-		albumCh:          make(chan album),
+		abortCh:          make(chan struct{}),
+		albumCh:          make(chan client.Album),
 		albumsWorkers:    cfg.ConcurrentAlbums,
 		albumWg:          sync.WaitGroup{},
+		metrics:          m,
+		store:            store,
+		versions:         versions,
+		snapshots:        snaps,
+		dedup:            dd,
 	}, nil
 }
 
-func (w *Worker) albumWorker(id int) {
+// MetricsHandler returns an http.Handler exposing the backup metrics in the Prometheus
+// text format, to be mounted on a /metrics endpoint. The metrics are live: they can be scraped
+// only while the process runs, see WriteMetrics to keep them after the backup
+func (w *Worker) MetricsHandler() http.Handler {
+	return w.metrics
+}
+
+// WriteMetrics writes the backup metrics in the Prometheus text format to the named file, e.g.
+// in the folder of the textfile collector of the node exporter, so that they can be scraped
+// after the end of the backup. If the backup didn't complete, the timestamp of the last success
+// is kept from the previous file
+func (w *Worker) WriteMetrics(name string) error {
+	return w.metrics.writeFile(name)
+}
+
+func (w *Worker) albumWorker(ctx context.Context, id int) {
 	log.Debugf("Running albumWorker %d", id)
 	for {
 		select {
-		case <-w.stopCh:
+		case <-ctx.Done():
 			log.Debugf("Stopping albumWorker %d", id)
 			return
 		case album, ok := <-w.albumCh:
@@ -224,37 +530,82 @@ func (w *Worker) albumWorker(id int) {
 				log.Debugf("Quitting albumWorker %d", id)
 				return
 			}
-			folder := filepath.Join(w.cfg.Destination, album.URLPath)
+			w.metrics.albumsQueue.Add(-1)
+			folder := strings.TrimPrefix(album.URLPath, "/")
 
-			if err := createFolder(folder); err != nil {
-				log.WithError(err).Errorf("cannot create the destination folder %s", folder)
-				w.errors++
-				continue
+			if w.processAlbum(ctx, album, folder) == albumDone {
+				w.metrics.albumsProcessed.Add(1)
 			}
+		}
+	}
+}
+
+// albumResult is the outcome of the processing of an album
+type albumResult int
 
-			log.Debugf("[ALBUM IMAGES] %s", album.Uris.AlbumImages.URI)
-			images, err := w.albumImages(album.Uris.AlbumImages.URI, album.URLPath)
-			if err != nil {
-				log.WithError(err).Errorf("cannot get album images for %s", album.Uris.AlbumImages.URI)
-				w.errors++
-				continue
+const (
+	albumDone        albumResult = iota // All the images have been sent to the downloaders
+	albumFailed                         // The folder or the list of images couldn't be created or read
+	albumInterrupted                    // Interrupted by the cancellation of the context
+)
+
+// processAlbum creates the album folder, removing the partial downloads left by a previous run,
+// and sends all the album images to the downloaders
+func (w *Worker) processAlbum(ctx context.Context, album client.Album, folder string) albumResult {
+	if err := createFolder(w.store, folder); err != nil {
+		log.WithError(err).Errorf("cannot create the destination folder %s", folder)
+		w.errors.Add(1)
+		return albumFailed
+	}
+	removePartials(w.store, folder)
+
+	log.Debugf("[ALBUM IMAGES] %s", album.Uris.AlbumImages.URI)
+	progress := newAlbumProgress(folder)
+	defer w.itemDone(progress)
+
+	// The images are sent to the downloaders as soon as each page is received, while their
+	// metadata is written to the CSV file in batches
+	var csvImages []albumImage
+	defer func() {
+		if len(csvImages) > 0 {
+			w.writeToCSV(csvImages, folder)
+		}
+	}()
+
+	for image, err := range w.albumImages(ctx, album.Uris.AlbumImages.URI, album.URLPath) {
+		if err != nil {
+			if ctx.Err() != nil {
+				return albumInterrupted
 			}
+			// The images of the previous pages have already been sent to the downloaders
+			log.WithError(err).Errorf("cannot get album images for %s", album.Uris.AlbumImages.URI)
+			w.errors.Add(1)
+			return albumFailed
+		}
 
-			log.Debugf("Got album images for %s", album.Uris.AlbumImages.URI)
-			// log.Debugf("%+v", images)
-			w.saveImages(images, folder)
-			if w.cfg.WriteCSV {
-				w.writeToCSV(images, folder)
+		if !w.queueImage(ctx, image, progress) {
+			return albumInterrupted
+		}
+		if w.cfg.WriteCSV {
+			csvImages = append(csvImages, image)
+			if len(csvImages) >= csvBatchSize {
+				w.writeToCSV(csvImages, folder)
+				csvImages = csvImages[:0]
 			}
 		}
 	}
+
+	log.Debugf("Got album images for %s", album.Uris.AlbumImages.URI)
+	return albumDone
 }
 
-func (w *Worker) downloader(id int) {
+// downloader picks the images and videos to download until ctx is cancelled. The downloads are
+// performed with dlCtx, so that a download in progress is completed after a graceful stop
+func (w *Worker) downloader(ctx, dlCtx context.Context, id int) {
 	log.Debugf("Running downloader %d", id)
 	for {
 		select {
-		case <-w.stopCh:
+		case <-ctx.Done():
 			log.Debugf("Stopping downloader %d", id)
 			return
 		case info, ok := <-w.downloadsCh:
@@ -262,18 +613,40 @@ func (w *Worker) downloader(id int) {
 				log.Debugf("Quitting downloader %d", id)
 				return
 			}
+			w.metrics.downloadsQueue.Add(-1)
+			w.handleDownload(ctx, dlCtx, info)
+		}
+	}
+}
 
-			if info.image.IsVideo {
-				if err := w.saveVideo(info.image, info.folder); err != nil {
-					log.Warnf("Error: %v", err)
-				}
-				continue
-			}
+// handleDownload saves the image or video, unless ctx has been cancelled
+func (w *Worker) handleDownload(ctx, dlCtx context.Context, info *downloadInfo) {
+	defer w.itemDone(info.album)
+	if ctx.Err() != nil {
+		// Received while stopping, leave it undone
+		w.metrics.itemsAborted.Add(1)
+		return
+	}
 
-			if err := w.saveImage(info.image, info.folder); err != nil {
-				log.Warnf("Error: %v", err)
-			}
-		}
+	var downloaded bool
+	var err error
+	if info.image.IsVideo {
+		downloaded, err = w.saveVideo(dlCtx, info.image, info.folder)
+	} else {
+		downloaded, err = w.saveImage(dlCtx, info.image, info.folder)
+	}
+	if err == nil && w.cfg.Archive != "" {
+		err = w.saveSidecar(info.image, info.folder)
+	}
+	if err != nil && dlCtx.Err() != nil {
+		// Interrupted by the abort, not a failure
+		w.metrics.itemsAborted.Add(1)
+		return
+	}
+	w.metrics.downloadResult(downloaded, err)
+	w.metrics.bytesHandled.Add(info.image.downloadSize())
+	if err != nil {
+		log.Warnf("Error: %v", err)
 	}
 }
 
@@ -299,18 +672,41 @@ func buildFilenameTemplate(filenameTemplate string) (*template.Template, error)
 //   - iterate over all images and videos
 //   - if existing and with the same size, then skip
 //   - if not, download
-func (w *Worker) Run() error {
+//
+// Cancelling the context (or calling Stop) gracefully stops the backup: no new album or download
+// is started, while the downloads in progress can complete within the configured grace period.
+// Calling Abort, or the end of the grace period, interrupts them, removing the partial files.
+// Run returns the context error once all workers have quit.
+func (w *Worker) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// The downloads in progress aren't interrupted by the cancellation of ctx, but by an abort
+	dlCtx, abort := context.WithCancel(context.WithoutCancel(ctx))
+	defer abort()
+	go w.abortOnShutdown(ctx, dlCtx, abort)
+
 	var err error
-	w.cfg.username, err = w.currentUser()
+	w.cfg.username, err = w.currentUser(ctx)
 	if err != nil {
-		return fmt.Errorf("error checking credentials: %v", err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("error checking credentials: %w", err)
 	}
 
 	w.albumWg.Add(w.albumsWorkers)
 	for i := 0; i < w.albumsWorkers; i++ {
 		go func(i int) {
 			defer w.albumWg.Done()
-			w.albumWorker(i)
+			w.albumWorker(ctx, i)
 		}(i)
 	}
 
@@ -318,47 +714,114 @@ func (w *Worker) Run() error {
 	for i := 0; i < w.downloadsWorkers; i++ {
 		go func(i int) {
 			defer w.downloadWg.Done()
-			w.downloader(i)
+			w.downloader(ctx, dlCtx, i)
 		}(i)
 	}
 
-	// Get user albums
+	// Get user albums, sending them to the album workers as soon as each page is received
 	log.Infof("Getting albums for user %s...\n", w.cfg.username)
-	albums, err := w.userAlbums()
-	if err != nil {
-		return fmt.Errorf("error getting user albums: %v", err)
-	}
-
-	log.Infof("Found %d albums\n", len(albums))
-
-	for _, album := range albums {
-		if w.quitting {
+	var found int
+sendAlbums:
+	for album, err := range w.userAlbums(ctx) {
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if found == 0 {
+				w.Wait()
+				return fmt.Errorf("error getting user albums: %w", err)
+			}
+			// The albums of the previous pages are backed up anyway
+			log.WithError(err).Errorf("cannot get all the albums, %d found", found)
+			w.errors.Add(1)
 			break
 		}
-		w.albumCh <- album
+
+		found++
+		w.metrics.albumsQueue.Add(1)
+		select {
+		case w.albumCh <- album:
+		case <-ctx.Done():
+			w.metrics.albumsQueue.Add(-1)
+			break sendAlbums
+		}
 	}
+	log.Infof("Found %d albums\n", found)
 
 	w.Wait()
+	if ctx.Err() == nil {
+		w.pruneVersions()
+		w.completeSnapshot()
+	}
+	w.flushStorage()
+	log.Info(w.Summary())
 
-	if w.errors > 0 {
-		return fmt.Errorf("completed with %d errors, please check logs", w.errors)
+	if errs := w.errors.Load(); errs > 0 {
+		return fmt.Errorf("completed with %d errors, please check logs", errs)
 	}
 
-	if w.quitting {
+	if ctx.Err() != nil {
 		log.Info("Quit worker!")
-		return nil
+		return ctx.Err()
 	}
 
+	w.metrics.backupCompleted(time.Now())
 	log.Info("Backup completed.")
 	return nil
 }
 
+// Stop gracefully stops a running backup. It's the same as cancelling the context passed to Run
 func (w *Worker) Stop() {
-	log.Info("Quitting worker...")
-	close(w.stopCh)
-	w.quitting = true
+	w.stopOnce.Do(func() {
+		log.Info("Quitting worker...")
+		close(w.stopCh)
+	})
+}
+
+// Abort immediately interrupts a running backup, including the downloads in progress. The
+// partially downloaded files are removed
+func (w *Worker) Abort() {
+	w.Stop()
+	w.abortOnce.Do(func() {
+		log.Info("Aborting downloads in progress...")
+		close(w.abortCh)
+	})
+}
+
+// abortOnShutdown calls abort when Abort is called or when the grace period expires after the
+// cancellation of ctx. It returns when dlCtx is done
+func (w *Worker) abortOnShutdown(ctx, dlCtx context.Context, abort context.CancelFunc) {
+	select {
+	case <-w.abortCh:
+		abort()
+		return
+	case <-dlCtx.Done():
+		return
+	case <-ctx.Done():
+	}
+
+	var expired <-chan time.Time
+	if w.cfg.ShutdownGrace > 0 {
+		log.Infof("Waiting up to %s for the downloads in progress to complete", w.cfg.ShutdownGrace)
+		timer := time.NewTimer(w.cfg.ShutdownGrace)
+		defer timer.Stop()
+		expired = timer.C
+	} else {
+		log.Info("Waiting for the downloads in progress to complete")
+	}
+
+	select {
+	case <-w.abortCh:
+		abort()
+	case <-expired:
+		log.Warn("Grace period expired, aborting downloads in progress")
+		abort()
+	case <-dlCtx.Done():
+	}
 }
 
+// Wait waits for all workers to quit. The album workers, the only ones sending to the
+// downloads channel, must be done before closing it
 func (w *Worker) Wait() {
 	close(w.albumCh)
 	log.Debug("waiting albumWg...")
@@ -1,15 +1,25 @@
 package smugmug
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/spf13/afero"
 	"github.com/spf13/viper"
+	"github.com/tommyblue/smugmug-backup/client"
+	"github.com/tommyblue/smugmug-backup/storage"
 	"github.com/tommyblue/smugmug-backup/testutil"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 const testUsername = "test_username"
@@ -25,47 +35,43 @@ type mockHandler struct {
 	albumImagesURI string
 }
 
-func (m *mockHandler) get(url string, obj interface{}) error {
+// respond decodes on obj an API response with the given content, like the client does
+func respond(obj any, response any) error {
+	data, err := json.Marshal(map[string]any{"Response": response})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, obj)
+}
+
+func (m *mockHandler) Get(_ context.Context, url string, obj any, _ ...client.RequestOption) error {
 	switch url {
 	case "/api/v2!authuser":
-		var u *currentUser
-		u = obj.(*currentUser)
-		u.Response.User.NickName = m.username
-		return nil
+		return respond(obj, map[string]any{"User": client.User{NickName: m.username}})
 	// from w.userAlbumsURI()
 	case fmt.Sprintf("/api/v2/user/%s", testUsername):
-		var u *user
-		u = obj.(*user)
-		u.Response.User.Uris.UserAlbums.URI = m.userAlbumsURI
-		obj = u
-		return nil
+		var u client.User
+		u.Uris.UserAlbums.URI = m.userAlbumsURI
+		return respond(obj, map[string]any{"User": u})
 	// from w.albums()
 	case m.userAlbumsURI:
-		albumObj := album{}
+		albumObj := client.Album{}
 		albumObj.URLPath = m.albumURLPath
 		albumObj.Uris.AlbumImages.URI = m.albumImagesURI
-		albumObjs := []album{albumObj}
-		// albumObjs = append(albumObjs, albumObj)
-		var a *albumsResponse
-		a = obj.(*albumsResponse)
-		a.Response.Album = albumObjs
+		return respond(obj, map[string]any{"Album": []client.Album{albumObj}})
 	// from w.albumImages()
 	case m.albumImagesURI:
-		img1 := albumImage{}
+		img1 := client.AlbumImage{}
 		img1.IsVideo = false
 		img1.FileName = fileName
 		img1.ImageKey = "abc123"
 
-		img2 := albumImage{}
+		img2 := client.AlbumImage{}
 		img2.IsVideo = false
 		img2.FileName = fileName
 		img2.ImageKey = "abc124"
 
-		images := []albumImage{img1, img2}
-
-		var a *albumImagesResponse
-		a = obj.(*albumImagesResponse)
-		a.Response.AlbumImage = images
+		return respond(obj, map[string]any{"AlbumImage": []client.AlbumImage{img1, img2}})
 	}
 	return nil
 }
@@ -73,21 +79,20 @@ func (m *mockHandler) get(url string, obj interface{}) error {
 func TestRun(t *testing.T) {
 	defer testutil.LessLogging()()
 
-	dest_dir := t.TempDir()
+	fs := afero.NewMemMapFs()
 
 	var downloadCalled atomic.Int32
 	tmpl, _ := buildFilenameTemplate("")
 	w := &Worker{
-		cfg: &Conf{
-			Destination: dest_dir,
-		},
+		cfg:   &Conf{},
+		store: storage.NewFs(fs),
 		req: &mockHandler{
 			username:       testUsername,
 			userAlbumsURI:  userAlbumsURI,
 			albumURLPath:   albumURLPath,
 			albumImagesURI: albumImagesURI,
 		},
-		downloadFn: func(_, _ string, _ int64) (bool, error) {
+		downloadFn: func(_ context.Context, _, _ string, _ int64, _ string) (bool, error) {
 			downloadCalled.Add(1)
 			return true, nil
 		},
@@ -96,15 +101,18 @@ func TestRun(t *testing.T) {
 		downloadsWorkers: 3,
 		downloadWg:       sync.WaitGroup{},
 		stopCh:           make(chan struct{}),
-		albumCh:          make(chan album),
+		abortCh:          make(chan struct{}),
+		albumCh:          make(chan client.Album),
 		albumsWorkers:    3,
 		albumWg:          sync.WaitGroup{},
+		metrics:          newMetrics(),
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	w.Run()
 
-	dst := filepath.Join(dest_dir, albumURLPath)
-	if _, err := os.Stat(dst); err != nil {
-		t.Fatalf("Dest folder %s not created", dst)
+	if info, err := fs.Stat(albumURLPath); err != nil || !info.IsDir() {
+		t.Fatalf("Dest folder %s not created", albumURLPath)
 	}
 
 	called := downloadCalled.Load()
@@ -203,6 +211,14 @@ func TestReadConf(t *testing.T) {
 	if cfgObj.userSecret != cfg.UserSecret {
 		t.Fatalf("userSecret: want: %s, got: %s", cfgObj.userSecret, cfg.UserSecret)
 	}
+
+	if cfg.HTTPPageSize != 100 || !cfg.HTTPExpansions {
+		t.Fatalf("http pages: want defaults, got page size %d and expansions %v", cfg.HTTPPageSize, cfg.HTTPExpansions)
+	}
+
+	if cfg.HTTPHeaderTimeout != 30*time.Second || cfg.HTTPStallTimeout != time.Minute {
+		t.Fatalf("http timeouts: want defaults, got header %s and stall %s", cfg.HTTPHeaderTimeout, cfg.HTTPStallTimeout)
+	}
 }
 
 func TestReadConfOverrides(t *testing.T) {
@@ -315,3 +331,464 @@ func TestReadConfMissingFileValues(t *testing.T) {
 		t.Fatalf("userSecret: want: %s, got: %s", "overridden_usersecret", cfg.UserSecret)
 	}
 }
+
+func TestReadConfBandwidth(t *testing.T) {
+	viper.Reset()
+	dir := t.TempDir()
+	cfgFile := []byte(`
+[store]
+destination = "test_dest"
+
+[bandwidth]
+limit = "10MB"
+
+[[bandwidth.schedule]]
+from = "08:00"
+to = "19:00"
+limit = "2MB"
+`)
+	if err := os.WriteFile(filepath.Join(dir, "config.toml"), cfgFile, 0644); err != nil {
+		t.Fatalf("Can't create config file for testing")
+	}
+
+	cfg, err := ReadConf(dir)
+	if err != nil {
+		t.Fatalf("unexpected err %v", err)
+	}
+
+	if cfg.BandwidthLimit != 10<<20 {
+		t.Fatalf("bandwidth limit: want %d, got %d", 10<<20, cfg.BandwidthLimit)
+	}
+
+	want := []BandwidthWindow{{From: 8 * time.Hour, To: 19 * time.Hour, Limit: 2 << 20}}
+	if len(cfg.BandwidthSchedule) != 1 || cfg.BandwidthSchedule[0] != want[0] {
+		t.Fatalf("bandwidth schedule: want %+v, got %+v", want, cfg.BandwidthSchedule)
+	}
+}
+
+// bigAccountHandler mocks an account with many albums, each with many images
+type bigAccountHandler struct {
+	albums    int
+	images    int
+	albumPage int // Albums per page, all in one page if 0
+	failPage  int // Page of albums failing, starting from 1, if > 0
+}
+
+func (m *bigAccountHandler) Get(ctx context.Context, url string, obj any, _ ...client.RequestOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch {
+	case url == "/api/v2!authuser":
+		return respond(obj, map[string]any{"User": client.User{NickName: testUsername}})
+	case url == "/api/v2/user/"+testUsername:
+		var u client.User
+		u.Uris.UserAlbums.URI = userAlbumsURI
+		return respond(obj, map[string]any{"User": u})
+	case strings.HasPrefix(url, userAlbumsURI):
+		start, end := 0, m.albums
+		pages := client.Pages{Total: m.albums}
+		if m.albumPage > 0 {
+			if _, err := fmt.Sscanf(url, userAlbumsURI+"?start=%d", &start); err != nil {
+				start = 0
+			}
+			if m.failPage == start/m.albumPage+1 {
+				return errors.New("boom")
+			}
+			end = min(start+m.albumPage, m.albums)
+			if end < m.albums {
+				pages.NextPage = fmt.Sprintf("%s?start=%d", userAlbumsURI, end)
+			}
+		}
+		var albums []client.Album
+		for i := start; i < end; i++ {
+			a := client.Album{URLPath: fmt.Sprintf("album_%d", i)}
+			a.Uris.AlbumImages.URI = fmt.Sprintf("/album/%d/images", i)
+			albums = append(albums, a)
+		}
+		return respond(obj, map[string]any{"Album": albums, "Pages": pages})
+	default:
+		var images []client.AlbumImage
+		for i := 0; i < m.images; i++ {
+			images = append(images, client.AlbumImage{FileName: fmt.Sprintf("%d.jpg", i)})
+		}
+		return respond(obj, map[string]any{"AlbumImage": images})
+	}
+}
+
+func newTestWorker(t *testing.T, downloadFn func(context.Context, string, string, int64, string) (bool, error)) *Worker {
+	t.Helper()
+	tmpl, _ := buildFilenameTemplate("")
+	return &Worker{
+		cfg:              &Conf{},
+		store:            storage.NewFs(afero.NewMemMapFs()),
+		req:              &bigAccountHandler{albums: 20, images: 20},
+		downloadFn:       downloadFn,
+		filenameTmpl:     tmpl,
+		downloadsCh:      make(chan *downloadInfo),
+		downloadsWorkers: 4,
+		stopCh:           make(chan struct{}),
+		abortCh:          make(chan struct{}),
+		albumCh:          make(chan client.Album),
+		albumsWorkers:    3,
+		metrics:          newMetrics(),
+	}
+}
+
+func TestRunStopAtAnyPoint(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	slowDownload := func(ctx context.Context, _, _ string, _ int64, _ string) (bool, error) {
+		select {
+		case <-time.After(time.Millisecond):
+			return true, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	for _, delay := range []time.Duration{0, 100 * time.Microsecond, time.Millisecond, 5 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond} {
+		for _, useStop := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s stop=%v", delay, useStop), func(t *testing.T) {
+				w := newTestWorker(t, slowDownload)
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				done := make(chan error, 1)
+				go func() { done <- w.Run(ctx) }()
+
+				time.Sleep(delay)
+				if useStop {
+					w.Stop()
+					w.Stop() // must not panic
+				} else {
+					cancel()
+				}
+
+				select {
+				case err := <-done:
+					if err != nil && !errors.Is(err, context.Canceled) {
+						t.Fatalf("unexpected error: %v", err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Run didn't return after being stopped")
+				}
+
+				if q := w.metrics.albumsQueue.Load(); q != 0 {
+					t.Fatalf("albums queue: want 0, got %d", q)
+				}
+				if q := w.metrics.downloadsQueue.Load(); q != 0 {
+					t.Fatalf("downloads queue: want 0, got %d", q)
+				}
+			})
+		}
+	}
+}
+
+func TestRunCompletes(t *testing.T) {
+	var downloads atomic.Int32
+	w := newTestWorker(t, func(context.Context, string, string, int64, string) (bool, error) {
+		downloads.Add(1)
+		return true, nil
+	})
+
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := downloads.Load(); got != 400 {
+		t.Fatalf("downloads: want 400, got %d", got)
+	}
+	if w.metrics.lastSuccess.Load() == 0 {
+		t.Fatalf("last success timestamp not set")
+	}
+}
+
+// blockingDownload returns a download function that signals when a download starts and then blocks
+// until release is closed or the context is cancelled
+func blockingDownload(started chan<- struct{}, release <-chan struct{}) func(context.Context, string, string, int64, string) (bool, error) {
+	return func(ctx context.Context, _, _ string, _ int64, _ string) (bool, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+			return true, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+func TestRunGracefulStop(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	w := newTestWorker(t, blockingDownload(started, release))
+
+	done := make(chan error, 1)
+	go func() { done <- w.Run(context.Background()) }()
+
+	<-started
+	w.Stop()
+
+	select {
+	case <-done:
+		t.Fatalf("Run returned without waiting for the downloads in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("want context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run didn't return after the downloads completed")
+	}
+
+	s := w.Summary()
+	if s.Downloaded == 0 {
+		t.Fatalf("downloads in progress not completed: %+v", s)
+	}
+	if s.Failed != 0 {
+		t.Fatalf("want no failures, got %+v", s)
+	}
+	if s.AlbumsLeft() == 0 {
+		t.Fatalf("want albums left undone, got %+v", s)
+	}
+}
+
+func TestRunAbort(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	for _, tt := range []struct {
+		name  string
+		grace time.Duration
+		stop  func(w *Worker)
+	}{
+		{name: "abort", stop: func(w *Worker) { w.Abort() }},
+		{name: "abort after stop", stop: func(w *Worker) { w.Stop(); w.Abort() }},
+		{name: "grace period expired", grace: 50 * time.Millisecond, stop: func(w *Worker) { w.Stop() }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{}, 1)
+			w := newTestWorker(t, blockingDownload(started, nil))
+			w.cfg.ShutdownGrace = tt.grace
+
+			done := make(chan error, 1)
+			go func() { done <- w.Run(context.Background()) }()
+
+			<-started
+			tt.stop(w)
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("want context.Canceled, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Run didn't return after the abort")
+			}
+
+			s := w.Summary()
+			if s.Aborted == 0 {
+				t.Fatalf("want aborted downloads, got %+v", s)
+			}
+			if s.Failed != 0 {
+				t.Fatalf("aborted downloads must not be failures, got %+v", s)
+			}
+		})
+	}
+}
+
+func TestRunAlbumsPageFailure(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	var downloads atomic.Int32
+	w := newTestWorker(t, func(context.Context, string, string, int64, string) (bool, error) {
+		downloads.Add(1)
+		return true, nil
+	})
+	w.req = &bigAccountHandler{albums: 20, images: 20, albumPage: 5, failPage: 3}
+
+	if err := w.Run(context.Background()); err == nil {
+		t.Fatalf("want error")
+	}
+	// The albums of the first two pages are backed up anyway
+	if got := downloads.Load(); got != 200 {
+		t.Fatalf("downloads: want 200, got %d", got)
+	}
+	if s := w.Summary(); s.AlbumsTotal != 20 || s.AlbumsDone != 10 || s.Errors != 1 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+}
+
+func TestTransportConfig(t *testing.T) {
+	cfg := &Conf{HTTPProxy: "socks5://localhost:1080", HTTPHeaderTimeout: time.Second}
+	tc, err := cfg.transportConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tc.Proxy == nil || tc.Proxy.Host != "localhost:1080" || tc.ResponseHeaderTimeout != time.Second {
+		t.Fatalf("unexpected transport configuration %+v", tc)
+	}
+	if tc.TLSConfig != nil {
+		t.Fatalf("want default TLS configuration")
+	}
+
+	for _, cfg := range []*Conf{
+		{HTTPProxy: "ftp://localhost"},
+		{HTTPCAFiles: []string{filepath.Join(t.TempDir(), "missing.pem")}},
+		{HTTPClientCert: "client.pem"},
+	} {
+		if _, err := cfg.transportConfig(); err == nil {
+			t.Errorf("%+v: want error", cfg)
+		}
+	}
+}
+
+func TestNewStorage(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		cfg     Conf
+		want    string
+		wantErr bool
+	}{
+		{name: "local folder", cfg: Conf{Destination: dir}, want: "*storage.Fs"},
+		{name: "s3 bucket", cfg: Conf{Destination: "s3://bucket/backups/smugmug", S3AccessKey: "key", S3SecretKey: "secret"}, want: "*storage.S3"},
+		{name: "s3 environment credentials", cfg: Conf{Destination: "s3://bucket", S3Endpoint: "localhost:9000", S3Insecure: true}, want: "*storage.S3"},
+		{name: "s3 missing bucket", cfg: Conf{Destination: "s3:///prefix"}, wantErr: true},
+		{name: "s3 missing secret key", cfg: Conf{Destination: "s3://bucket", S3AccessKey: "key"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := tt.cfg.newStorage()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := fmt.Sprintf("%T", s); got != tt.want {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	// Remote destinations aren't checked as local folders
+	cfg := Conf{ApiKey: "k", ApiSecret: "s", UserToken: "t", UserSecret: "s", Destination: "s3://bucket/prefix"}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNewSFTPStorage(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srv := testutil.NewSSHServer(t)
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, srv.ClientKeyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeKnownHosts := func(name string, key ssh.PublicKey) string {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, key) + "\n"
+		if err := os.WriteFile(p, []byte(line), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	knownHosts := writeKnownHosts("known_hosts", srv.HostKey)
+	otherKey := testutil.NewSSHServer(t).HostKey
+	wrongHosts := writeKnownHosts("wrong_hosts", otherKey)
+	emptyHosts := filepath.Join(dir, "empty_hosts")
+	if err := os.WriteFile(emptyHosts, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(t.TempDir(), "backup")
+	dest := "sftp://backup@" + srv.Addr + filepath.ToSlash(root)
+	tests := []struct {
+		name    string
+		cfg     Conf
+		wantErr string
+	}{
+		{name: "known host", cfg: Conf{Destination: dest, SFTPKeyFile: keyFile, SFTPKnownHosts: knownHosts}},
+		{name: "unknown host", cfg: Conf{Destination: dest, SFTPKeyFile: keyFile, SFTPKnownHosts: emptyHosts}, wantErr: "unknown host"},
+		{name: "host key mismatch", cfg: Conf{Destination: dest, SFTPKeyFile: keyFile, SFTPKnownHosts: wrongHosts}, wantErr: "key mismatch"},
+		{name: "missing key", cfg: Conf{Destination: dest, SFTPKeyFile: filepath.Join(dir, "missing"), SFTPKnownHosts: knownHosts}, wantErr: "sftp.key_file"},
+		{name: "password", cfg: Conf{Destination: "sftp://backup:secret@" + srv.Addr + "/backup", SFTPKeyFile: keyFile, SFTPKnownHosts: knownHosts}, wantErr: "passwords"},
+		{name: "missing host", cfg: Conf{Destination: "sftp:///backup"}, wantErr: "missing host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := tt.cfg.newStorage()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("want error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := createFolder(s, "album"); err != nil {
+				t.Fatalf("cannot create folder: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "album")); err != nil {
+				t.Fatalf("folder not created on the server: %v", err)
+			}
+		})
+	}
+}
+
+// failingHandler fails all the API calls
+type failingHandler struct{}
+
+func (failingHandler) Get(context.Context, string, any, ...client.RequestOption) error {
+	return errors.New("boom")
+}
+
+func TestProcessAlbum(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "album/img.jpg.part", []byte("partial"), 0o644)
+	afero.WriteFile(fs, "album/img.jpg", []byte("image"), 0o644)
+	w := newTestWorker(t, nil)
+	w.store = storage.NewFs(fs)
+	w.req = &bigAccountHandler{}
+	a := client.Album{URLPath: "/album"}
+	a.Uris.AlbumImages.URI = "/album/0/images"
+
+	// The partial downloads left by a previous run are removed
+	if got := w.processAlbum(context.Background(), a, "album"); got != albumDone {
+		t.Fatalf("want album done, got %d", got)
+	}
+	if exists, _ := afero.Exists(fs, "album/img.jpg.part"); exists {
+		t.Fatalf("want the partial download removed")
+	}
+	if exists, _ := afero.Exists(fs, "album/img.jpg"); !exists {
+		t.Fatalf("want the image kept")
+	}
+
+	// The albums whose images can't be listed fail
+	w.req = failingHandler{}
+	if got := w.processAlbum(context.Background(), a, "album"); got != albumFailed {
+		t.Fatalf("want album failed, got %d", got)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := w.processAlbum(ctx, a, "album"); got != albumInterrupted {
+		t.Fatalf("want album interrupted, got %d", got)
+	}
+}
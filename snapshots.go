@@ -0,0 +1,269 @@
+package smugmug
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
+)
+
+const (
+	// snapshotsFolder contains a folder for each snapshot of the backup, named by date
+	snapshotsFolder = "snapshots"
+	// latestSnapshot is the symbolic link to the last completed snapshot
+	latestSnapshot = "latest"
+	// snapshotLayout is the format of the names of the snapshots
+	snapshotLayout = "2006-01-02"
+)
+
+// snapshots saves each backup in a dated folder, e.g. "snapshots/2026-10-18". The files that
+// haven't changed are hard links to the ones of the previous snapshot, so that only the new and
+// changed images and videos are downloaded
+type snapshots struct {
+	root     storage.Storage
+	linker   storage.Linker
+	current  string // Folder of the snapshot of this backup
+	previous string // Folder of the last completed snapshot before the current one, empty if none
+	daily    int    // Number of daily snapshots kept. If all the counts are 0, all are kept
+	weekly   int    // Number of weekly snapshots kept
+	monthly  int    // Number of monthly snapshots kept
+}
+
+// validateSnapshots checks the retention of the snapshots and that they aren't used with the
+// options changing the layout of the files
+func (cfg *Conf) validateSnapshots() error {
+	if cfg.SnapshotsDaily < 0 || cfg.SnapshotsWeekly < 0 || cfg.SnapshotsMonthly < 0 {
+		return errors.New("snapshots.keep_daily, snapshots.keep_weekly and snapshots.keep_monthly can't be negative")
+	}
+	if !cfg.Snapshots {
+		return nil
+	}
+	switch {
+	case cfg.Archive != "":
+		return errors.New("snapshots can't be used with store.archive")
+	case cfg.encrypted():
+		return errors.New("snapshots can't be used with encryption")
+	case cfg.KeepVersions:
+		return errors.New("snapshots can't be used with versions.keep, the previous snapshots keep the replaced files")
+	}
+	return nil
+}
+
+// newSnapshots returns the snapshots of the backup in root, whose current snapshot is the one
+// of the given day. root must support hard links
+func newSnapshots(root storage.Storage, day time.Time, daily, weekly, monthly int) (*snapshots, error) {
+	linker, ok := root.(storage.Linker)
+	if !ok {
+		return nil, errors.New("snapshots require a destination supporting hard links, like a local folder or sftp")
+	}
+	s := &snapshots{
+		root:    root,
+		linker:  linker,
+		current: path.Join(snapshotsFolder, day.Format(snapshotLayout)),
+		daily:   daily,
+		weekly:  weekly,
+		monthly: monthly,
+	}
+	// The newest snapshot may have been interrupted, the latest link points to the last completed
+	previous, err := latestSnapshotFolder(linker)
+	if err != nil {
+		return nil, err
+	}
+	if previous != s.current {
+		s.previous = previous
+	}
+	if err := root.MkdirAll(s.current); err != nil {
+		return nil, fmt.Errorf("cannot create the snapshot %s: %w", s.current, err)
+	}
+	return s, nil
+}
+
+// listSnapshots returns the days of the snapshots in root, newest first
+func listSnapshots(root storage.Storage) ([]time.Time, error) {
+	files, err := root.List(snapshotsFolder)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the snapshots: %w", err)
+	}
+	var days []time.Time
+	for _, fi := range files {
+		if d, err := time.Parse(snapshotLayout, fi.Name); err == nil && fi.IsDir {
+			days = append(days, d)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].After(days[j]) })
+	return days, nil
+}
+
+// latestSnapshotFolder returns the folder of the last completed snapshot, the target of the
+// latest link, or an empty string if no snapshot has been completed
+func latestSnapshotFolder(linker storage.Linker) (string, error) {
+	target, err := linker.Readlink(path.Join(snapshotsFolder, latestSnapshot))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot read the latest snapshot: %w", err)
+	}
+	if _, err := time.Parse(snapshotLayout, path.Base(target)); err != nil {
+		return "", fmt.Errorf("unexpected latest snapshot %s", target)
+	}
+	return path.Join(snapshotsFolder, path.Base(target)), nil
+}
+
+// lastSnapshot returns the storage of the last completed snapshot in root
+func lastSnapshot(root storage.Storage) (storage.Storage, error) {
+	linker, ok := root.(storage.Linker)
+	if !ok {
+		return nil, errors.New("snapshots require a destination supporting links, like a local folder or sftp")
+	}
+	folder, err := latestSnapshotFolder(linker)
+	if err != nil {
+		return nil, err
+	}
+	if folder == "" {
+		return nil, errors.New("no completed snapshots found")
+	}
+	return storage.NewSub(root, folder), nil
+}
+
+// store returns the storage of the current snapshot
+func (s *snapshots) store() storage.Storage {
+	return storage.NewSub(s.root, s.current)
+}
+
+// link links the named file of the current snapshot to the one of the previous snapshot, if
+// the latter has the given size and the former doesn't exist. It returns true if linked
+func (s *snapshots) link(name string, size int64) (bool, error) {
+	if s.previous == "" {
+		return false, nil
+	}
+	cur := path.Join(s.current, name)
+	if _, err := s.root.Stat(cur); !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	prev := path.Join(s.previous, name)
+	same, err := sameFile(s.root, prev, size, "")
+	if err != nil || !same {
+		return false, err
+	}
+	if err := s.linker.Link(prev, cur); err != nil {
+		return false, fmt.Errorf("cannot link %s to the previous snapshot: %w", name, err)
+	}
+	log.Debugf("%s linked to the previous snapshot", name)
+	return true, nil
+}
+
+// complete points the latest link to the current snapshot and removes the snapshots exceeding
+// the retention
+func (s *snapshots) complete() error {
+	tmp := path.Join(snapshotsFolder, latestSnapshot+storage.PartialSuffix)
+	if err := s.root.Remove(tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := s.linker.Symlink(path.Base(s.current), tmp); err != nil {
+		return fmt.Errorf("cannot link the latest snapshot: %w", err)
+	}
+	if err := s.root.Rename(tmp, path.Join(snapshotsFolder, latestSnapshot)); err != nil {
+		return fmt.Errorf("cannot link the latest snapshot: %w", err)
+	}
+	return s.prune()
+}
+
+// prune removes the snapshots exceeding the retention: the last snapshot of each of the last
+// daily days, weekly weeks and monthly months are kept, together with the current one
+func (s *snapshots) prune() error {
+	if s.daily == 0 && s.weekly == 0 && s.monthly == 0 {
+		return nil
+	}
+	days, err := listSnapshots(s.root)
+	if err != nil {
+		return err
+	}
+	for _, d := range days {
+		name := path.Join(snapshotsFolder, d.Format(snapshotLayout))
+		if name == s.current || keepSnapshot(days, d, s.daily, s.weekly, s.monthly) {
+			continue
+		}
+		if err := removeAll(s.root, name); err != nil {
+			return fmt.Errorf("cannot remove the snapshot %s: %w", name, err)
+		}
+		log.Infof("Removed snapshot %s", name)
+	}
+	return nil
+}
+
+// keepSnapshot returns true if the snapshot of the given day is kept by the retention. days are
+// the days of all the snapshots, newest first
+func keepSnapshot(days []time.Time, day time.Time, daily, weekly, monthly int) bool {
+	periods := []struct {
+		keep   int
+		period func(time.Time) string
+	}{
+		{daily, func(t time.Time) string { return t.Format(snapshotLayout) }},
+		{weekly, func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprintf("%d-W%02d", y, w) }},
+		{monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, p := range periods {
+		// The newest snapshot of each period is kept, for the last keep periods
+		seen := map[string]bool{}
+		for _, d := range days {
+			key := p.period(d)
+			if seen[key] {
+				continue
+			}
+			if len(seen) == p.keep {
+				break
+			}
+			seen[key] = true
+			if d.Equal(day) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeAll removes the named folder with its content
+func removeAll(store storage.Storage, name string) error {
+	files, err := store.List(name)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir {
+			if err := removeAll(store, path.Join(name, fi.Name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := store.Remove(path.Join(name, fi.Name)); err != nil {
+			return err
+		}
+	}
+	return store.Remove(name)
+}
+
+// completeSnapshot completes the current snapshot at the end of a backup without errors. After
+// errors the snapshot is left incomplete, the next backup of the same day continues it and the
+// ones of the following days link the files of the last completed one
+func (w *Worker) completeSnapshot() {
+	if w.snapshots == nil {
+		return
+	}
+	if w.errors.Load() > 0 {
+		log.Warnf("The snapshot %s isn't completed because of the errors", w.snapshots.current)
+		return
+	}
+	if err := w.snapshots.complete(); err != nil {
+		log.WithError(err).Error("cannot complete the snapshot")
+		w.errors.Add(1)
+	}
+}
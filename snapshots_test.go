@@ -0,0 +1,157 @@
+package smugmug
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/storage"
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestSnapshots(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	var downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	root := storage.NewLocal(dir)
+	backup := func(day time.Time, files ...string) {
+		t.Helper()
+		snaps, err := newSnapshots(root, day, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", newMetrics(), nil, snaps.store())
+		h.snapshots = snaps
+		snaps.store().MkdirAll("album")
+		for _, name := range files {
+			if _, err := h.download(context.Background(), name, srv.URL+"/"+name, int64(len("content of /"+name)), ""); err != nil {
+				t.Fatalf("download %s: %v", name, err)
+			}
+		}
+		if err := snaps.complete(); err != nil {
+			t.Fatalf("complete: %v", err)
+		}
+	}
+
+	backup(time.Date(2026, 10, 17, 0, 0, 0, 0, time.Local), "album/a.jpg", "album/b.jpg")
+	backup(time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local), "album/a.jpg", "album/c.jpg")
+	if n := downloads.Load(); n != 3 {
+		t.Fatalf("want 3 downloads, got %d", n)
+	}
+
+	// The unchanged file is linked, the removed one isn't in the new snapshot
+	prev, _ := os.Stat(filepath.Join(dir, "snapshots/2026-10-17/album/a.jpg"))
+	cur, _ := os.Stat(filepath.Join(dir, "snapshots/2026-10-18/album/a.jpg"))
+	if prev == nil || cur == nil || !os.SameFile(prev, cur) {
+		t.Fatalf("want a.jpg linked to the previous snapshot")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "snapshots/2026-10-18/album/b.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("want b.jpg only in the previous snapshot, got %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "snapshots/latest")); err != nil || target != "2026-10-18" {
+		t.Fatalf("want latest linked to the current snapshot, got %q, %v", target, err)
+	}
+
+	last, err := lastSnapshot(root)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := last.Stat("album/c.jpg"); err != nil {
+		t.Fatalf("want the last snapshot, got %v", err)
+	}
+}
+
+func TestKeepSnapshot(t *testing.T) {
+	var days []time.Time
+	for d := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC); d.Year() == 2026 && d.Month() >= 8; d = d.AddDate(0, 0, -1) {
+		days = append(days, d)
+	}
+
+	var kept []string
+	for _, d := range days {
+		if keepSnapshot(days, d, 3, 2, 3) {
+			kept = append(kept, d.Format(snapshotLayout))
+		}
+	}
+	// The last 3 days, the last day of the previous week and of the previous 2 months
+	want := []string{"2026-10-18", "2026-10-17", "2026-10-16", "2026-10-11", "2026-09-30", "2026-08-31"}
+	if len(kept) != len(want) {
+		t.Fatalf("want %v, got %v", want, kept)
+	}
+	for i := range want {
+		if kept[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, kept)
+		}
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	dir := t.TempDir()
+	root := storage.NewLocal(dir)
+	for _, day := range []string{"2026-10-15", "2026-10-16", "2026-10-17"} {
+		root.MkdirAll("snapshots/" + day + "/album")
+		w, _ := root.Create("snapshots/" + day + "/album/a.jpg")
+		w.Close()
+	}
+	// The backup of the 17th has been interrupted
+	os.Symlink("2026-10-16", filepath.Join(dir, "snapshots/latest"))
+
+	snaps, err := newSnapshots(root, time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local), 2, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if snaps.previous != "snapshots/2026-10-16" {
+		t.Fatalf("unexpected previous snapshot %s", snaps.previous)
+	}
+
+	// A backup with errors doesn't complete the snapshot
+	w := &Worker{snapshots: snaps}
+	w.errors.Add(1)
+	w.completeSnapshot()
+	if target, _ := os.Readlink(filepath.Join(dir, "snapshots/latest")); target != "2026-10-16" {
+		t.Fatalf("want latest unchanged, got %q", target)
+	}
+
+	if err := snaps.complete(); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "snapshots"))
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 3 || names[0] != "2026-10-17" || names[1] != "2026-10-18" || names[2] != "latest" {
+		t.Fatalf("unexpected snapshots %v", names)
+	}
+}
+
+func TestValidateSnapshots(t *testing.T) {
+	for name, cfg := range map[string]Conf{
+		"negative":   {SnapshotsDaily: -1},
+		"archive":    {Snapshots: true, Archive: "tar"},
+		"encryption": {Snapshots: true, EncryptPassphrase: "secret"},
+		"versions":   {Snapshots: true, KeepVersions: true},
+	} {
+		if err := cfg.validateSnapshots(); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+	cfg := Conf{Snapshots: true, SnapshotsDaily: 7}
+	if err := cfg.validateSnapshots(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,1037 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveFormat is the format of the archives written by Archive
+type ArchiveFormat string
+
+const (
+	Tar ArchiveFormat = "tar"
+	Zip ArchiveFormat = "zip"
+)
+
+// archivesFolder contains the indexes of the archives
+const archivesFolder = MetaFolder + "/archives"
+
+// ArchiveEntry describes a file of an archive
+type ArchiveEntry struct {
+	Name    string    `json:"name"`            // Base name of the file
+	Size    int64     `json:"size"`            // Size of the content
+	MD5     string    `json:"md5"`             // Hex MD5 of the content
+	CRC32   uint32    `json:"crc32,omitempty"` // CRC-32 of the content, required by the zip entries
+	ModTime time.Time `json:"mtime"`           // Modification time, with seconds precision
+	Offset  int64     `json:"offset"`          // Offset of the content in the archive
+}
+
+// archiveIndex lists the entries of an archive, so that they are known without reading it
+type archiveIndex struct {
+	Entries []*ArchiveEntry `json:"entries"`
+	End     int64           `json:"end"`   // Offset of the end of the last entry, before the end marker
+	Size    int64           `json:"size"`  // Size of the archive, to check that the index matches it
+	ModTime time.Time       `json:"mtime"` // Modification time of the archive
+}
+
+// Archive is a Storage saving the files of each folder in an archive (tar or zip) instead of
+// loose files: "album/image.jpg" is the "image.jpg" entry of "album.tar". The files at the root
+// and in MetaFolder are saved as they are.
+//
+// The written files are staged in a local temporary folder and added to the archive of their
+// folder by FlushFolder, or by Flush for all the folders. Each archive has an index in MetaFolder
+// listing its entries, so that Stat and List don't read the archive. When the index is missing or
+// doesn't match the archive (e.g. after an interrupted flush), it's rebuilt reading the archive,
+// that is never overwritten without knowing its entries. New files are appended to
+// the archive when the underlying storage is a Truncater, in all the other cases (replaced,
+// removed or retimed files) the archive is rewritten
+type Archive struct {
+	s      Storage
+	format ArchiveFormat
+	tmpDir string
+
+	mu      sync.Mutex
+	folders map[string]*archiveFolder
+}
+
+// archiveFolder is the state of the archive of a folder
+type archiveFolder struct {
+	mu      sync.Mutex
+	loaded  bool                     // The index has been read
+	entries map[string]*ArchiveEntry // Entries of the archive, by name
+	end     int64
+	staged  map[string]*stagedFile // Files to add to the archive, by name
+	dirty   bool                   // Entries removed or changed, the archive must be rewritten
+}
+
+// stagedFile is a file written to the local temporary folder, to be added to an archive
+type stagedFile struct {
+	path    string
+	size    int64
+	md5     string
+	crc     uint32
+	modTime time.Time
+}
+
+// NewArchive returns a Storage saving the files of each folder of s in an archive of the given
+// format. The files are staged in tmpDir, if empty in the default temporary folder
+func NewArchive(s Storage, format ArchiveFormat, tmpDir string) *Archive {
+	return &Archive{s: s, format: format, tmpDir: tmpDir, folders: map[string]*archiveFolder{}}
+}
+
+// split returns the folder and the base name of the named file. It returns false if the file
+// isn't saved in an archive
+func (a *Archive) split(name string) (string, string, bool) {
+	folder, base := path.Split(name)
+	folder = strings.TrimSuffix(folder, "/")
+	if folder == "" || isMeta(folder) {
+		return "", "", false
+	}
+	return folder, base, true
+}
+
+func isMeta(name string) bool {
+	return name == MetaFolder || strings.HasPrefix(name, MetaFolder+"/")
+}
+
+// archiveName returns the name of the archive of the folder
+func (a *Archive) archiveName(folder string) string {
+	return folder + "." + string(a.format)
+}
+
+// indexName returns the name of the index of the archive of the folder
+func (a *Archive) indexName(folder string) string {
+	return path.Join(archivesFolder, a.archiveName(folder)+".json")
+}
+
+// lock returns the locked state of the archive of the folder, reading its index if needed
+func (a *Archive) lock(folder string) (*archiveFolder, error) {
+	a.mu.Lock()
+	f, ok := a.folders[folder]
+	if !ok {
+		f = &archiveFolder{staged: map[string]*stagedFile{}}
+		a.folders[folder] = f
+	}
+	a.mu.Unlock()
+
+	f.mu.Lock()
+	if !f.loaded {
+		index, err := a.readIndex(folder)
+		if err == nil {
+			index, err = a.checkIndex(folder, index)
+		}
+		if err != nil {
+			f.mu.Unlock()
+			return nil, fmt.Errorf("cannot read the index of %s: %w", a.archiveName(folder), err)
+		}
+		f.entries = make(map[string]*ArchiveEntry, len(index.Entries))
+		for _, e := range index.Entries {
+			f.entries[e.Name] = e
+		}
+		f.end = index.End
+		f.loaded = true
+	}
+	return f, nil
+}
+
+func (a *Archive) readIndex(folder string) (*archiveIndex, error) {
+	var index archiveIndex
+	r, err := a.s.Open(a.indexName(folder))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(&index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// checkIndex returns the index of the archive of the folder, rebuilt reading the archive if the
+// index is missing or if the archive has been written after it
+func (a *Archive) checkIndex(folder string, index *archiveIndex) (*archiveIndex, error) {
+	fi, err := a.s.Stat(a.archiveName(folder))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &archiveIndex{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size == index.Size && fi.ModTime.Equal(index.ModTime) {
+		return index, nil
+	}
+
+	if index, err = a.scan(folder); err != nil {
+		return nil, err
+	}
+	index.Size, index.ModTime = fi.Size, fi.ModTime
+	if err := a.writeIndex(folder, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// scan reads the entries of the archive of the folder. An incomplete entry at the end, left by
+// an interrupted append, is excluded from the index and overwritten by the next append
+func (a *Archive) scan(folder string) (*archiveIndex, error) {
+	name := a.archiveName(folder)
+	r, err := a.s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	cr := &countingReader{r: r}
+	var index *archiveIndex
+	if a.format == Zip {
+		index, err = scanZip(cr)
+	} else {
+		index, err = scanTar(cr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", name, err)
+	}
+	return index, nil
+}
+
+// scanTar reads the entries of a tar archive
+func scanTar(r *countingReader) (*archiveIndex, error) {
+	index := &archiveIndex{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, tar.ErrHeader) {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e := &ArchiveEntry{Name: h.Name, Size: h.Size, ModTime: h.ModTime, Offset: r.n}
+		if e.MD5, e.CRC32, err = hashContent(tr, h.Size); errors.Is(err, io.ErrUnexpectedEOF) {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The content is padded to the tar blocks
+		index.End = e.Offset + (e.Size+511)/512*512
+		if h.Typeflag == tar.TypeReg {
+			index.Entries = append(index.Entries, e)
+		}
+	}
+}
+
+// Signatures and extra fields of the zip headers
+const (
+	zipLocalHeader     = 0x04034b50
+	zipLocalLen        = 30
+	zip64Extra         = 0x0001
+	zipTimeExtra       = 0x5455
+	zipDescriptor      = 0x8
+	zipSizePlaceholder = 0xffffffff
+)
+
+// scanZip reads the entries of a zip archive from their local headers, up to the central
+// directory. Only the uncompressed entries with the sizes in the local headers, as written by
+// Archive, are supported
+func scanZip(r *countingReader) (*archiveIndex, error) {
+	index := &archiveIndex{}
+	var h [zipLocalLen]byte
+	for {
+		if _, err := io.ReadFull(r, h[:]); err != nil || binary.LittleEndian.Uint32(h[:]) != zipLocalHeader {
+			return index, nil
+		}
+		flags, method := binary.LittleEndian.Uint16(h[6:]), binary.LittleEndian.Uint16(h[8:])
+		if flags&zipDescriptor != 0 || method != zip.Store {
+			return nil, errors.New("only the uncompressed entries with known sizes are supported")
+		}
+		e := &ArchiveEntry{
+			CRC32:   binary.LittleEndian.Uint32(h[14:]),
+			Size:    int64(binary.LittleEndian.Uint32(h[22:])),
+			ModTime: msDosTime(binary.LittleEndian.Uint16(h[12:]), binary.LittleEndian.Uint16(h[10:])),
+		}
+		nameLen, extraLen := int(binary.LittleEndian.Uint16(h[26:])), int(binary.LittleEndian.Uint16(h[28:]))
+		buf := make([]byte, nameLen+extraLen)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return index, nil
+		}
+		e.Name = string(buf[:nameLen])
+		for extra := buf[nameLen:]; len(extra) >= 4; {
+			id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+			if 4+size > len(extra) {
+				break
+			}
+			field := extra[4 : 4+size]
+			switch {
+			case id == zip64Extra && size >= 8 && e.Size == zipSizePlaceholder:
+				e.Size = int64(binary.LittleEndian.Uint64(field))
+			case id == zipTimeExtra && size >= 5 && field[0]&1 != 0:
+				e.ModTime = time.Unix(int64(binary.LittleEndian.Uint32(field[1:])), 0)
+			}
+			extra = extra[4+size:]
+		}
+
+		e.Offset = r.n
+		md5, crc, err := hashContent(r, e.Size)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if crc != e.CRC32 {
+			return nil, fmt.Errorf("corrupted entry %s", e.Name)
+		}
+		e.MD5 = md5
+		index.End = e.Offset + e.Size
+		if !strings.HasSuffix(e.Name, "/") {
+			index.Entries = append(index.Entries, e)
+		}
+	}
+}
+
+// msDosTime converts the MS-DOS date and time of the zip headers, in UTC
+func msDosTime(date, t uint16) time.Time {
+	return time.Date(int(date>>9+1980), time.Month(date>>5&0xf), int(date&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f*2), 0, time.UTC)
+}
+
+// dosDateTime converts t to the MS-DOS date and time of the zip headers
+func dosDateTime(t time.Time) (uint16, uint16) {
+	return uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9),
+		uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+}
+
+// hashContent reads size bytes of r, returning their hex MD5 and their CRC-32
+func hashContent(r io.Reader, size int64) (string, uint32, error) {
+	md5Hash, crc := md5.New(), crc32.NewIEEE()
+	if _, err := io.CopyN(io.MultiWriter(md5Hash, crc), r, size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", 0, err
+	}
+	return hex.EncodeToString(md5Hash.Sum(nil)), crc.Sum32(), nil
+}
+
+// stat returns the description of the named file of the archive or of the staged files
+func (f *archiveFolder) stat(name string) (FileInfo, bool) {
+	if s, ok := f.staged[name]; ok {
+		return FileInfo{Name: name, Size: s.size, ModTime: s.modTime, MD5: s.md5}, true
+	}
+	if e, ok := f.entries[name]; ok {
+		return FileInfo{Name: name, Size: e.Size, ModTime: e.ModTime, MD5: e.MD5}, true
+	}
+	return FileInfo{}, false
+}
+
+func (a *Archive) Stat(name string) (FileInfo, error) {
+	folder, base, ok := a.split(name)
+	if ok {
+		f, err := a.lock(folder)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		fi, found := f.stat(base)
+		f.mu.Unlock()
+		if found {
+			return fi, nil
+		}
+	}
+
+	fi, err := a.s.Stat(name)
+	if err == nil && (fi.IsDir || !ok) || isMeta(name) || err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fi, err
+	}
+	// The folders of the archives exist as long as their archives exist
+	if fi, err := a.s.Stat(a.archiveName(name)); err == nil {
+		return FileInfo{Name: path.Base(name), ModTime: fi.ModTime, IsDir: true}, nil
+	}
+	if a.hasStaged(name) {
+		return FileInfo{Name: path.Base(name), IsDir: true}, nil
+	}
+	return FileInfo{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// hasStaged returns true if files of the folder are staged
+func (a *Archive) hasStaged(folder string) bool {
+	a.mu.Lock()
+	f, ok := a.folders[folder]
+	a.mu.Unlock()
+	if !ok {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.staged) > 0
+}
+
+func (a *Archive) Open(name string) (io.ReadCloser, error) {
+	folder, base, ok := a.split(name)
+	if !ok {
+		return a.s.Open(name)
+	}
+	f, err := a.lock(folder)
+	if err != nil {
+		return nil, err
+	}
+	s, staged := f.staged[base]
+	e, archived := f.entries[base]
+	f.mu.Unlock()
+
+	switch {
+	case staged:
+		return os.Open(s.path)
+	case archived:
+		r, err := a.s.Open(a.archiveName(folder))
+		if err != nil {
+			return nil, err
+		}
+		if err := skip(r, e.Offset); err != nil {
+			r.Close()
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(r, e.Size), r}, nil
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+}
+
+// skip discards the first n bytes of r, seeking if possible
+func skip(r io.Reader, n int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+func (a *Archive) Create(name string) (io.WriteCloser, error) {
+	return a.CreateAtomic(name)
+}
+
+// CreateAtomic returns a writer staging the named file, added to the archive of its folder by
+// the next flush. Replacing staged files is atomic, they aren't visible until the writer is closed
+func (a *Archive) CreateAtomic(name string) (AtomicWriter, error) {
+	folder, base, ok := a.split(name)
+	if !ok {
+		return CreateAtomic(a.s, name)
+	}
+	file, err := os.CreateTemp(a.tmpDir, "smugmug-backup-*")
+	if err != nil {
+		return nil, fmt.Errorf("cannot stage %s: %w", name, err)
+	}
+	return &stagingWriter{a: a, folder: folder, name: base, file: file, md5: md5.New(), crc: crc32.NewIEEE()}, nil
+}
+
+// stagingWriter writes a file to the local temporary folder, hashing its content
+type stagingWriter struct {
+	a      *Archive
+	folder string
+	name   string
+	file   *os.File
+	md5    hash.Hash
+	crc    hash.Hash32
+	size   int64
+}
+
+func (w *stagingWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.md5.Write(p[:n])
+	w.crc.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *stagingWriter) Close() error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	f, err := w.a.lock(w.folder)
+	if err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	defer f.mu.Unlock()
+	if old, ok := f.staged[w.name]; ok {
+		os.Remove(old.path)
+	}
+	f.staged[w.name] = &stagedFile{
+		path:    w.file.Name(),
+		size:    w.size,
+		md5:     hex.EncodeToString(w.md5.Sum(nil)),
+		crc:     w.crc.Sum32(),
+		modTime: time.Now().Truncate(time.Second),
+	}
+	return nil
+}
+
+func (w *stagingWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// Append isn't supported for the files of the archives, they can only be replaced
+func (a *Archive) Append(name string) (io.WriteCloser, error) {
+	if _, _, ok := a.split(name); !ok {
+		return a.s.Append(name)
+	}
+	return nil, &fs.PathError{Op: "append", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Rename copies the content of the files of the archives to the new name, removing the old one
+func (a *Archive) Rename(oldname, newname string) error {
+	_, _, oldArchived := a.split(oldname)
+	_, _, newArchived := a.split(newname)
+	if !oldArchived && !newArchived {
+		return a.s.Rename(oldname, newname)
+	}
+
+	fi, err := a.Stat(oldname)
+	if err != nil {
+		return err
+	}
+	r, err := a.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := a.CreateAtomic(newname)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Abort()
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := a.Chtimes(newname, time.Now(), fi.ModTime); err != nil {
+		return err
+	}
+	return a.Remove(oldname)
+}
+
+func (a *Archive) Remove(name string) error {
+	folder, base, ok := a.split(name)
+	if !ok {
+		return a.s.Remove(name)
+	}
+	f, err := a.lock(folder)
+	if err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	if s, ok := f.staged[base]; ok {
+		os.Remove(s.path)
+		delete(f.staged, base)
+		return nil
+	}
+	if _, ok := f.entries[base]; ok {
+		delete(f.entries, base)
+		f.dirty = true
+		return nil
+	}
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+}
+
+// MkdirAll creates the folder containing the archive of the named folder
+func (a *Archive) MkdirAll(name string) error {
+	if isMeta(name) {
+		return a.s.MkdirAll(name)
+	}
+	if dir := path.Dir(name); dir != "." {
+		return a.s.MkdirAll(dir)
+	}
+	return nil
+}
+
+// Chtimes changes the modification time of the files of the archives, rewriting them if needed
+func (a *Archive) Chtimes(name string, atime, mtime time.Time) error {
+	folder, base, ok := a.split(name)
+	if !ok {
+		return a.s.Chtimes(name, atime, mtime)
+	}
+	mtime = mtime.Truncate(time.Second)
+	f, err := a.lock(folder)
+	if err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	if s, ok := f.staged[base]; ok {
+		s.modTime = mtime
+		return nil
+	}
+	if e, ok := f.entries[base]; ok {
+		if !e.ModTime.Equal(mtime) {
+			e.ModTime = mtime
+			f.dirty = true
+		}
+		return nil
+	}
+	return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+}
+
+// List returns the content of the named folder: the archives are listed as folders and their
+// entries as the files of the folders
+func (a *Archive) List(name string) ([]FileInfo, error) {
+	if isMeta(name) {
+		return a.s.List(name)
+	}
+
+	files := map[string]FileInfo{}
+	stored, err := a.s.List(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, fi := range stored {
+		switch {
+		case fi.IsDir:
+			files[fi.Name] = fi
+		case strings.HasSuffix(fi.Name, "."+string(a.format)):
+			fi.Name = strings.TrimSuffix(fi.Name, "."+string(a.format))
+			fi.IsDir, fi.Size = true, 0
+			files[fi.Name] = fi
+		case name == "":
+			// The files at the root aren't archived
+			files[fi.Name] = fi
+		}
+	}
+
+	// The folders with only staged files
+	a.mu.Lock()
+	folders := slices.Collect(maps.Keys(a.folders))
+	a.mu.Unlock()
+	for _, folder := range folders {
+		if dir := path.Dir(folder); (dir == name || dir == "." && name == "") && a.hasStaged(folder) {
+			if _, ok := files[path.Base(folder)]; !ok {
+				files[path.Base(folder)] = FileInfo{Name: path.Base(folder), IsDir: true}
+			}
+		}
+	}
+
+	if name != "" {
+		f, err := a.lock(name)
+		if err != nil {
+			return nil, err
+		}
+		for entry := range f.entries {
+			files[entry], _ = f.stat(entry)
+		}
+		for entry := range f.staged {
+			files[entry], _ = f.stat(entry)
+		}
+		f.mu.Unlock()
+	}
+
+	if len(files) == 0 && errors.Is(err, fs.ErrNotExist) {
+		if _, statErr := a.Stat(name); statErr != nil {
+			return nil, err
+		}
+	}
+	list := slices.Collect(maps.Values(files))
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// FlushFolder adds the staged files of the folder to its archive, removing them from the
+// temporary folder
+func (a *Archive) FlushFolder(folder string) error {
+	f, err := a.lock(folder)
+	if err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	if len(f.staged) == 0 && !f.dirty {
+		return nil
+	}
+
+	if err := a.write(folder, f); err != nil {
+		return fmt.Errorf("cannot write %s: %w", a.archiveName(folder), err)
+	}
+	for _, s := range f.staged {
+		os.Remove(s.path)
+	}
+	f.staged = map[string]*stagedFile{}
+	f.dirty = false
+	// The index is read again when needed, the entries of all the archives aren't kept in memory
+	f.loaded, f.entries = false, nil
+	return nil
+}
+
+// Flush adds the staged files to the archives and flushes the underlying storage, if it's a
+// Flusher
+func (a *Archive) Flush() error {
+	a.mu.Lock()
+	folders := slices.Sorted(maps.Keys(a.folders))
+	a.mu.Unlock()
+	var errs []error
+	for _, folder := range folders {
+		if err := a.FlushFolder(folder); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if f, ok := a.s.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// write adds the staged files to the archive of the folder and saves its index. The entries are
+// appended when possible, otherwise the archive is rewritten
+func (a *Archive) write(folder string, f *archiveFolder) error {
+	if err := a.s.MkdirAll(archivesFolder); err != nil {
+		return err
+	}
+	var (
+		index    *archiveIndex
+		err      error
+		appended bool
+	)
+	if a.canAppend(f) {
+		index, err = a.appendEntries(folder, f)
+		// An archive not written by this version is rewritten
+		appended = !errors.Is(err, errIndexMismatch)
+	}
+	if !appended {
+		index, err = a.rewrite(folder, f)
+	}
+	if err != nil {
+		return err
+	}
+
+	fi, err := a.s.Stat(a.archiveName(folder))
+	if err == nil {
+		index.Size, index.ModTime = fi.Size, fi.ModTime
+		err = a.writeIndex(folder, index)
+	}
+	if err != nil {
+		// An outdated index would point to the wrong content, without it the index is rebuilt
+		// reading the archive
+		a.s.Remove(a.indexName(folder))
+		f.loaded, f.entries, f.dirty = false, nil, false
+		return fmt.Errorf("cannot write the index: %w", err)
+	}
+	return nil
+}
+
+func (a *Archive) writeIndex(folder string, index *archiveIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := a.s.MkdirAll(path.Dir(a.indexName(folder))); err != nil {
+		return err
+	}
+	w, err := CreateAtomic(a.s, a.indexName(folder))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// canAppend returns true if the staged files can be appended to the archive: all of them are new
+// and the end of the archive can be truncated
+func (a *Archive) canAppend(f *archiveFolder) bool {
+	if _, ok := a.s.(Truncater); !ok || f.dirty || len(f.entries) == 0 {
+		return false
+	}
+	for name := range f.staged {
+		if _, ok := f.entries[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// errIndexMismatch is returned when the entries of an archive aren't where its index says
+var errIndexMismatch = errors.New("the archive doesn't match its index")
+
+// appendEntries replaces the end of the archive (the end marker of the tar archives, the central
+// directory of the zip ones) with the staged files
+func (a *Archive) appendEntries(folder string, f *archiveFolder) (*archiveIndex, error) {
+	name := a.archiveName(folder)
+	entries := slices.Collect(maps.Values(f.entries))
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	cw := &countingWriter{w: io.Discard, n: f.end}
+	if a.format == Zip {
+		cw.n = 0
+	}
+	aw := newArchiveWriter(a.format, cw)
+	if z, ok := aw.(*zipWriter); ok {
+		if err := z.replay(entries, f.end); err != nil {
+			return nil, err
+		}
+	}
+
+	// Also removes what's left by an interrupted append
+	if err := a.s.(Truncater).Truncate(name, f.end); err != nil {
+		return nil, err
+	}
+	w, err := a.s.Append(name)
+	if err != nil {
+		return nil, err
+	}
+	cw.w = w
+	index := &archiveIndex{Entries: entries}
+	if err := a.addStaged(aw, f, index); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if index.End, err = aw.Close(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return index, w.Close()
+}
+
+// rewrite writes a new archive with the entries of the current one and the staged files
+func (a *Archive) rewrite(folder string, f *archiveFolder) (*archiveIndex, error) {
+	name := a.archiveName(folder)
+	var kept []*ArchiveEntry
+	for _, e := range f.entries {
+		if _, ok := f.staged[e.Name]; !ok {
+			kept = append(kept, e)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Offset < kept[j].Offset })
+
+	var old io.ReadCloser
+	if len(kept) > 0 {
+		var err error
+		if old, err = a.s.Open(name); err != nil {
+			return nil, err
+		}
+		defer old.Close()
+	}
+	w, err := CreateAtomic(a.s, name)
+	if err != nil {
+		return nil, err
+	}
+	aw := newArchiveWriter(a.format, &countingWriter{w: w})
+
+	// The entries are read sequentially, in the order of the archive
+	index := &archiveIndex{}
+	var pos int64
+	for _, e := range kept {
+		if err := skip(old, e.Offset-pos); err != nil {
+			w.Abort()
+			return nil, err
+		}
+		moved := *e
+		content, offset, err := aw.add(&moved)
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+		if _, err := io.CopyN(content, old, e.Size); err != nil {
+			w.Abort()
+			return nil, fmt.Errorf("cannot copy %s: %w", e.Name, err)
+		}
+		pos = e.Offset + e.Size
+		moved.Offset = offset
+		index.Entries = append(index.Entries, &moved)
+	}
+	if err := a.addStaged(aw, f, index); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if index.End, err = aw.Close(); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return index, w.Close()
+}
+
+// addStaged adds the staged files to the archive, sorted by name, and to the index
+func (a *Archive) addStaged(aw archiveWriter, f *archiveFolder, index *archiveIndex) error {
+	for _, name := range slices.Sorted(maps.Keys(f.staged)) {
+		s := f.staged[name]
+		e := &ArchiveEntry{Name: name, Size: s.size, MD5: s.md5, CRC32: s.crc, ModTime: s.modTime}
+		content, offset, err := aw.add(e)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(s.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(content, file, s.size)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("cannot copy %s: %w", name, err)
+		}
+		e.Offset = offset
+		index.Entries = append(index.Entries, e)
+	}
+	return nil
+}
+
+// archiveWriter writes the entries of an archive
+type archiveWriter interface {
+	// add writes the header of the entry, returning the writer of its content and its offset
+	add(e *ArchiveEntry) (io.Writer, int64, error)
+	// Close completes the archive, returning the offset of the end of the last entry
+	Close() (int64, error)
+}
+
+func newArchiveWriter(format ArchiveFormat, w *countingWriter) archiveWriter {
+	if format == Zip {
+		zw := zip.NewWriter(w)
+		zw.SetOffset(w.n)
+		return &zipWriter{w: w, zw: zw}
+	}
+	return &tarWriter{w: w, tw: tar.NewWriter(w)}
+}
+
+type tarWriter struct {
+	w  *countingWriter
+	tw *tar.Writer
+}
+
+func (t *tarWriter) add(e *ArchiveEntry) (io.Writer, int64, error) {
+	h := &tar.Header{Typeflag: tar.TypeReg, Name: e.Name, Size: e.Size, Mode: 0644, ModTime: e.ModTime}
+	if err := t.tw.WriteHeader(h); err != nil {
+		return nil, 0, err
+	}
+	return t.tw, t.w.n, nil
+}
+
+func (t *tarWriter) Close() (int64, error) {
+	if err := t.tw.Flush(); err != nil {
+		return 0, err
+	}
+	end := t.w.n
+	return end, t.tw.Close()
+}
+
+// zipWriter writes zip archives with uncompressed entries, the images and the videos are already
+// compressed
+type zipWriter struct {
+	w  *countingWriter
+	zw *zip.Writer
+}
+
+func (z *zipWriter) add(e *ArchiveEntry) (io.Writer, int64, error) {
+	// The modification time, in the MS-DOS format and in the extended timestamp field
+	date, t := dosDateTime(e.ModTime.UTC())
+	mtime := make([]byte, 9)
+	binary.LittleEndian.PutUint16(mtime, zipTimeExtra)
+	binary.LittleEndian.PutUint16(mtime[2:], 5)
+	mtime[4] = 1
+	binary.LittleEndian.PutUint32(mtime[5:], uint32(e.ModTime.Unix()))
+	w, err := z.zw.CreateRaw(&zip.FileHeader{
+		Name:               e.Name,
+		Method:             zip.Store,
+		ModifiedDate:       date,
+		ModifiedTime:       t,
+		Extra:              mtime,
+		CRC32:              e.CRC32,
+		CompressedSize64:   uint64(e.Size),
+		UncompressedSize64: uint64(e.Size),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	// The header is buffered by the zip writer
+	if err := z.zw.Flush(); err != nil {
+		return nil, 0, err
+	}
+	return w, z.w.n, nil
+}
+
+// replay adds the entries already in the archive, which ends at end, to the central directory.
+// Their headers and contents are written to the underlying writer, that discards them
+func (z *zipWriter) replay(entries []*ArchiveEntry, end int64) error {
+	for _, e := range entries {
+		content, offset, err := z.add(e)
+		if err != nil {
+			return err
+		}
+		if offset != e.Offset {
+			return errIndexMismatch
+		}
+		if _, err := io.CopyN(content, zeros{}, e.Size); err != nil {
+			return err
+		}
+	}
+	if err := z.zw.Flush(); err != nil {
+		return err
+	}
+	if z.w.n != end {
+		return errIndexMismatch
+	}
+	return nil
+}
+
+func (z *zipWriter) Close() (int64, error) {
+	if err := z.zw.Flush(); err != nil {
+		return 0, err
+	}
+	end := z.w.n
+	return end, z.zw.Close()
+}
+
+// zeros is a reader of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// countingReader counts the bytes read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written, starting from n
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// archiveContent returns the content of the entries of an archive, by name
+func archiveContent(t *testing.T, format ArchiveFormat, data []byte) map[string]string {
+	t.Helper()
+	content := map[string]string{}
+	if format == Zip {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("invalid zip: %v", err)
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatalf("invalid zip entry %s: %v", f.Name, err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("invalid zip entry %s: %v", f.Name, err)
+			}
+			content[f.Name] = string(b)
+		}
+		return content
+	}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return content
+		}
+		if err != nil {
+			t.Fatalf("invalid tar: %v", err)
+		}
+		b, _ := io.ReadAll(tr)
+		content[h.Name] = string(b)
+	}
+}
+
+// appendsFs is a Fs counting the files opened for appending
+type appendsFs struct {
+	*Fs
+	appends int
+}
+
+func (f *appendsFs) Append(name string) (io.WriteCloser, error) {
+	f.appends++
+	return f.Fs.Append(name)
+}
+
+func TestArchive(t *testing.T) {
+	for _, format := range []ArchiveFormat{Tar, Zip} {
+		t.Run(string(format), func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			tmp := t.TempDir()
+			base := &appendsFs{Fs: NewFs(fs)}
+			s := NewArchive(base, format, tmp)
+			archive := "album." + string(format)
+
+			write := func(name, content string) {
+				t.Helper()
+				w, err := CreateAtomic(s, name)
+				if err != nil {
+					t.Fatalf("create %s: %v", name, err)
+				}
+				io.WriteString(w, content)
+				if err := w.Close(); err != nil {
+					t.Fatalf("close %s: %v", name, err)
+				}
+			}
+			read := func(s Storage, name string) string {
+				t.Helper()
+				r, err := s.Open(name)
+				if err != nil {
+					t.Fatalf("open %s: %v", name, err)
+				}
+				defer r.Close()
+				b, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("read %s: %v", name, err)
+				}
+				return string(b)
+			}
+			flush := func() map[string]string {
+				t.Helper()
+				if err := s.FlushFolder("album"); err != nil {
+					t.Fatalf("flush: %v", err)
+				}
+				data, err := afero.ReadFile(fs, archive)
+				if err != nil {
+					t.Fatalf("missing archive: %v", err)
+				}
+				return archiveContent(t, format, data)
+			}
+
+			if _, err := s.Stat("album"); err == nil {
+				t.Fatalf("want missing album")
+			}
+			if err := s.MkdirAll("album"); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			write("album/a.jpg", "aaa")
+			write("album/b.jpg", "bbbb")
+			write("metadata.csv", "csv")
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			if err := s.Chtimes("album/a.jpg", time.Now(), mtime); err != nil {
+				t.Fatalf("chtimes: %v", err)
+			}
+
+			// The staged files are visible before the flush
+			if fi, err := s.Stat("album"); err != nil || !fi.IsDir {
+				t.Fatalf("want album folder, got %+v, %v", fi, err)
+			}
+			if fi, err := s.Stat("album/b.jpg"); err != nil || fi.Size != 4 {
+				t.Fatalf("unexpected file info %+v, %v", fi, err)
+			}
+			if got := read(s, "album/b.jpg"); got != "bbbb" {
+				t.Fatalf("unexpected staged content %q", got)
+			}
+
+			want := map[string]string{"a.jpg": "aaa", "b.jpg": "bbbb"}
+			if got := flush(); len(got) != 2 || got["a.jpg"] != want["a.jpg"] || got["b.jpg"] != want["b.jpg"] {
+				t.Fatalf("unexpected archive %v", got)
+			}
+			if exists, _ := afero.DirExists(fs, "album"); exists {
+				t.Fatalf("want no loose files")
+			}
+			if got, _ := afero.ReadFile(fs, "metadata.csv"); string(got) != "csv" {
+				t.Fatalf("want files at the root not archived, got %q", got)
+			}
+
+			// The index describes the archive to other instances
+			other := NewArchive(NewFs(fs), format, tmp)
+			fi, err := other.Stat("album/a.jpg")
+			if err != nil || fi.Size != 3 || !fi.ModTime.Equal(mtime) || fi.MD5 != "47bce5c74f589f4867dbd57e9ca9f808" {
+				t.Fatalf("unexpected file info %+v, %v", fi, err)
+			}
+			if got := read(other, "album/b.jpg"); got != "bbbb" {
+				t.Fatalf("unexpected content %q", got)
+			}
+			files, err := other.List("")
+			if err != nil || len(files) != 3 || files[0].Name != MetaFolder || files[1].Name != "album" || !files[1].IsDir || files[2].Name != "metadata.csv" {
+				t.Fatalf("unexpected root files %+v, %v", files, err)
+			}
+			files, err = other.List("album")
+			if err != nil || len(files) != 2 || files[0].Name != "a.jpg" || files[1].Size != 4 {
+				t.Fatalf("unexpected album files %+v, %v", files, err)
+			}
+
+			// New files are appended to the archives, replacing the tar end marker or the zip
+			// central directory
+			before, _ := afero.ReadFile(fs, archive)
+			end := len(before) - 1024
+			if format == Zip {
+				end = bytes.Index(before, []byte("PK\x01\x02"))
+			}
+			write("album/c.jpg", "c")
+			if got := flush(); len(got) != 3 || got["c.jpg"] != "c" || got["a.jpg"] != "aaa" {
+				t.Fatalf("unexpected archive %v", got)
+			}
+			if after, _ := afero.ReadFile(fs, archive); base.appends != 1 || !bytes.HasPrefix(after, before[:end]) {
+				t.Fatalf("want archive appended")
+			}
+			if got := read(NewArchive(NewFs(fs), format, tmp), "album/b.jpg"); got != "bbbb" {
+				t.Fatalf("unexpected content %q", got)
+			}
+
+			// Replaced and removed files rewrite the archive
+			write("album/a.jpg", "new")
+			if err := s.Remove("album/b.jpg"); err != nil {
+				t.Fatalf("remove: %v", err)
+			}
+			if got := flush(); len(got) != 2 || got["a.jpg"] != "new" || got["c.jpg"] != "c" {
+				t.Fatalf("unexpected archive %v", got)
+			}
+			if got := read(s, "album/c.jpg"); got != "c" {
+				t.Fatalf("unexpected content %q", got)
+			}
+			if _, err := s.Stat("album/b.jpg"); err == nil {
+				t.Fatalf("want removed file")
+			}
+
+			if _, err := s.Append("album/a.jpg"); !errors.Is(err, errors.ErrUnsupported) {
+				t.Fatalf("append: want ErrUnsupported, got %v", err)
+			}
+			if staged, _ := afero.ReadDir(afero.NewOsFs(), tmp); len(staged) != 0 {
+				t.Fatalf("want no staged files left, got %d", len(staged))
+			}
+		})
+	}
+}
+
+func TestArchiveIndexRecovery(t *testing.T) {
+	for _, format := range []ArchiveFormat{Tar, Zip} {
+		t.Run(string(format), func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			tmp := t.TempDir()
+			archive := "album." + string(format)
+			index := NewArchive(NewFs(fs), format, tmp).indexName("album")
+
+			// Each step is a new process, with the state read from the destination
+			update := func(files map[string]string) *Archive {
+				t.Helper()
+				s := NewArchive(NewFs(fs), format, tmp)
+				for name, content := range files {
+					w, err := CreateAtomic(s, name)
+					if err != nil {
+						t.Fatalf("create %s: %v", name, err)
+					}
+					io.WriteString(w, content)
+					if err := w.Close(); err != nil {
+						t.Fatalf("close %s: %v", name, err)
+					}
+				}
+				if err := s.FlushFolder("album"); err != nil {
+					t.Fatalf("flush: %v", err)
+				}
+				return s
+			}
+			content := func() map[string]string {
+				t.Helper()
+				data, err := afero.ReadFile(fs, archive)
+				if err != nil {
+					t.Fatalf("missing archive: %v", err)
+				}
+				return archiveContent(t, format, data)
+			}
+
+			s := update(map[string]string{"album/a.jpg": "aaa"})
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			if err := s.Chtimes("album/a.jpg", time.Now(), mtime); err != nil {
+				t.Fatalf("chtimes: %v", err)
+			}
+			s.FlushFolder("album")
+
+			// A missing index is rebuilt from the archive, that isn't overwritten
+			fs.Remove(index)
+			s = update(map[string]string{"album/b.jpg": "bbbb"})
+			if got := content(); len(got) != 2 || got["a.jpg"] != "aaa" || got["b.jpg"] != "bbbb" {
+				t.Fatalf("unexpected archive %v", got)
+			}
+			fi, err := NewArchive(NewFs(fs), format, tmp).Stat("album/a.jpg")
+			if err != nil || fi.Size != 3 || !fi.ModTime.Equal(mtime) || fi.MD5 != "47bce5c74f589f4867dbd57e9ca9f808" {
+				t.Fatalf("unexpected file info %+v, %v", fi, err)
+			}
+
+			// An index older than the archive, e.g. when the process is killed before writing it,
+			// is rebuilt too
+			old, _ := afero.ReadFile(fs, index)
+			update(map[string]string{"album/a.jpg": "new content"})
+			afero.WriteFile(fs, index, old, 0o644)
+			update(map[string]string{"album/c.jpg": "c"})
+			if got := content(); len(got) != 3 || got["a.jpg"] != "new content" || got["b.jpg"] != "bbbb" || got["c.jpg"] != "c" {
+				t.Fatalf("unexpected archive %v", got)
+			}
+
+			// An incomplete entry left by an interrupted append is overwritten
+			data, _ := afero.ReadFile(fs, archive)
+			before := NewArchive(NewFs(fs), format, tmp)
+			f, err := before.lock("album")
+			if err != nil {
+				t.Fatalf("lock: %v", err)
+			}
+			end, first := f.end, f.entries["b.jpg"].Offset
+			f.mu.Unlock()
+			// The header and the first byte of the content of b.jpg
+			afero.WriteFile(fs, archive, append(data[:end:end], data[:first+1]...), 0o644)
+			update(map[string]string{"album/d.jpg": "dd"})
+			if got := content(); len(got) != 4 || got["a.jpg"] != "new content" || got["d.jpg"] != "dd" {
+				t.Fatalf("unexpected archive %v", got)
+			}
+		})
+	}
+}
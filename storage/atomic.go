@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+// PartialSuffix is appended to the names of the temporary files written by CreateAtomic
+const PartialSuffix = ".part"
+
+// CreateAtomic returns a writer replacing the named file when closed. If the storage can't
+// create files atomically, the content is written to a temporary file renamed when complete:
+// an interrupted write doesn't leave partial files behind
+func CreateAtomic(store Storage, name string) (AtomicWriter, error) {
+	if s, ok := store.(AtomicCreator); ok {
+		return s.CreateAtomic(name)
+	}
+	partial := name + PartialSuffix
+	f, err := store.Create(partial)
+	if err != nil {
+		return nil, fmt.Errorf("%s: file creation failed with: %w", partial, err)
+	}
+	return &partialFile{WriteCloser: f, store: store, partial: partial, name: name}, nil
+}
+
+// partialFile writes a temporary file, renamed to its final name when closed
+type partialFile struct {
+	io.WriteCloser
+	store   Storage
+	partial string
+	name    string
+}
+
+func (f *partialFile) Close() error {
+	if err := f.WriteCloser.Close(); err != nil {
+		f.store.Remove(f.partial)
+		return fmt.Errorf("%s: file close failed with: %w", f.partial, err)
+	}
+	if err := f.store.Rename(f.partial, f.name); err != nil {
+		f.store.Remove(f.partial)
+		return fmt.Errorf("%s: file rename failed with: %w", f.name, err)
+	}
+	return nil
+}
+
+func (f *partialFile) Abort() {
+	f.WriteCloser.Close()
+	f.store.Remove(f.partial)
+}
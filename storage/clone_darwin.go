@@ -0,0 +1,10 @@
+//go:build darwin
+
+package storage
+
+import "golang.org/x/sys/unix"
+
+// clone creates newpath as a clone of oldpath, supported by APFS
+func clone(oldpath, newpath string) error {
+	return unix.Clonefile(oldpath, newpath, unix.CLONE_NOFOLLOW)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package storage
+
+import "errors"
+
+// clone isn't supported on this platform
+func clone(oldpath, newpath string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tommyblue/smugmug-backup/crypt"
+)
+
+// MetaFolder contains the files describing an encrypted backup (e.g. the key parameters and the
+// manifests). It's in the root of the underlying storage and its name is never encrypted
+const MetaFolder = ".smugmug-backup"
+
+// manifestsFolder contains a manifest for each backup run
+const manifestsFolder = MetaFolder + "/manifests"
+
+// ManifestEntry describes a file written to an Encrypted storage
+type ManifestEntry struct {
+	Name    string    `json:"name"`           // Name of the file
+	Stored  string    `json:"stored"`         // Name in the underlying storage, different if the names are encrypted
+	Size    int64     `json:"size"`           // Size of the content
+	MD5     string    `json:"md5"`            // Hex MD5 of the content
+	ModTime time.Time `json:"mtime,omitzero"` // Modification time, if set with Chtimes
+}
+
+type manifest struct {
+	Files []*ManifestEntry `json:"files"`
+}
+
+// Encrypted is a Storage encrypting the content of the files, and optionally their names,
+// before saving them on another Storage. Stat and List report the size of the content.
+//
+// The files written are described in a manifest (names, sizes and MD5 of the content), saved
+// encrypted in MetaFolder by Flush. Files can't be appended, their encryption can't be resumed
+type Encrypted struct {
+	s      Storage
+	cipher crypt.Cipher
+	names  *crypt.Names // nil if the names aren't encrypted
+
+	mu      sync.Mutex
+	written map[string]*ManifestEntry // Files written since the last Flush, by name
+}
+
+// NewEncrypted returns a Storage encrypting the files with the cipher before saving them on s.
+// If names isn't nil, the names of the files and folders are encrypted too
+func NewEncrypted(s Storage, c crypt.Cipher, names *crypt.Names) *Encrypted {
+	return &Encrypted{s: s, cipher: c, names: names, written: map[string]*ManifestEntry{}}
+}
+
+// stored returns the name of the file in the underlying storage
+func (e *Encrypted) stored(name string) string {
+	if e.names == nil || name == "" {
+		return name
+	}
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = e.names.Encrypt(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// plain converts the description of a file of the underlying storage. It returns false if
+// the name isn't encrypted, e.g. for temporary files
+func (e *Encrypted) plain(fi FileInfo) (FileInfo, bool) {
+	if e.names != nil {
+		name, err := e.names.Decrypt(fi.Name)
+		if err != nil {
+			return fi, false
+		}
+		fi.Name = name
+	}
+	if !fi.IsDir {
+		fi.Size = e.cipher.PlainSize(fi.Size)
+	}
+	// The MD5 of the underlying storage is the one of the encrypted content
+	fi.MD5 = ""
+	return fi, true
+}
+
+func (e *Encrypted) Stat(name string) (FileInfo, error) {
+	fi, err := e.s.Stat(e.stored(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi, _ = e.plain(fi)
+	fi.Name = path.Base(name)
+	return fi, nil
+}
+
+func (e *Encrypted) Open(name string) (io.ReadCloser, error) {
+	r, err := e.s.Open(e.stored(name))
+	if err != nil {
+		return nil, err
+	}
+	d, err := e.cipher.Decrypt(r)
+	if err != nil {
+		r.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{d, r}, nil
+}
+
+func (e *Encrypted) Create(name string) (io.WriteCloser, error) {
+	w, err := e.s.Create(e.stored(name))
+	if err != nil {
+		return nil, err
+	}
+	return e.encrypt(name, w)
+}
+
+// CreateAtomic encrypts the content written with CreateAtomic of the underlying storage
+func (e *Encrypted) CreateAtomic(name string) (AtomicWriter, error) {
+	w, err := CreateAtomic(e.s, e.stored(name))
+	if err != nil {
+		return nil, err
+	}
+	return e.encrypt(name, w)
+}
+
+func (e *Encrypted) encrypt(name string, w io.WriteCloser) (*encryptedWriter, error) {
+	enc, err := e.cipher.Encrypt(w)
+	if err != nil {
+		w.Close()
+		return nil, &fs.PathError{Op: "encrypt", Path: name, Err: err}
+	}
+	return &encryptedWriter{e: e, name: name, w: w, enc: enc, hash: md5.New()}, nil
+}
+
+// encryptedWriter encrypts the content written to the file, hashing it for the manifest
+type encryptedWriter struct {
+	e    *Encrypted
+	name string
+	w    io.WriteCloser // Writer of the underlying storage
+	enc  io.WriteCloser
+	hash hash.Hash
+	size int64
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	n, err := w.enc.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *encryptedWriter) Close() error {
+	if err := w.enc.Close(); err != nil {
+		w.Abort()
+		return &fs.PathError{Op: "encrypt", Path: w.name, Err: err}
+	}
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	w.e.record(&ManifestEntry{
+		Name:   w.name,
+		Stored: w.e.stored(w.name),
+		Size:   w.size,
+		MD5:    hex.EncodeToString(w.hash.Sum(nil)),
+	})
+	return nil
+}
+
+// Abort discards the content if the underlying writer is an AtomicWriter, otherwise it closes it
+func (w *encryptedWriter) Abort() {
+	if a, ok := w.w.(AtomicWriter); ok {
+		a.Abort()
+		return
+	}
+	w.w.Close()
+}
+
+func (e *Encrypted) record(entry *ManifestEntry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.written[entry.Name] = entry
+}
+
+// Append isn't supported: the content of the encrypted files can't be extended
+func (e *Encrypted) Append(name string) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "append", Path: name, Err: errors.ErrUnsupported}
+}
+
+func (e *Encrypted) Rename(oldname, newname string) error {
+	if err := e.s.Rename(e.stored(oldname), e.stored(newname)); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if entry, ok := e.written[oldname]; ok {
+		delete(e.written, oldname)
+		entry.Name, entry.Stored = newname, e.stored(newname)
+		e.written[newname] = entry
+	}
+	return nil
+}
+
+func (e *Encrypted) Remove(name string) error {
+	if err := e.s.Remove(e.stored(name)); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.written, name)
+	return nil
+}
+
+func (e *Encrypted) MkdirAll(name string) error {
+	return e.s.MkdirAll(e.stored(name))
+}
+
+func (e *Encrypted) Chtimes(name string, atime, mtime time.Time) error {
+	if err := e.s.Chtimes(e.stored(name), atime, mtime); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if entry, ok := e.written[name]; ok {
+		entry.ModTime = mtime
+	}
+	return nil
+}
+
+// List returns the content of the named folder, without MetaFolder and the files whose names
+// aren't encrypted when the names are encrypted
+func (e *Encrypted) List(name string) ([]FileInfo, error) {
+	stored, err := e.s.List(e.stored(name))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileInfo, 0, len(stored))
+	for _, fi := range stored {
+		if name == "" && fi.Name == MetaFolder {
+			continue
+		}
+		if fi, ok := e.plain(fi); ok {
+			files = append(files, fi)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// Flush saves the manifest of the files written since the previous call, encrypted, in
+// MetaFolder. Each call saves a new manifest
+func (e *Encrypted) Flush() error {
+	e.mu.Lock()
+	written := e.written
+	e.written = map[string]*ManifestEntry{}
+	e.mu.Unlock()
+	if len(written) == 0 {
+		return nil
+	}
+
+	err := e.writeManifest(written)
+	if err != nil {
+		// Saved with the next manifest
+		e.mu.Lock()
+		for name, entry := range written {
+			if _, ok := e.written[name]; !ok {
+				e.written[name] = entry
+			}
+		}
+		e.mu.Unlock()
+	}
+	return err
+}
+
+func (e *Encrypted) writeManifest(written map[string]*ManifestEntry) error {
+	m := manifest{Files: slices.SortedFunc(maps.Values(written), func(a, b *ManifestEntry) int {
+		return strings.Compare(a.Name, b.Name)
+	})}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := e.s.MkdirAll(manifestsFolder); err != nil {
+		return fmt.Errorf("cannot create the manifests folder: %w", err)
+	}
+	name := path.Join(manifestsFolder, time.Now().UTC().Format("20060102T150405.000000000Z")+".json")
+	w, err := CreateAtomic(e.s, name)
+	if err != nil {
+		return fmt.Errorf("cannot write the manifest: %w", err)
+	}
+	enc, err := e.cipher.Encrypt(w)
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("cannot write the manifest: %w", err)
+	}
+	if _, err := enc.Write(data); err != nil {
+		w.Abort()
+		return fmt.Errorf("cannot write the manifest: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		w.Abort()
+		return fmt.Errorf("cannot write the manifest: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot write the manifest: %w", err)
+	}
+	return nil
+}
+
+// Manifest returns the files described by the saved manifests, by name. The later manifests
+// override the earlier ones. Reading the manifests requires a cipher able to decrypt them
+func (e *Encrypted) Manifest() (map[string]ManifestEntry, error) {
+	entries := map[string]ManifestEntry{}
+	files, err := e.s.List(manifestsFolder)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the manifests: %w", err)
+	}
+	for _, fi := range files {
+		if fi.IsDir || path.Ext(fi.Name) != ".json" {
+			continue
+		}
+		m, err := e.readManifest(path.Join(manifestsFolder, fi.Name))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the manifest %s: %w", fi.Name, err)
+		}
+		for _, entry := range m.Files {
+			entries[entry.Name] = *entry
+		}
+	}
+	return entries, nil
+}
+
+func (e *Encrypted) readManifest(name string) (*manifest, error) {
+	r, err := e.s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	d, err := e.cipher.Decrypt(r)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.NewDecoder(d).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
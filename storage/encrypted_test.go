@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tommyblue/smugmug-backup/crypt"
+)
+
+func TestEncrypted(t *testing.T) {
+	c, err := crypt.NewPassphrase("secret", &crypt.KeyParams{Salt: []byte("0123456789abcdef"), N: 1 << 10, R: 8, P: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := crypt.NewNames(c.NamesSecret())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, names := range map[string]*crypt.Names{"plain names": nil, "encrypted names": names} {
+		t.Run(name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			inner := NewFs(fs)
+			s := NewEncrypted(inner, c, names)
+
+			content := bytes.Repeat([]byte("image "), 20_000)
+			if err := s.MkdirAll("album"); err != nil {
+				t.Fatalf("mkdir: %v", err)
+			}
+			w, err := CreateAtomic(s, "album/img.jpg")
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			if _, err := w.Write(content); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+			mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			if err := s.Chtimes("album/img.jpg", time.Now(), mtime); err != nil {
+				t.Fatalf("chtimes: %v", err)
+			}
+
+			// The underlying storage has only the encrypted content
+			stored := s.stored("album/img.jpg")
+			if (names != nil) == (stored == "album/img.jpg") {
+				t.Fatalf("unexpected stored name %s", stored)
+			}
+			raw, err := afero.ReadFile(fs, stored)
+			if err != nil || bytes.Contains(raw, []byte("image")) {
+				t.Fatalf("want encrypted content, got %d bytes, %v", len(raw), err)
+			}
+
+			fi, err := s.Stat("album/img.jpg")
+			if err != nil || fi.Size != int64(len(content)) || fi.Name != "img.jpg" || !fi.ModTime.Equal(mtime) {
+				t.Fatalf("unexpected file info %+v, %v", fi, err)
+			}
+			r, err := s.Open("album/img.jpg")
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("decrypted %d bytes, %v", len(got), err)
+			}
+
+			if _, err := s.Append("album/img.jpg"); !errors.Is(err, errors.ErrUnsupported) {
+				t.Fatalf("append: want ErrUnsupported, got %v", err)
+			}
+
+			if err := s.Flush(); err != nil {
+				t.Fatalf("flush: %v", err)
+			}
+			files, err := s.List("")
+			if err != nil || len(files) != 1 || files[0].Name != "album" || !files[0].IsDir {
+				t.Fatalf("want only the album, got %+v, %v", files, err)
+			}
+			files, err = s.List("album")
+			if err != nil || len(files) != 1 || files[0].Name != "img.jpg" || files[0].Size != int64(len(content)) {
+				t.Fatalf("unexpected files %+v, %v", files, err)
+			}
+
+			sum := md5.Sum(content)
+			m, err := s.Manifest()
+			if err != nil {
+				t.Fatalf("manifest: %v", err)
+			}
+			want := ManifestEntry{Name: "album/img.jpg", Stored: stored, Size: int64(len(content)), MD5: hex.EncodeToString(sum[:]), ModTime: mtime}
+			if len(m) != 1 || m["album/img.jpg"] != want {
+				t.Fatalf("unexpected manifest %+v", m)
+			}
+
+			// A later manifest overrides the earlier ones
+			if err := s.Rename("album/img.jpg", "album/renamed.jpg"); err != nil {
+				t.Fatalf("rename: %v", err)
+			}
+			w, _ = CreateAtomic(s, "album/img.jpg")
+			io.WriteString(w, "new")
+			w.Close()
+			if err := s.Flush(); err != nil {
+				t.Fatalf("flush: %v", err)
+			}
+			m, err = s.Manifest()
+			if err != nil || len(m) != 1 || m["album/img.jpg"].Size != 3 {
+				t.Fatalf("unexpected manifest %+v, %v", m, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Fs is a Storage saving the files on an afero filesystem
+type Fs struct {
+	fs afero.Fs
+}
+
+// NewFs returns a Storage saving the files on the given filesystem, e.g. an afero.MemMapFs in
+// the tests
+func NewFs(fs afero.Fs) *Fs {
+	return &Fs{fs: fs}
+}
+
+// NewLocal returns a Storage saving the files in the root folder of the local filesystem
+func NewLocal(root string) *Fs {
+	return NewFs(afero.NewBasePathFs(afero.NewOsFs(), root))
+}
+
+func (s *Fs) path(name string) string {
+	return filepath.FromSlash(name)
+}
+
+func fileInfo(fi fs.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+	}
+}
+
+func (s *Fs) Stat(name string) (FileInfo, error) {
+	fi, err := s.fs.Stat(s.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return fileInfo(fi), nil
+}
+
+func (s *Fs) Open(name string) (io.ReadCloser, error) {
+	return s.fs.Open(s.path(name))
+}
+
+func (s *Fs) Create(name string) (io.WriteCloser, error) {
+	return s.fs.Create(s.path(name))
+}
+
+func (s *Fs) Append(name string) (io.WriteCloser, error) {
+	return s.fs.OpenFile(s.path(name), os.O_APPEND|os.O_WRONLY, 0)
+}
+
+func (s *Fs) Truncate(name string, size int64) error {
+	f, err := s.fs.OpenFile(s.path(name), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// realPath returns the path of the named file on the local filesystem, if the storage is on it
+func (s *Fs) realPath(name string) (string, error) {
+	switch fs := s.fs.(type) {
+	case *afero.BasePathFs:
+		return fs.RealPath(s.path(name))
+	case *afero.OsFs:
+		return s.path(name), nil
+	}
+	return "", errors.ErrUnsupported
+}
+
+func (s *Fs) Link(oldname, newname string) error {
+	oldpath, err := s.realPath(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	newpath, err := s.realPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	return os.Link(oldpath, newpath)
+}
+
+func (s *Fs) Symlink(target, newname string) error {
+	newpath, err := s.realPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: newname, Err: err}
+	}
+	return os.Symlink(filepath.FromSlash(target), newpath)
+}
+
+func (s *Fs) Readlink(name string) (string, error) {
+	p, err := s.realPath(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	target, err := os.Readlink(p)
+	return filepath.ToSlash(target), err
+}
+
+func (s *Fs) SameFile(name1, name2 string) (bool, error) {
+	fi1, err := s.fs.Stat(s.path(name1))
+	if err != nil {
+		return false, err
+	}
+	fi2, err := s.fs.Stat(s.path(name2))
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi1, fi2), nil
+}
+
+// Clone creates a reflink of oldname, if supported by the local filesystem
+func (s *Fs) Clone(oldname, newname string) error {
+	oldpath, err := s.realPath(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "clone", Old: oldname, New: newname, Err: err}
+	}
+	newpath, err := s.realPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "clone", Old: oldname, New: newname, Err: err}
+	}
+	if err := clone(oldpath, newpath); err != nil {
+		return &os.LinkError{Op: "clone", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (s *Fs) Rename(oldname, newname string) error {
+	return s.fs.Rename(s.path(oldname), s.path(newname))
+}
+
+func (s *Fs) Remove(name string) error {
+	return s.fs.Remove(s.path(name))
+}
+
+func (s *Fs) MkdirAll(name string) error {
+	return s.fs.MkdirAll(s.path(name), os.ModePerm)
+}
+
+func (s *Fs) Chtimes(name string, atime, mtime time.Time) error {
+	return s.fs.Chtimes(s.path(name), atime, mtime)
+}
+
+func (s *Fs) List(name string) ([]FileInfo, error) {
+	infos, err := afero.ReadDir(s.fs, s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]FileInfo, 0, len(infos))
+	for _, fi := range infos {
+		files = append(files, fileInfo(fi))
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
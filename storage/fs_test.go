@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestFs(t *testing.T) {
+	stores := map[string]Storage{
+		"local":  NewLocal(t.TempDir()),
+		"memory": NewFs(afero.NewMemMapFs()),
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) { testStorage(t, s) })
+	}
+}
+
+// testStorage tests the operations of the Storage interface
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+
+	if _, err := s.Stat("album/img.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("want ErrNotExist, got %v", err)
+	}
+	if err := s.MkdirAll("album/sub"); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	write := func(w io.WriteCloser, err error, content string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("cannot open writer: %v", err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatalf("cannot write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("cannot close: %v", err)
+		}
+	}
+	w, err := s.Create("album/img.jpg.part")
+	write(w, err, "12345")
+	w, err = s.Append("album/img.jpg.part")
+	write(w, err, "678")
+	if err := s.Rename("album/img.jpg.part", "album/img.jpg"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	r, err := s.Open("album/img.jpg")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	content, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(content) != "12345678" {
+		t.Fatalf("unexpected content %q, %v", content, err)
+	}
+	if _, err := s.Open("album/missing.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open missing file: want ErrNotExist, got %v", err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := s.Chtimes("album/img.jpg", time.Now(), mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	fi, err := s.Stat("album/img.jpg")
+	if err != nil || fi.Size != 8 || !fi.ModTime.Equal(mtime) || fi.IsDir {
+		t.Fatalf("unexpected file info %+v, %v", fi, err)
+	}
+
+	files, err := s.List("album")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(files) != 2 || files[0].Name != "img.jpg" || files[1].Name != "sub" || !files[1].IsDir {
+		t.Fatalf("unexpected files %+v", files)
+	}
+
+	if tr, ok := s.(Truncater); ok {
+		if err := tr.Truncate("album/img.jpg", 3); err != nil {
+			t.Fatalf("truncate: %v", err)
+		}
+		if fi, err := s.Stat("album/img.jpg"); err != nil || fi.Size != 3 {
+			t.Fatalf("want truncated file, got %+v, %v", fi, err)
+		}
+	}
+
+	if l, ok := s.(Linker); ok {
+		err := l.Link("album/img.jpg", "album/sub/link.jpg")
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			t.Fatalf("link: %v", err)
+		}
+		if err == nil {
+			if err := l.Symlink("sub", "album/latest"); err != nil {
+				t.Fatalf("symlink: %v", err)
+			}
+			want, _ := s.Stat("album/img.jpg")
+			if fi, err := s.Stat("album/latest/link.jpg"); err != nil || fi.Size != want.Size {
+				t.Fatalf("want linked file, got %+v, %v", fi, err)
+			}
+			if target, err := l.Readlink("album/latest"); err != nil || target != "sub" {
+				t.Fatalf("readlink: want sub, got %q, %v", target, err)
+			}
+			if same, err := l.SameFile("album/img.jpg", "album/sub/link.jpg"); !same && !errors.Is(err, errors.ErrUnsupported) {
+				t.Fatalf("samefile: want same file, got %v", err)
+			}
+			s.Remove("album/latest")
+			s.Remove("album/sub/link.jpg")
+		}
+	}
+
+	if err := s.Remove("album/img.jpg"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := s.Append("album/img.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("append to missing file: want ErrNotExist, got %v", err)
+	}
+}
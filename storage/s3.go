@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// DefaultS3PartSize is the size of the parts of the multipart uploads used when no other is set
+const DefaultS3PartSize = 16 << 20
+
+// s3MaxCopySize is the max size of the objects copied with a single request
+const s3MaxCopySize = 5 << 30
+
+// User metadata of the objects, the keys are stored as x-amz-meta-<key>
+const (
+	s3MetaMD5   = "Md5"   // Hex MD5 of the content, the ETag of multipart uploads isn't the MD5
+	s3MetaMtime = "Mtime" // Modification time set by Chtimes, in RFC3339 format
+)
+
+// S3 is a Storage saving the files as objects of an S3 compatible bucket (AWS S3, MinIO, etc.).
+//
+// Folders don't exist on S3: MkdirAll does nothing and a folder exists if it contains objects.
+// The objects are uploaded with multipart uploads as they are written, the MD5 of the content
+// and the modification times are stored as user metadata. The MD5 set on the writers with SetMD5
+// is stored with the upload, saving a copy of the object to add it later (see MD5Setter)
+type S3 struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64
+}
+
+// NewS3 returns a Storage saving the files in the bucket, with names prefixed by prefix (e.g.
+// "backups/smugmug"). The files are uploaded in parts of partSize bytes, DefaultS3PartSize if 0.
+// S3 requires parts of at least 5MB
+func NewS3(client *minio.Client, bucket, prefix string, partSize int64) *S3 {
+	if partSize <= 0 {
+		partSize = DefaultS3PartSize
+	}
+	return &S3{
+		client:   client,
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		partSize: uint64(partSize),
+	}
+}
+
+// key returns the name of the object storing the named file
+func (s *S3) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, name), "/")
+}
+
+// notExist converts the errors of missing objects to errors matching fs.ErrNotExist
+func notExist(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	resp := minio.ToErrorResponse(err)
+	if resp.StatusCode == http.StatusNotFound || resp.Code == "NoSuchKey" {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return fmt.Errorf("%s %s: %w", op, name, err)
+}
+
+func (s *S3) Stat(name string) (FileInfo, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	obj, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err == nil {
+		return s.fileInfo(obj), nil
+	}
+	err = notExist("stat", name, err)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return FileInfo{}, err
+	}
+
+	// It can be a folder, if it contains objects
+	opts := minio.ListObjectsOptions{Prefix: s.key(name) + "/", MaxKeys: 1}
+	for obj := range s.client.ListObjects(ctx, s.bucket, opts) {
+		if obj.Err != nil {
+			return FileInfo{}, notExist("stat", name, obj.Err)
+		}
+		return FileInfo{Name: path.Base(name), IsDir: true}, nil
+	}
+	return FileInfo{}, err
+}
+
+func (s *S3) fileInfo(obj minio.ObjectInfo) FileInfo {
+	fi := FileInfo{
+		Name:    path.Base(obj.Key),
+		Size:    obj.Size,
+		ModTime: obj.LastModified,
+		MD5:     obj.UserMetadata[s3MetaMD5],
+	}
+	if mtime, err := time.Parse(time.RFC3339Nano, obj.UserMetadata[s3MetaMtime]); err == nil {
+		fi.ModTime = mtime
+	}
+	// The ETag of the objects uploaded in a single part is the MD5 of the content
+	if etag := strings.Trim(obj.ETag, `"`); fi.MD5 == "" && len(etag) == 32 && !strings.Contains(etag, "-") {
+		fi.MD5 = etag
+	}
+	return fi
+}
+
+func (s *S3) Open(name string) (io.ReadCloser, error) {
+	ctx := context.Background()
+	// GetObject returns the errors only when reading, the object is checked first
+	obj, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, notExist("open", name, err)
+	}
+	opts := minio.GetObjectOptions{}
+	opts.SetMatchETag(obj.ETag)
+	r, err := s.client.GetObject(ctx, s.bucket, s.key(name), opts)
+	if err != nil {
+		return nil, notExist("open", name, err)
+	}
+	return r, nil
+}
+
+func (s *S3) Create(name string) (io.WriteCloser, error) {
+	return &s3Writer{s: s, name: name}, nil
+}
+
+// CreateAtomic returns a writer of the named file, the object is replaced only when the upload
+// completes on Close
+func (s *S3) CreateAtomic(name string) (AtomicWriter, error) {
+	return &s3Writer{s: s, name: name}, nil
+}
+
+// Append rewrites the object with the new content appended, S3 objects can't be modified
+func (s *S3) Append(name string) (io.WriteCloser, error) {
+	ctx := context.Background()
+	if _, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{}); err != nil {
+		return nil, notExist("append", name, err)
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, notExist("append", name, err)
+	}
+	w := &s3Writer{s: s, name: name, head: obj}
+	w.start()
+	return w, nil
+}
+
+// s3Writer uploads a file as it's written. The content is buffered until it reaches the part
+// size: smaller files are uploaded with a single request on Close, bigger ones are streamed with
+// a multipart upload
+type s3Writer struct {
+	s    *S3
+	name string
+	head io.ReadCloser // Content preceding the written bytes, if not nil
+	buf  bytes.Buffer
+	md5  string // Expected MD5 of the content, stored in the metadata of the object if set
+
+	pw   *io.PipeWriter // Set once the multipart upload has started
+	done chan error
+
+	closed bool
+	err    error
+}
+
+// SetMD5 sets the expected MD5 of the content, stored in the metadata when the upload starts
+func (w *s3Writer) SetMD5(md5 string) {
+	w.md5 = md5
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.pw != nil {
+		return w.pw.Write(p)
+	}
+	n, _ := w.buf.Write(p)
+	if uint64(w.buf.Len()) >= w.s.partSize {
+		w.start()
+	}
+	return n, nil
+}
+
+// start starts the multipart upload of the buffered content followed by the next writes
+func (w *s3Writer) start() {
+	pr, pw := io.Pipe()
+	w.pw = pw
+	w.done = make(chan error, 1)
+
+	body := io.MultiReader(&w.buf, pr)
+	if w.head != nil {
+		body = io.MultiReader(w.head, body)
+	}
+	go func() {
+		err := w.s.put(w.name, body, -1, w.md5)
+		pr.CloseWithError(err)
+		if w.head != nil {
+			w.head.Close()
+		}
+		w.done <- err
+	}()
+}
+
+// Close completes the upload, returning its error
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.pw == nil {
+		w.err = w.s.put(w.name, &w.buf, int64(w.buf.Len()), w.md5)
+		return w.err
+	}
+	w.pw.Close()
+	w.err = <-w.done
+	return w.err
+}
+
+// errAborted interrupts the uploads of the aborted writers
+var errAborted = errors.New("upload aborted")
+
+// Abort interrupts the upload, the parts already uploaded are discarded
+func (w *s3Writer) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.err = errAborted
+	if w.pw != nil {
+		w.pw.CloseWithError(errAborted)
+		<-w.done
+	}
+}
+
+// put uploads the content of the named file. The expected MD5, if not empty, is stored in the
+// metadata with the upload. Otherwise, or if it's wrong, the MD5 is added to the metadata after
+// the upload when the ETag isn't the MD5 (multipart uploads). size can be -1 if unknown
+func (s *S3) put(name string, body io.Reader, size int64, wantMD5 string) error {
+	opts := minio.PutObjectOptions{PartSize: s.partSize}
+	if wantMD5 != "" {
+		opts.UserMetadata = map[string]string{s3MetaMD5: strings.ToLower(wantMD5)}
+	}
+	hash := md5.New()
+	info, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), io.TeeReader(body, hash), size, opts)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", name, err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if wantMD5 != "" && !strings.EqualFold(wantMD5, sum) || wantMD5 == "" && strings.Trim(info.ETag, `"`) != sum {
+		return s.setMetadata(name, map[string]string{s3MetaMD5: sum})
+	}
+	return nil
+}
+
+// copy copies the object of src to dst. If meta isn't nil, it replaces the user metadata of the
+// object, otherwise the metadata is copied too
+func (s *S3) copy(src, dst string, meta map[string]string) error {
+	ctx := context.Background()
+	obj, err := s.client.StatObject(ctx, s.bucket, s.key(src), minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+	dstOpts := minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(dst), UserMetadata: meta, ReplaceMetadata: meta != nil}
+	srcOpts := minio.CopySrcOptions{Bucket: s.bucket, Object: s.key(src), MatchETag: obj.ETag}
+	if obj.Size <= s3MaxCopySize {
+		_, err = s.client.CopyObject(ctx, dstOpts, srcOpts)
+	} else {
+		// Bigger objects are copied in parts
+		_, err = s.client.ComposeObject(ctx, dstOpts, srcOpts)
+	}
+	return err
+}
+
+// setMetadata adds the given user metadata to the named file, copying the object onto itself
+// unless it already has the same values
+func (s *S3) setMetadata(name string, meta map[string]string) error {
+	obj, err := s.client.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return notExist("metadata", name, err)
+	}
+	merged := make(map[string]string, len(obj.UserMetadata)+len(meta))
+	for k, v := range obj.UserMetadata {
+		merged[k] = v
+	}
+	changed := false
+	for k, v := range meta {
+		changed = changed || merged[k] != v
+		merged[k] = v
+	}
+	if !changed {
+		return nil
+	}
+	if err := s.copy(name, name, merged); err != nil {
+		return notExist("metadata", name, err)
+	}
+	return nil
+}
+
+// Rename copies the object to the new name, keeping its metadata, and removes the old one
+func (s *S3) Rename(oldname, newname string) error {
+	if err := s.copy(oldname, newname, nil); err != nil {
+		return notExist("rename", oldname, err)
+	}
+	return s.Remove(oldname)
+}
+
+func (s *S3) Remove(name string) error {
+	err := s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+	return notExist("remove", name, err)
+}
+
+// MkdirAll does nothing, folders don't exist on S3
+func (s *S3) MkdirAll(string) error {
+	return nil
+}
+
+// Chtimes stores the modification time in the metadata of the object, the access time is ignored.
+// The object is copied only if its modification time changes
+func (s *S3) Chtimes(name string, _, mtime time.Time) error {
+	return s.setMetadata(name, map[string]string{s3MetaMtime: mtime.UTC().Format(time.RFC3339Nano)})
+}
+
+func (s *S3) List(name string) ([]FileInfo, error) {
+	prefix := s.key(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var files []FileInfo
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, notExist("list", name, obj.Err)
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			files = append(files, FileInfo{Name: path.Base(obj.Key), IsDir: true})
+			continue
+		}
+		files = append(files, s.fileInfo(obj))
+	}
+	if len(files) == 0 && prefix != "" {
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
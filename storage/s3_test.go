@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	meta     http.Header
+	modified time.Time
+}
+
+// fakeS3 implements the subset of the S3 API used by the S3 storage, for a single bucket
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]*fakeObject
+	uploads map[string]map[int][]byte
+	puts    int // Number of objects uploaded, including the multipart uploads
+	copies  int // Number of objects copied, including the copies onto themselves
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string]*fakeObject{}, uploads: map[string]map[int][]byte{}}
+}
+
+func userMeta(h http.Header) http.Header {
+	meta := http.Header{}
+	for k, v := range h {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+// readBody returns the content of the request, decoding the aws-chunked encoding
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var out bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(strings.SplitN(line, ";", 2)[0]), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		if _, err := io.CopyN(&out, br, size); err != nil {
+			return nil, err
+		}
+		br.ReadString('\n')
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(p, "/")
+	if bucket != f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, q.Get("prefix"), q.Get("delimiter"))
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		obj, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>`, key)
+			}
+			return
+		}
+		for k, v := range obj.meta {
+			w.Header()[k] = v
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Last-Modified", obj.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{0: nil}
+		// The metadata is kept with the part 0, that has no data
+		f.objects["\x00"+id] = &fakeObject{meta: userMeta(r.Header)}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, bucket, key, id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = data
+		sum := md5.Sum(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		id := q.Get("uploadId")
+		parts := f.uploads[id]
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		sums := md5.New()
+		for _, n := range numbers {
+			if n == 0 {
+				continue
+			}
+			data = append(data, parts[n]...)
+			sum := md5.Sum(parts[n])
+			sums.Write(sum[:])
+		}
+		etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sums.Sum(nil)), len(numbers)-1)
+		f.objects[key] = &fakeObject{data: data, etag: etag, meta: f.objects["\x00"+id].meta, modified: time.Now()}
+		delete(f.objects, "\x00"+id)
+		delete(f.uploads, id)
+		f.puts++
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>`, bucket, key, etag)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+		obj, ok := f.objects[srcKey]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>`, srcKey)
+			return
+		}
+		meta := obj.meta
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			meta = userMeta(r.Header)
+		}
+		f.objects[key] = &fakeObject{data: obj.data, etag: obj.etag, meta: meta, modified: time.Now()}
+		f.copies++
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>`, obj.etag, time.Now().UTC().Format(time.RFC3339))
+	case r.Method == http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sum := md5.Sum(data)
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		f.objects[key] = &fakeObject{data: data, etag: etag, meta: userMeta(r.Header), modified: time.Now()}
+		f.puts++
+		w.Header().Set("ETag", etag)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{Name: f.bucket, Prefix: prefix}
+
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) || strings.HasPrefix(k, "\x00") {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			cp := prefix + rest[:i+1]
+			if !seen[cp] {
+				seen[cp] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{cp})
+			}
+			continue
+		}
+		obj := f.objects[k]
+		result.Contents = append(result.Contents, content{k, obj.modified.UTC().Format(time.RFC3339), obj.etag, len(obj.data)})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3(t *testing.T) (*S3, *fakeS3) {
+	t.Helper()
+	fake := newFakeS3("bucket")
+	srv := httptest.NewTLSServer(fake)
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+	c, err := minio.New(u.Host, &minio.Options{
+		Creds:     credentials.NewStaticV4("access", "secret", ""),
+		Secure:    true,
+		Region:    "us-east-1",
+		Transport: srv.Client().Transport,
+	})
+	if err != nil {
+		t.Fatalf("cannot create the client: %v", err)
+	}
+	return NewS3(c, "bucket", "/backups/", 5<<20), fake
+}
+
+func TestS3(t *testing.T) {
+	s, fake := newTestS3(t)
+
+	if _, err := s.Stat("album/img.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("want ErrNotExist, got %v", err)
+	}
+
+	// Small files are uploaded with a single request, bigger ones with a multipart upload
+	small := []byte("small image")
+	big := bytes.Repeat([]byte("0123456789"), 600_000)
+	for name, content := range map[string][]byte{"album/img.jpg": small, "album/sub/video.mp4": big} {
+		w, err := s.Create(name + ".part")
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if err := s.Rename(name+".part", name); err != nil {
+			t.Fatalf("rename: %v", err)
+		}
+
+		fi, err := s.Stat(name)
+		sum := md5.Sum(content)
+		if err != nil || fi.Size != int64(len(content)) || fi.MD5 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("%s: unexpected file info %+v, %v", name, fi, err)
+		}
+		if _, ok := fake.objects["backups/"+name]; !ok {
+			t.Fatalf("%s: object not found", name)
+		}
+	}
+	if fake.puts != 2 {
+		t.Fatalf("want 2 uploads, got %d", fake.puts)
+	}
+	if etag := fake.objects["backups/album/sub/video.mp4"].etag; !strings.HasSuffix(etag, `-2"`) {
+		t.Fatalf("want a multipart upload, got ETag %s", etag)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := s.Chtimes("album/sub/video.mp4", time.Now(), mtime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	fi, err := s.Stat("album/sub/video.mp4")
+	if err != nil || !fi.ModTime.Equal(mtime) || fi.MD5 == "" {
+		t.Fatalf("unexpected file info %+v, %v", fi, err)
+	}
+
+	w, err := s.Append("album/img.jpg")
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	io.WriteString(w, " appended")
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got := string(fake.objects["backups/album/img.jpg"].data); got != "small image appended" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	r, err := s.Open("album/img.jpg")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	content, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(content) != "small image appended" {
+		t.Fatalf("unexpected content %q, %v", content, err)
+	}
+	if _, err := s.Open("album/missing.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open missing file: want ErrNotExist, got %v", err)
+	}
+	if _, err := s.Append("album/missing.csv"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("append to missing file: want ErrNotExist, got %v", err)
+	}
+
+	if fi, err := s.Stat("album/sub"); err != nil || !fi.IsDir {
+		t.Fatalf("want folder, got %+v, %v", fi, err)
+	}
+	files, err := s.List("album")
+	if err != nil || len(files) != 2 || files[0].Name != "img.jpg" || !files[1].IsDir {
+		t.Fatalf("unexpected files %+v, %v", files, err)
+	}
+	if _, err := s.List("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("list missing folder: want ErrNotExist, got %v", err)
+	}
+
+	if err := s.Remove("album/img.jpg"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := s.Stat("album/img.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("want ErrNotExist after remove, got %v", err)
+	}
+}
+
+func TestS3CreateAtomic(t *testing.T) {
+	s, fake := newTestS3(t)
+	big := bytes.Repeat([]byte("0123456789"), 600_000)
+
+	for _, content := range [][]byte{[]byte("small image"), big} {
+		// An aborted upload leaves the existing object unchanged
+		fake.objects["backups/album/img.jpg"] = &fakeObject{data: []byte("old"), etag: `"old"`}
+		w, err := s.CreateAtomic("album/img.jpg")
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		w.Abort()
+		if got := string(fake.objects["backups/album/img.jpg"].data); got != "old" {
+			t.Fatalf("aborted upload replaced the object with %d bytes", len(got))
+		}
+		if len(fake.uploads) != 0 {
+			t.Fatalf("want the multipart uploads aborted, %d pending", len(fake.uploads))
+		}
+
+		w, err = s.CreateAtomic("album/img.jpg")
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		if got := fake.objects["backups/album/img.jpg"].data; !bytes.Equal(got, content) {
+			t.Fatalf("unexpected content of %d bytes", len(got))
+		}
+	}
+}
+
+func TestS3Metadata(t *testing.T) {
+	s, fake := newTestS3(t)
+	big := bytes.Repeat([]byte("0123456789"), 600_000)
+	sum := md5.Sum(big)
+	want := hex.EncodeToString(sum[:])
+
+	// The MD5 set before writing is stored with the multipart upload, without copies. A wrong
+	// one is corrected
+	for _, tt := range []struct {
+		md5    string
+		copies int
+	}{
+		{md5: strings.ToUpper(want), copies: 0},
+		{md5: "0123456789abcdef0123456789abcdef", copies: 1},
+	} {
+		fake.copies = 0
+		w, err := s.CreateAtomic("album/video.mp4")
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		w.(MD5Setter).SetMD5(tt.md5)
+		w.Write(big)
+		if err := w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		fi, err := s.Stat("album/video.mp4")
+		if err != nil || fi.MD5 != want {
+			t.Fatalf("unexpected file info %+v, %v", fi, err)
+		}
+		if fake.copies != tt.copies {
+			t.Fatalf("%s: want %d copies, got %d", tt.md5, tt.copies, fake.copies)
+		}
+	}
+
+	// Setting the same modification time again doesn't copy the object
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake.copies = 0
+	for range 2 {
+		if err := s.Chtimes("album/video.mp4", time.Now(), mtime); err != nil {
+			t.Fatalf("chtimes: %v", err)
+		}
+	}
+	if fake.copies != 1 {
+		t.Fatalf("want 1 copy, got %d", fake.copies)
+	}
+	if fi, err := s.Stat("album/video.mp4"); err != nil || !fi.ModTime.Equal(mtime) || fi.MD5 != want {
+		t.Fatalf("unexpected file info %+v, %v", fi, err)
+	}
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpPosixRename is the extension of the OpenSSH servers replacing the existing files on rename
+const sftpPosixRename = "posix-rename@openssh.com"
+
+// sftpHardlink is the extension of the OpenSSH servers creating hard links
+const sftpHardlink = "hardlink@openssh.com"
+
+// SFTP is a Storage saving the files on a remote server over SFTP, e.g. a NAS reachable with SSH.
+//
+// The files are written as they are received, pipelining the writes to hide the latency of the
+// connection
+type SFTP struct {
+	client      *sftp.Client
+	root        string
+	posixRename bool
+}
+
+// NewSFTP returns a Storage saving the files in the root folder of the server (e.g.
+// "/volume1/backups"), relative to the home of the user if not absolute. The client is owned by
+// the caller, that closes it when the storage isn't used anymore
+func NewSFTP(client *sftp.Client, root string) *SFTP {
+	if root == "" {
+		root = "."
+	}
+	_, posixRename := client.HasExtension(sftpPosixRename)
+	return &SFTP{client: client, root: root, posixRename: posixRename}
+}
+
+func (s *SFTP) path(name string) string {
+	return path.Join(s.root, name)
+}
+
+// sftpError wraps the errors of the server with the operation and the name, converting the
+// errors of missing files to errors matching fs.ErrNotExist
+func sftpError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var status *sftp.StatusError
+	if errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxNoSuchFile {
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (s *SFTP) Stat(name string) (FileInfo, error) {
+	fi, err := s.client.Stat(s.path(name))
+	if err != nil {
+		return FileInfo{}, sftpError("stat", name, err)
+	}
+	return fileInfo(fi), nil
+}
+
+func (s *SFTP) Open(name string) (io.ReadCloser, error) {
+	f, err := s.client.Open(s.path(name))
+	if err != nil {
+		return nil, sftpError("open", name, err)
+	}
+	return f, nil
+}
+
+func (s *SFTP) Create(name string) (io.WriteCloser, error) {
+	f, err := s.client.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, sftpError("create", name, err)
+	}
+	return sftpWriter{f}, nil
+}
+
+func (s *SFTP) Append(name string) (io.WriteCloser, error) {
+	f, err := s.client.OpenFile(s.path(name), os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return nil, sftpError("append", name, err)
+	}
+	// Not all the servers honor the append flag, the writes start from the current size
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, sftpError("append", name, err)
+	}
+	return sftpWriter{f}, nil
+}
+
+// sftpWriter writes a remote file. io.Copy sends the content with concurrent requests, without
+// waiting for the acknowledgment of each packet before sending the next one
+type sftpWriter struct {
+	*sftp.File
+}
+
+func (w sftpWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.File.ReadFromWithConcurrency(r, 0)
+}
+
+// Rename replaces newname atomically if the server supports the posix-rename extension
+// (OpenSSH), otherwise newname is removed before renaming
+func (s *SFTP) Rename(oldname, newname string) error {
+	if s.posixRename {
+		return sftpError("rename", oldname, s.client.PosixRename(s.path(oldname), s.path(newname)))
+	}
+	if err := sftpError("rename", newname, s.client.Remove(s.path(newname))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return sftpError("rename", oldname, s.client.Rename(s.path(oldname), s.path(newname)))
+}
+
+// Link requires the hardlink extension of the OpenSSH servers
+func (s *SFTP) Link(oldname, newname string) error {
+	if _, ok := s.client.HasExtension(sftpHardlink); !ok {
+		return &fs.PathError{Op: "link", Path: newname, Err: errors.ErrUnsupported}
+	}
+	return sftpError("link", newname, s.client.Link(s.path(oldname), s.path(newname)))
+}
+
+func (s *SFTP) Symlink(target, newname string) error {
+	return sftpError("symlink", newname, s.client.Symlink(target, s.path(newname)))
+}
+
+func (s *SFTP) Readlink(name string) (string, error) {
+	target, err := s.client.ReadLink(s.path(name))
+	return target, sftpError("readlink", name, err)
+}
+
+// SameFile isn't supported, the SFTP protocol doesn't expose the inodes of the files
+func (s *SFTP) SameFile(name1, name2 string) (bool, error) {
+	return false, &fs.PathError{Op: "samefile", Path: name2, Err: errors.ErrUnsupported}
+}
+
+func (s *SFTP) Truncate(name string, size int64) error {
+	return sftpError("truncate", name, s.client.Truncate(s.path(name), size))
+}
+
+func (s *SFTP) Remove(name string) error {
+	return sftpError("remove", name, s.client.Remove(s.path(name)))
+}
+
+func (s *SFTP) MkdirAll(name string) error {
+	return sftpError("mkdir", name, s.client.MkdirAll(s.path(name)))
+}
+
+func (s *SFTP) Chtimes(name string, atime, mtime time.Time) error {
+	return sftpError("chtimes", name, s.client.Chtimes(s.path(name), atime, mtime))
+}
+
+func (s *SFTP) List(name string) ([]FileInfo, error) {
+	entries, err := s.client.ReadDir(s.path(name))
+	if err != nil {
+		return nil, sftpError("list", name, err)
+	}
+	files := make([]FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		files = append(files, fileInfo(fi))
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
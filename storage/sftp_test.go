@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/tommyblue/smugmug-backup/testutil"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSFTP(t *testing.T) (*SFTP, string) {
+	t.Helper()
+	srv := testutil.NewSSHServer(t)
+	conn, err := ssh.Dial("tcp", srv.Addr, &ssh.ClientConfig{
+		User:            "backup",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(srv.ClientKey)},
+		HostKeyCallback: ssh.FixedHostKey(srv.HostKey),
+	})
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("cannot start sftp: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	root := t.TempDir()
+	return NewSFTP(c, filepath.ToSlash(root)), root
+}
+
+func TestSFTP(t *testing.T) {
+	s, root := newTestSFTP(t)
+	testStorage(t, s)
+
+	// Big files are written with concurrent requests by io.Copy, also from readers of unknown
+	// size like the downloads
+	content := bytes.Repeat([]byte("0123456789"), 100_000)
+	for _, posixRename := range []bool{true, false} {
+		s.posixRename = posixRename
+		w, err := s.Create("album/video.mp4.part")
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := io.Copy(w, io.MultiReader(bytes.NewReader(content))); err != nil {
+			t.Fatalf("copy: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		// The second time the rename replaces the existing file, removing it first without the
+		// posix-rename extension
+		if err := s.Rename("album/video.mp4.part", "album/video.mp4"); err != nil {
+			t.Fatalf("rename: %v", err)
+		}
+	}
+	got, err := os.ReadFile(filepath.Join(root, "album", "video.mp4"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("unexpected content of %d bytes, %v", len(got), err)
+	}
+
+	if _, err := s.List("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("list missing folder: want ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Package storage abstracts the destination of the backup, so that the files can be saved on
+different targets.
+
+All the names are slash separated paths relative to the root of the storage, e.g.
+"album/sub-album/image.jpg". Missing files are reported with errors matching fs.ErrNotExist.
+*/
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// FileInfo describes a file or a folder of a Storage
+type FileInfo struct {
+	Name    string    // Base name of the file
+	Size    int64     // Size in bytes
+	ModTime time.Time // Last modification time
+	IsDir   bool      // True for folders
+	MD5     string    // Hex MD5 of the content, if known without reading it (e.g. from the S3 metadata)
+}
+
+// Storage is the destination of the backup
+type Storage interface {
+	// Stat returns the description of the named file
+	Stat(name string) (FileInfo, error)
+	// Open returns a reader of the content of the named file
+	Open(name string) (io.ReadCloser, error)
+	// Create returns a writer to the named file, truncating it if it already exists. The content
+	// is complete only after Close returns without errors
+	Create(name string) (io.WriteCloser, error)
+	// Append returns a writer appending to the named file, that must exist
+	Append(name string) (io.WriteCloser, error)
+	// Rename renames (moves) oldname to newname, replacing it if it already exists
+	Rename(oldname, newname string) error
+	// Remove removes the named file
+	Remove(name string) error
+	// MkdirAll creates the named folder with all the missing parents
+	MkdirAll(name string) error
+	// Chtimes changes the access and modification times of the named file
+	Chtimes(name string, atime, mtime time.Time) error
+	// List returns the content of the named folder, sorted by name
+	List(name string) ([]FileInfo, error)
+}
+
+// AtomicCreator is implemented by the storages creating the files atomically, e.g. S3 where an
+// object appears only once its upload completes. The files can be written directly, without
+// writing a temporary file renamed when complete
+type AtomicCreator interface {
+	// CreateAtomic returns a writer replacing the named file with the written content on Close
+	CreateAtomic(name string) (AtomicWriter, error)
+}
+
+// AtomicWriter is a writer whose content replaces the file only when closed
+type AtomicWriter interface {
+	io.WriteCloser
+	// Abort discards the written content, leaving the file unchanged
+	Abort()
+}
+
+// MD5Setter is implemented by the writers storing the MD5 of the content with the file, e.g. in
+// the metadata of the S3 objects. The MD5 set before writing the content is stored when the file
+// is created, instead of being computed and added afterwards. A wrong MD5 is corrected on Close
+type MD5Setter interface {
+	SetMD5(md5 string)
+}
+
+// Flusher is implemented by the storages keeping state that must be saved at the end of the
+// backup, e.g. the manifest of Encrypted
+type Flusher interface {
+	Flush() error
+}
+
+// Truncater is implemented by the storages able to shrink the files, e.g. to append entries to a
+// tar archive over its end marker
+type Truncater interface {
+	// Truncate changes the size of the named file
+	Truncate(name string, size int64) error
+}
+
+// Linker is implemented by the storages supporting links, e.g. the local filesystem. They may
+// return errors matching errors.ErrUnsupported if the underlying filesystem doesn't support them
+type Linker interface {
+	// Link creates newname as a hard link to the oldname file
+	Link(oldname, newname string) error
+	// Symlink creates newname as a symbolic link to target, relative to the folder of newname
+	Symlink(target, newname string) error
+	// Readlink returns the target of the named symbolic link
+	Readlink(name string) (string, error)
+	// SameFile returns true if the two named files are the same file, e.g. hard links to it
+	SameFile(name1, name2 string) (bool, error)
+}
+
+// Cloner is implemented by the storages able to clone the files, sharing their content until
+// one of them is modified (reflinks), e.g. the local filesystem on Btrfs, XFS or APFS
+type Cloner interface {
+	// Clone creates newname as a clone of the oldname file
+	Clone(oldname, newname string) error
+}
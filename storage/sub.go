@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"path"
+	"time"
+)
+
+// Sub is a Storage saving the files in a folder of another Storage, e.g. a snapshot of the
+// backup
+type Sub struct {
+	s   Storage
+	dir string
+}
+
+// NewSub returns a Storage whose names are relative to the dir folder of s
+func NewSub(s Storage, dir string) *Sub {
+	return &Sub{s: s, dir: dir}
+}
+
+func (s *Sub) path(name string) string {
+	return path.Join(s.dir, name)
+}
+
+func (s *Sub) Stat(name string) (FileInfo, error) {
+	return s.s.Stat(s.path(name))
+}
+
+func (s *Sub) Open(name string) (io.ReadCloser, error) {
+	return s.s.Open(s.path(name))
+}
+
+func (s *Sub) Create(name string) (io.WriteCloser, error) {
+	return s.s.Create(s.path(name))
+}
+
+// CreateAtomic creates the file atomically if s does, otherwise through a temporary file
+func (s *Sub) CreateAtomic(name string) (AtomicWriter, error) {
+	return CreateAtomic(s.s, s.path(name))
+}
+
+func (s *Sub) Append(name string) (io.WriteCloser, error) {
+	return s.s.Append(s.path(name))
+}
+
+func (s *Sub) Truncate(name string, size int64) error {
+	t, ok := s.s.(Truncater)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return t.Truncate(s.path(name), size)
+}
+
+func (s *Sub) Rename(oldname, newname string) error {
+	return s.s.Rename(s.path(oldname), s.path(newname))
+}
+
+func (s *Sub) Remove(name string) error {
+	return s.s.Remove(s.path(name))
+}
+
+func (s *Sub) MkdirAll(name string) error {
+	return s.s.MkdirAll(s.path(name))
+}
+
+func (s *Sub) Chtimes(name string, atime, mtime time.Time) error {
+	return s.s.Chtimes(s.path(name), atime, mtime)
+}
+
+func (s *Sub) List(name string) ([]FileInfo, error) {
+	return s.s.List(s.path(name))
+}
+
+func (s *Sub) Link(oldname, newname string) error {
+	l, ok := s.s.(Linker)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return l.Link(s.path(oldname), s.path(newname))
+}
+
+func (s *Sub) Symlink(target, newname string) error {
+	l, ok := s.s.(Linker)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return l.Symlink(target, s.path(newname))
+}
+
+func (s *Sub) Readlink(name string) (string, error) {
+	l, ok := s.s.(Linker)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+	return l.Readlink(s.path(name))
+}
+
+func (s *Sub) SameFile(name1, name2 string) (bool, error) {
+	l, ok := s.s.(Linker)
+	if !ok {
+		return false, errors.ErrUnsupported
+	}
+	return l.SameFile(s.path(name1), s.path(name2))
+}
+
+func (s *Sub) Clone(oldname, newname string) error {
+	c, ok := s.s.(Cloner)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return c.Clone(s.path(oldname), s.path(newname))
+}
+
+// Flush flushes s, if it's a Flusher
+func (s *Sub) Flush() error {
+	if f, ok := s.s.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestSub(t *testing.T) {
+	testStorage(t, NewSub(NewLocal(t.TempDir()), "snapshots/2026-10-18"))
+
+	fs := afero.NewMemMapFs()
+	s := NewSub(NewFs(fs), "snapshots/2026-10-18")
+	w, _ := CreateAtomic(s, "album/img.jpg")
+	w.Write([]byte("image"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if exists, _ := afero.Exists(fs, "snapshots/2026-10-18/album/img.jpg"); !exists {
+		t.Fatalf("want file in the folder")
+	}
+}
@@ -0,0 +1,122 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHServer is a local SSH server serving the SFTP subsystem on the local filesystem, to test the
+// SFTP destinations. It accepts only the client key
+type SSHServer struct {
+	Addr         string        // Listening address, as "127.0.0.1:port"
+	HostKey      ssh.PublicKey // Host key of the server
+	ClientKey    ssh.Signer    // Key authorized to log in, with any user
+	ClientKeyPEM []byte        // ClientKey in the OpenSSH format
+}
+
+// NewSSHServer starts an SSH server, stopped at the end of the test
+func NewSSHServer(t testing.TB) *SSHServer {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("cannot load host key: %v", err)
+	}
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate client key: %v", err)
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatalf("cannot load client key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatalf("cannot marshal client key: %v", err)
+	}
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized key")
+		},
+	}
+	cfg.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, cfg)
+		}
+	}()
+
+	return &SSHServer{
+		Addr:         ln.Addr().String(),
+		HostKey:      hostSigner.PublicKey(),
+		ClientKey:    clientSigner,
+		ClientKeyPEM: pem.EncodeToMemory(block),
+	}
+}
+
+// serveSSH serves the SFTP subsystem on the sessions of the connection
+func serveSSH(conn net.Conn, cfg *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				// The payload of subsystem requests is the length prefixed name
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 &&
+					int(binary.BigEndian.Uint32(req.Payload)) == len(req.Payload)-4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				srv, err := sftp.NewServer(ch)
+				if err != nil {
+					return
+				}
+				srv.Serve()
+				return
+			}
+		}()
+	}
+}
@@ -0,0 +1,180 @@
+package smugmug
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tommyblue/smugmug-backup/storage"
+)
+
+// versionsFolder contains the previous versions of the replaced images and videos, in the same
+// folders of the backup
+const versionsFolder = ".versions"
+
+// versionTimeLayout is the format of the time a version has been replaced, added to its name
+const versionTimeLayout = "20060102T150405Z"
+
+// versionKeeper moves the files about to be replaced to versionsFolder, removing the versions
+// exceeding the retention
+type versionKeeper struct {
+	store    storage.Storage
+	keepLast int // Max number of versions of each file, 0 means no limit
+	keepDays int // Max age of the versions in days, 0 means no limit
+	now      func() time.Time
+}
+
+func newVersionKeeper(store storage.Storage, keepLast, keepDays int) *versionKeeper {
+	return &versionKeeper{store: store, keepLast: keepLast, keepDays: keepDays, now: time.Now}
+}
+
+// versionName returns the name of the version of the named file replaced at the given time, e.g.
+// ".versions/album/IMG_0001.20261018T100000Z.jpg" for "album/IMG_0001.jpg"
+func versionName(name string, replaced time.Time) string {
+	ext := path.Ext(name)
+	return path.Join(versionsFolder, strings.TrimSuffix(name, ext)+"."+replaced.UTC().Format(versionTimeLayout)+ext)
+}
+
+// parseVersion returns the time the version has been replaced, if file is a version of name
+func parseVersion(name, file string) (time.Time, bool) {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(path.Base(name), ext) + "."
+	if !strings.HasPrefix(file, stem) || !strings.HasSuffix(file, ext) || len(file) != len(stem)+len(versionTimeLayout)+len(ext) {
+		return time.Time{}, false
+	}
+	replaced, err := time.Parse(versionTimeLayout, file[len(stem):len(file)-len(ext)])
+	return replaced, err == nil
+}
+
+// keep saves the named file, if it exists, to the versions folder, then calls replace to write
+// its new content and prunes its versions. The version is a hard link to the file, if the
+// storage supports them, otherwise the file is moved. If replace fails, the file is left as it was
+func (v *versionKeeper) keep(name string, replace func() error) error {
+	if _, err := v.store.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return replace()
+	}
+	version := versionName(name, v.now())
+	if err := v.store.MkdirAll(path.Dir(version)); err != nil {
+		return fmt.Errorf("cannot create the versions folder of %s: %w", name, err)
+	}
+	linked := false
+	if l, ok := v.store.(storage.Linker); ok {
+		linked = l.Link(name, version) == nil
+	}
+	if !linked {
+		if err := v.store.Rename(name, version); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("cannot keep the previous version of %s: %w", name, err)
+		}
+	}
+
+	if err := replace(); err != nil {
+		if linked {
+			v.store.Remove(version)
+		} else if err := v.store.Rename(version, name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.WithError(err).Errorf("cannot restore %s from %s", name, version)
+		}
+		return err
+	}
+	log.Infof("Previous version of %s kept as %s", name, version)
+	return v.prune(name)
+}
+
+// prune removes the versions of the named file exceeding the retention
+func (v *versionKeeper) prune(name string) error {
+	folder := path.Join(versionsFolder, path.Dir(name))
+	files, err := v.store.List(folder)
+	if err != nil {
+		return fmt.Errorf("cannot list the versions of %s: %w", name, err)
+	}
+	type version struct {
+		name     string
+		replaced time.Time
+	}
+	var versions []version
+	for _, fi := range files {
+		if replaced, ok := parseVersion(name, fi.Name); ok && !fi.IsDir {
+			versions = append(versions, version{path.Join(folder, fi.Name), replaced})
+		}
+	}
+	// Newest first
+	sort.Slice(versions, func(i, j int) bool { return versions[i].replaced.After(versions[j].replaced) })
+
+	for i, ver := range versions {
+		if v.keepLast > 0 && i >= v.keepLast || v.expired(ver.replaced) {
+			if err := v.store.Remove(ver.name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("cannot remove the version %s: %w", ver.name, err)
+			}
+			log.Infof("Removed old version %s", ver.name)
+		}
+	}
+	return nil
+}
+
+// expired returns true if the version replaced at the given time is older than keepDays
+func (v *versionKeeper) expired(replaced time.Time) bool {
+	return v.keepDays > 0 && v.now().Sub(replaced) > time.Duration(v.keepDays)*24*time.Hour
+}
+
+// versionTime returns the time the version has been replaced, added to its name before the
+// extension, if any
+func versionTime(file string) (time.Time, bool) {
+	for _, s := range []string{strings.TrimSuffix(file, path.Ext(file)), file} {
+		n := len(s) - len(versionTimeLayout)
+		if n < 2 || s[n-1] != '.' {
+			continue
+		}
+		if replaced, err := time.Parse(versionTimeLayout, s[n:]); err == nil {
+			return replaced, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// pruneExpired removes the versions older than keepDays in the given folder of versionsFolder
+// and in its subfolders, also the ones of the files that haven't been replaced again
+func (v *versionKeeper) pruneExpired(folder string) error {
+	if v.keepDays <= 0 {
+		return nil
+	}
+	files, err := v.store.List(path.Join(versionsFolder, folder))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot list the versions: %w", err)
+	}
+	for _, fi := range files {
+		name := path.Join(folder, fi.Name)
+		if fi.IsDir {
+			if err := v.pruneExpired(name); err != nil {
+				return err
+			}
+			continue
+		}
+		replaced, ok := versionTime(fi.Name)
+		if !ok || !v.expired(replaced) {
+			continue
+		}
+		if err := v.store.Remove(path.Join(versionsFolder, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("cannot remove the version %s: %w", name, err)
+		}
+		log.Infof("Removed old version %s", name)
+	}
+	return nil
+}
+
+// pruneVersions removes the expired versions at the end of the backup
+func (w *Worker) pruneVersions() {
+	if w.versions == nil {
+		return
+	}
+	if err := w.versions.pruneExpired(""); err != nil {
+		log.WithError(err).Error("cannot prune the previous versions")
+		w.errors.Add(1)
+	}
+}
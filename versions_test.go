@@ -0,0 +1,146 @@
+package smugmug
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tommyblue/smugmug-backup/storage"
+	"github.com/tommyblue/smugmug-backup/testutil"
+)
+
+func TestVersionKeeper(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	fs := afero.NewMemMapFs()
+	now := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	v := newVersionKeeper(storage.NewFs(fs), 2, 0)
+	v.now = func() time.Time { return now }
+
+	for _, name := range []string{"album/img.jpg", "album/noext"} {
+		for i := range 3 {
+			afero.WriteFile(fs, name, []byte{byte('0' + i)}, 0o644)
+			if err := v.keep(name, func() error { return nil }); err != nil {
+				t.Fatalf("keep: %v", err)
+			}
+			if exists, _ := afero.Exists(fs, name); exists {
+				t.Fatalf("want %s moved", name)
+			}
+			now = now.Add(24 * time.Hour)
+		}
+	}
+
+	// Only the last 2 versions of each file are kept
+	want := map[string]string{
+		".versions/album/img.20261002T120000Z.jpg": "1",
+		".versions/album/img.20261003T120000Z.jpg": "2",
+		".versions/album/noext.20261005T120000Z":   "1",
+		".versions/album/noext.20261006T120000Z":   "2",
+	}
+	files, _ := afero.ReadDir(fs, ".versions/album")
+	if len(files) != len(want) {
+		t.Fatalf("want %d versions, got %d", len(want), len(files))
+	}
+	for name, content := range want {
+		if got, err := afero.ReadFile(fs, name); err != nil || string(got) != content {
+			t.Fatalf("%s: want %q, got %q, %v", name, content, got, err)
+		}
+	}
+
+	// Missing files have no versions
+	if err := v.keep("album/missing.jpg", func() error { return nil }); err != nil {
+		t.Fatalf("keep: %v", err)
+	}
+
+	// The versions older than keep_days are removed at the end of the backup
+	v.keepDays = 1
+	if err := v.pruneExpired(""); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	files, _ = afero.ReadDir(fs, ".versions/album")
+	if len(files) != 1 || files[0].Name() != "noext.20261006T120000Z" {
+		t.Fatalf("want only the recent version, got %d files", len(files))
+	}
+}
+
+func TestDownloadKeepsVersion(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new content"))
+	}))
+	defer srv.Close()
+
+	fs := afero.NewMemMapFs()
+	store := storage.NewFs(fs)
+	afero.WriteFile(fs, "album/image.jpg", []byte("old"), 0o644)
+	h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", newMetrics(), nil, store)
+	h.versions = newVersionKeeper(store, 0, 0)
+	h.versions.now = func() time.Time { return time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC) }
+
+	if ok, err := h.download(context.Background(), "album/image.jpg", srv.URL+"/image.jpg", 11, ""); err != nil || !ok {
+		t.Fatalf("want downloaded, got %v %v", ok, err)
+	}
+	if got, _ := afero.ReadFile(fs, "album/image.jpg"); string(got) != "new content" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if got, _ := afero.ReadFile(fs, ".versions/album/image.20261018T100000Z.jpg"); string(got) != "old" {
+		t.Fatalf("want previous version kept, got %q", got)
+	}
+}
+
+// failingCloseStore is a storage whose atomic writes fail when closed, like the uploads whose
+// completion fails
+type failingCloseStore struct {
+	*storage.Fs
+}
+
+func (s *failingCloseStore) CreateAtomic(name string) (storage.AtomicWriter, error) {
+	return &failingCloseWriter{}, nil
+}
+
+type failingCloseWriter struct {
+	bytes.Buffer
+}
+
+func (w *failingCloseWriter) Close() error { return errors.New("upload failed") }
+func (w *failingCloseWriter) Abort()       {}
+
+func TestDownloadKeepsFileOnFailure(t *testing.T) {
+	defer testutil.DisableLogging()()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new content"))
+	}))
+	defer srv.Close()
+
+	// The versions are moved without links and linked with them
+	dir := t.TempDir()
+	for name, fs := range map[string]afero.Fs{
+		"move": afero.NewMemMapFs(),
+		"link": afero.NewBasePathFs(afero.NewOsFs(), dir),
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs.MkdirAll("album", 0o755)
+			afero.WriteFile(fs, "album/image.jpg", []byte("old"), 0o644)
+			store := &failingCloseStore{Fs: storage.NewFs(fs)}
+			h := newHTTPHandler(srv.URL, 1, "key", "secret", "token", "secret", newMetrics(), nil, store)
+			h.versions = newVersionKeeper(store, 0, 0)
+
+			if _, err := h.download(context.Background(), "album/image.jpg", srv.URL+"/image.jpg", 11, ""); err == nil {
+				t.Fatalf("want error")
+			}
+			if got, _ := afero.ReadFile(fs, "album/image.jpg"); string(got) != "old" {
+				t.Fatalf("want the current file left, got %q", got)
+			}
+			if versions, _ := afero.ReadDir(fs, ".versions/album"); len(versions) != 0 {
+				t.Fatalf("want no versions, got %d", len(versions))
+			}
+		})
+	}
+}